@@ -125,6 +125,8 @@ var (
 		utils.CacheGCFlag,
 		utils.CacheSnapshotFlag,
 		// utils.CacheNoPrefetchFlag,
+		utils.CacheNoSnapshotPrefetchFlag,
+		utils.CacheNoTriePrefetchInAdvanceFlag,
 		utils.CachePreimagesFlag,
 		utils.PersistDiffFlag,
 		utils.DiffBlockFlag,
@@ -509,6 +509,16 @@ var (
 		Usage:    "Disable heuristic state prefetch during block import (less CPU and disk IO, more time waiting for data)",
 		Category: flags.PerfCategory,
 	}
+	CacheNoSnapshotPrefetchFlag = &cli.BoolFlag{
+		Name:     "cache.nosnapshotprefetch",
+		Usage:    "Disable the speculative execution of large blocks ahead of their import to warm up the snapshot cache",
+		Category: flags.PerfCategory,
+	}
+	CacheNoTriePrefetchInAdvanceFlag = &cli.BoolFlag{
+		Name:     "cache.notrieprefetchinadvance",
+		Usage:    "Disable prefetching the trie nodes of the senders and recipients of large blocks ahead of their import",
+		Category: flags.PerfCategory,
+	}
 	CachePreimagesFlag = &cli.BoolFlag{
 		Name:     "cache.preimages",
 		Usage:    "Enable recording the SHA3/keccak preimages of trie keys",
@@ -1947,6 +1957,12 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *ethconfig.Config) {
 	if ctx.IsSet(CacheNoPrefetchFlag.Name) {
 		cfg.NoPrefetch = ctx.Bool(CacheNoPrefetchFlag.Name)
 	}
+	if ctx.IsSet(CacheNoSnapshotPrefetchFlag.Name) {
+		cfg.NoSnapshotPrefetch = ctx.Bool(CacheNoSnapshotPrefetchFlag.Name)
+	}
+	if ctx.IsSet(CacheNoTriePrefetchInAdvanceFlag.Name) {
+		cfg.NoTriePrefetchInAdvance = ctx.Bool(CacheNoTriePrefetchInAdvanceFlag.Name)
+	}
 	// Read the value from the flag no matter if it's set or not.
 	cfg.Preimages = ctx.Bool(CachePreimagesFlag.Name)
 	if cfg.NoPruning && !cfg.Preimages {
@@ -2529,6 +2545,9 @@ func MakeChain(ctx *cli.Context, stack *node.Node, readonly bool) (*core.BlockCh
 		Preimages:           ctx.Bool(CachePreimagesFlag.Name),
 		StateScheme:         scheme,
 		StateHistory:        ctx.Uint64(StateHistoryFlag.Name),
+
+		NoSnapshotPrefetch:      ctx.Bool(CacheNoSnapshotPrefetchFlag.Name),
+		NoTriePrefetchInAdvance: ctx.Bool(CacheNoTriePrefetchInAdvanceFlag.Name),
 	}
 	if cache.TrieDirtyDisabled && !cache.Preimages {
 		cache.Preimages = true
@@ -18,7 +18,9 @@ package core
 
 import (
 	"crypto/ecdsa"
+	"fmt"
 	"math/big"
+	"runtime"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -170,7 +172,33 @@ func genUncles(i int, gen *BlockGen) {
 	}
 }
 
+func BenchmarkInsertChain_ring1000_prefetch_none(b *testing.B) {
+	benchInsertChainWithPrefetch(b, false, false)
+}
+func BenchmarkInsertChain_ring1000_prefetch_snapshot(b *testing.B) {
+	benchInsertChainWithPrefetch(b, true, false)
+}
+func BenchmarkInsertChain_ring1000_prefetch_trie(b *testing.B) {
+	benchInsertChainWithPrefetch(b, false, true)
+}
+func BenchmarkInsertChain_ring1000_prefetch_both(b *testing.B) {
+	benchInsertChainWithPrefetch(b, true, true)
+}
+
+// benchInsertChainWithPrefetch measures the insertion of transaction heavy
+// blocks with the snapshot and the trie prefetch toggled independently.
+func benchInsertChainWithPrefetch(b *testing.B, snapshot, trie bool) {
+	config := *defaultCacheConfig
+	config.NoSnapshotPrefetch = !snapshot
+	config.NoTriePrefetchInAdvance = !trie
+	benchInsertChainWithConfig(b, true, &config, genTxRing(1000))
+}
+
 func benchInsertChain(b *testing.B, disk bool, gen func(int, *BlockGen)) {
+	benchInsertChainWithConfig(b, disk, nil, gen)
+}
+
+func benchInsertChainWithConfig(b *testing.B, disk bool, config *CacheConfig, gen func(int, *BlockGen)) {
 	// Create the database in memory or in a temporary directory.
 	var db ethdb.Database
 	var err error
@@ -195,7 +223,7 @@ func benchInsertChain(b *testing.B, disk bool, gen func(int, *BlockGen)) {
 
 	// Time the insertion of the new chain.
 	// State and blocks are stored in the same DB.
-	chainman, _ := NewBlockChain(db, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	chainman, _ := NewBlockChain(db, config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
 	defer chainman.Stop()
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -329,3 +357,45 @@ func benchReadChain(b *testing.B, full bool, count uint64) {
 		db.Close()
 	}
 }
+
+// BenchmarkSenderCacher measures how quickly the senders of a block full of
+// transactions become available with different numbers of recovery workers.
+func BenchmarkSenderCacher(b *testing.B) {
+	var (
+		signer = types.LatestSigner(params.TestChainConfig)
+		blobs  = make([][]byte, 2000)
+	)
+	for i := range blobs {
+		tx, _ := types.SignNewTx(benchRootKey, signer, &types.LegacyTx{
+			Nonce:    uint64(i),
+			To:       &common.Address{},
+			Value:    big.NewInt(1),
+			Gas:      params.TxGas,
+			GasPrice: big.NewInt(params.InitialBaseFee),
+		})
+		blobs[i], _ = tx.MarshalBinary()
+	}
+	for _, workers := range []int{1, 2, 4, 8, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			cacher := newTxSenderCacher(workers)
+			defer cacher.close()
+
+			txs := make([]*types.Transaction, len(blobs))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Decode fresh transactions to drop the cached senders
+				b.StopTimer()
+				for j, blob := range blobs {
+					txs[j] = new(types.Transaction)
+					txs[j].UnmarshalBinary(blob)
+				}
+				b.StartTimer()
+
+				cacher.Recover(signer, txs)
+				for _, tx := range txs {
+					types.Sender(signer, tx)
+				}
+			}
+		})
+	}
+}
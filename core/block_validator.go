@@ -231,6 +231,18 @@ func (v *BlockValidator) RemoteVerifyManager() *remoteVerifyManager {
 	return v.remoteValidator
 }
 
+// remoteVerifyValidator keeps the remote verify manager of a replaced validator
+// reachable through a validator without one, so that the verify responses are
+// still delivered to it.
+type remoteVerifyValidator struct {
+	Validator
+	manager *remoteVerifyManager
+}
+
+func (v *remoteVerifyValidator) RemoteVerifyManager() *remoteVerifyManager {
+	return v.manager
+}
+
 // CalcGasLimit computes the gas limit of the next block after parent. It aims
 // to keep the baseline gas close to the provided target, and increase it towards
 // the target if the baseline gas is lower.
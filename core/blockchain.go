@@ -18,11 +18,15 @@
 package core
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
+	"math/rand"
 	"runtime"
+	"slices"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -30,7 +34,6 @@ import (
 
 	mapset "github.com/deckarep/golang-set/v2"
 	exlru "github.com/hashicorp/golang-lru"
-	"golang.org/x/crypto/sha3"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/lru"
@@ -45,6 +48,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/systemcontracts"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/internal/syncx"
@@ -53,6 +57,8 @@ import (
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/trie/trienode"
 	"github.com/ethereum/go-ethereum/triedb"
 	"github.com/ethereum/go-ethereum/triedb/hashdb"
 	"github.com/ethereum/go-ethereum/triedb/pathdb"
@@ -67,6 +73,12 @@ var (
 	headBlockGauge     = metrics.NewRegisteredGauge("chain/head/block", nil)
 	headHeaderGauge    = metrics.NewRegisteredGauge("chain/head/header", nil)
 	headFastBlockGauge = metrics.NewRegisteredGauge("chain/head/receipt", nil)
+	headLagGauge       = metrics.NewRegisteredGauge("chain/head/lag", nil) // Seconds between the head block timestamp and now
+
+	txLookupCacheGauge = metrics.NewRegisteredGauge("chain/txlookup/cache/size", nil)
+	receiptsCacheGauge = metrics.NewRegisteredGauge("chain/receipts/cache/size", nil)
+	blockCacheGauge    = metrics.NewRegisteredGauge("chain/blocks/cache/size", nil)
+	bodyCacheGauge     = metrics.NewRegisteredGauge("chain/bodies/cache/size", nil)
 
 	justifiedBlockGauge = metrics.NewRegisteredGauge("chain/head/justified", nil)
 	finalizedBlockGauge = metrics.NewRegisteredGauge("chain/head/finalized", nil)
@@ -85,46 +97,81 @@ var (
 	storageUpdateTimer = metrics.NewRegisteredTimer("chain/storage/updates", nil)
 	storageCommitTimer = metrics.NewRegisteredTimer("chain/storage/commits", nil)
 
+	accountTrieReadGauge = metrics.NewRegisteredGauge("chain/account/trie/reads", nil)
+	storageTrieReadGauge = metrics.NewRegisteredGauge("chain/storage/trie/reads", nil)
+
 	snapshotAccountReadTimer = metrics.NewRegisteredTimer("chain/snapshot/account/reads", nil)
 	snapshotStorageReadTimer = metrics.NewRegisteredTimer("chain/snapshot/storage/reads", nil)
 	snapshotCommitTimer      = metrics.NewRegisteredTimer("chain/snapshot/commits", nil)
 
 	triedbCommitTimer = metrics.NewRegisteredTimer("chain/triedb/commits", nil)
 
+	trieDirtyGauge    = metrics.NewRegisteredGauge("chain/trie/dirty/bytes", nil)
+	triePreimageGauge = metrics.NewRegisteredGauge("chain/trie/preimage/bytes", nil)
+	trieCapCounter    = metrics.NewRegisteredCounter("chain/trie/caps", nil)
+
+	chainMuWaitTimer = metrics.NewRegisteredTimer("chain/mu/wait", nil)
+	chainMuHeldGauge = metrics.NewRegisteredGauge("chain/mu/held", nil) // Only the most recent hold time
+
 	blockInsertTimer     = metrics.NewRegisteredTimer("chain/inserts", nil)
 	blockValidationTimer = metrics.NewRegisteredTimer("chain/validation", nil)
 	blockExecutionTimer  = metrics.NewRegisteredTimer("chain/execution", nil)
 	blockWriteTimer      = metrics.NewRegisteredTimer("chain/write", nil)
 
-	blockReorgMeter     = metrics.NewRegisteredMeter("chain/reorg/executes", nil)
-	blockReorgAddMeter  = metrics.NewRegisteredMeter("chain/reorg/add", nil)
-	blockReorgDropMeter = metrics.NewRegisteredMeter("chain/reorg/drop", nil)
+	blockReorgMeter      = metrics.NewRegisteredMeter("chain/reorg/executes", nil)
+	blockReorgAddMeter   = metrics.NewRegisteredMeter("chain/reorg/add", nil)
+	blockReorgDropMeter  = metrics.NewRegisteredMeter("chain/reorg/drop", nil)
+	blockReorgChurnMeter = metrics.NewRegisteredMeter("chain/reorg/churn", nil)
+
+	reorgReexecBlocksGauge = metrics.NewRegisteredGauge("chain/reorg/reexec/blocks", nil)
+	reorgReexecTimer       = metrics.NewRegisteredTimer("chain/reorg/reexec/time", nil)
+
+	futureQueuedGauge   = metrics.NewRegisteredGauge("chain/future/queued", nil)
+	futurePromotedMeter = metrics.NewRegisteredMeter("chain/future/promoted", nil)
+
+	diffQueueDropMeter = metrics.NewRegisteredMeter("chain/diff/queue/drop", nil)
+	diffApplyMeter     = metrics.NewRegisteredMeter("chain/diff/apply", nil)
+	diffFallbackMeter  = metrics.NewRegisteredMeter("chain/diff/fallback", nil)
 
 	errStateRootVerificationFailed = errors.New("state root verification failed")
 	errInsertionInterrupted        = errors.New("insertion is interrupted")
 	errChainStopped                = errors.New("blockchain is stopped")
 	errInvalidOldChain             = errors.New("invalid old chain")
 	errInvalidNewChain             = errors.New("invalid new chain")
+	errDiffLayerMismatch           = errors.New("diff layer mismatch")
+	errDiffFollowerDisabled        = errors.New("diff follower mode disabled")
 )
 
 const (
-	bodyCacheLimit      = 256
-	blockCacheLimit     = 256
-	diffLayerCacheLimit = 1024
-	receiptsCacheLimit  = 10000
-	sidecarsCacheLimit  = 1024
-	txLookupCacheLimit  = 1024
-	maxBadBlockLimit    = 16
-	maxFutureBlocks     = 256
-	maxTimeFutureBlocks = 30
-	TriesInMemory       = 128
-	maxBeyondBlocks     = 2048
-	prefetchTxNumber    = 100
+	bodyCacheLimit        = 256
+	blockCacheLimit       = 256
+	diffLayerCacheLimit   = 1024
+	diffQueueBufferLimit  = 1024
+	receiptsCacheLimit    = 10000
+	receiptsRLPCacheLimit = 256
+	sidecarsCacheLimit    = 1024
+	txLookupCacheLimit    = 1024
+	gasThroughputWindow   = 1000
+	maxBadBlockLimit      = 16
+	maxFutureBlocks       = 256
+	maxTimeFutureBlocks   = 30
+	TriesInMemory         = 128
+	maxBeyondBlocks       = 2048
+	prefetchTxNumber      = 100
 
 	diffLayerFreezerRecheckInterval = 3 * time.Second
-	maxDiffForkDist                 = 11 // Maximum allowed backward distance from the chain head
-
-	rewindBadBlockInterval = 1 * time.Second
+	snapGenRecheckInterval          = 3 * time.Second
+	maxDiffForkDist                 = 11   // Maximum allowed backward distance from the chain head
+	maxPinnedStates                 = 16   // Number of pinned state roots above which a memory warning is emitted
+	maxDiffAccountsRange            = 1024 // Maximum number of blocks scanned by GetDiffAccountsForRange
+	maxCanonicalHashesRange         = 1024 // Maximum number of hashes returned by GetCanonicalHashes
+	replayBlockReexec               = 128  // Maximum number of ancestors re-executed to rebuild the state of a replay
+	reorgChurnWarnThreshold         = 3    // Number of consecutive reorgs at the same height above which a warning is emitted
+	maxCommonAncestorDepth          = 1024 // Maximum number of blocks walked back by GetCommonAncestor
+
+	rewindBadBlockInterval    = 1 * time.Second
+	minRewindBadBlockInterval = 100 * time.Millisecond
+	diffAccountsWaitTimeout   = 1 * time.Second // Maximum time GetDiffAccountsForRange waits for a diff layer being cached
 
 	// BlockChainVersion ensures that an incompatible database forces a resync from scratch.
 	//
@@ -169,9 +216,88 @@ type CacheConfig struct {
 	PathSyncFlush       bool          // Whether sync flush the trienodebuffer of pathdb to disk.
 	JournalFilePath     string
 	JournalFile         bool
+	DiffLayerCacheLimit int           // Number of diff layers to cache in memory, default is used if zero
+	DiffQueueBufferSize int           // Number of diff layers buffered for persistence, default is used if zero
+	ResidentDiffLayers  int           // Number of recent diff layers kept cached after persistence, 0 leaves it to the LRU
+	TxLookupCacheLimit  int           // Number of transaction lookups to cache in memory, default is used if zero
+	ReceiptsCacheLimit  int           // Number of block receipts to cache in memory, default is used if zero
+	BlockCacheLimit     int           // Number of blocks to cache in memory, default is used if zero
+	BodyCacheLimit      int           // Number of block bodies to cache in memory, default is used if zero
+	GasThroughputWindow int           // Number of recent blocks measured by RecentGasThroughput, default is used if zero
+	MaxDiffForkDist     uint64        // Maximum distance from the head of blocks verified as possible forks, default is used if zero
+	HeadEventCoalesce   time.Duration // Window within which only the latest chain head event is sent, 0 disables it
+
+	// NoSnapshotPrefetch disables the speculative execution of the transactions
+	// of large blocks ahead of the processing, which warms up the snapshot cache.
+	// The prefetch pays off for state read heavy blocks, at the cost of executing
+	// them twice. The BenchmarkInsertChain_ring1000_prefetch_* benchmarks measure
+	// the import of such blocks with either prefetch toggled.
+	NoSnapshotPrefetch bool
+	// NoTriePrefetchInAdvance disables loading the trie paths of the senders and
+	// the recipients of large blocks ahead of the processing. The prefetch is
+	// cheaper than the snapshot one as nothing is executed, but only covers the
+	// accounts known upfront and not the contract storage.
+	NoTriePrefetchInAdvance bool
+
+	// ShutdownCommitOffsets are the distances from the head of the blocks whose
+	// state is committed to disk on shutdown, {0, 1, TriesInMemory-1} if empty.
+	// The head marker is moved to the closest committed block, offsets beyond the
+	// genesis block are skipped.
+	ShutdownCommitOffsets []uint64
+
+	// StrictBodyValidation re-derives the transaction and uncle roots of every
+	// imported block before executing it, independently of the engine and the
+	// validator checks. Off by default as those usually cover it already.
+	StrictBodyValidation bool
+
+	// StrictGasValidation compares the gas used reported by the processor for
+	// every imported block against its header, before the state validation.
+	// Off by default as the validator already checks it.
+	StrictGasValidation bool
+
+	// RetainOrphanReceipts keeps a copy of the receipts of the blocks reorged out
+	// of the canonical chain, retrievable with GetOrphanReceipts. These are never
+	// pruned, so the database grows with every dropped block, and side chains are
+	// otherwise wiped from the database once frozen. Off by default.
+	RetainOrphanReceipts bool
+
+	// PreimageFilter selects the SHA3 preimages seen by the VM that are written
+	// along with the blocks, e.g. only the keys of the debugged contracts to save
+	// disk. It is called with the preimage and all of them are stored if nil.
+	// Preimages are debug data, filtering them does not affect consensus.
+	PreimageFilter func(preimage []byte) bool
+
+	// SenderCacheWorkers is the number of goroutines recovering the transaction
+	// senders ahead of block import. The recovery runs in parallel with the block
+	// processing, so it only speeds up the import if it stays ahead of execution.
+	// Too few workers leave the processor waiting on signature verification during
+	// bulk import, too many compete with it for CPU. The shared cacher with one
+	// worker per CPU is used if zero.
+	SenderCacheWorkers int
+
+	IdleFlushDelay         time.Duration // Time without block imports after which the head state is flushed to disk, 0 disables it
+	RewindBadBlockInterval time.Duration // Interval of the pipeline commit bad block checks, default is used if zero
 
 	SnapshotNoBuild bool // Whether the background generation is allowed
 	SnapshotWait    bool // Wait for snapshot construction on startup. TODO(karalabe): This is a dirty hack for testing, nuke it
+
+	// SyncDiffPersistence sorts, caches and queues the diff layer of an imported
+	// block for persistence before the import returns, instead of in the
+	// background. Testing only, it slows down the block import.
+	SyncDiffPersistence bool
+}
+
+// rewindBadBlockInterval returns the interval of the pipeline commit bad block
+// checks, capped to minRewindBadBlockInterval to avoid spinning on the chain lock.
+func (c *CacheConfig) rewindBadBlockInterval() time.Duration {
+	switch {
+	case c.RewindBadBlockInterval == 0:
+		return rewindBadBlockInterval
+	case c.RewindBadBlockInterval < minRewindBadBlockInterval:
+		log.Warn("Bad block rewind interval too low, increasing", "provided", c.RewindBadBlockInterval, "updated", minRewindBadBlockInterval)
+		return minRewindBadBlockInterval
+	}
+	return c.RewindBadBlockInterval
 }
 
 // triedbConfig derives the configures for trie database.
@@ -248,11 +374,13 @@ type BlockChain struct {
 	cacheConfig *CacheConfig        // Cache configuration for pruning
 
 	db            ethdb.Database                   // Low level persistent database to store final content in
-	snaps         *snapshot.Tree                   // Snapshot tree for fast trie leaf access
+	snaps         atomic.Pointer[snapshot.Tree]    // Snapshot tree for fast trie leaf access, nil if disabled
 	triegc        *prque.Prque[int64, common.Hash] // Priority queue mapping block numbers to tries to gc
 	gcproc        time.Duration                    // Accumulates canonical block processing for trie dumping
 	commitLock    sync.Mutex                       // CommitLock is used to protect above field from being modified concurrently
+	pinnedRoots   map[common.Hash]int              // State roots exempted from trie GC, mapped to their pending dereferences
 	lastWrite     uint64                           // Last block when the state was flushed
+	lastInsert    atomic.Int64                     // Unix nano time when the last chain insertion finished
 	flushInterval atomic.Int64                     // Time interval (processing time) after which to flush a state
 	triedb        *triedb.Database                 // The database handler for maintaining trie nodes.
 	stateCache    state.Database                   // State database to reuse between imports (contains state cache)
@@ -263,11 +391,17 @@ type BlockChain struct {
 	rmLogsFeed          event.Feed
 	chainFeed           event.Feed
 	chainSideFeed       event.Feed
+	chainSideBatchFeed  event.Feed
 	chainHeadFeed       event.Feed
 	chainBlockFeed      event.Feed
 	logsFeed            event.Feed
 	blockProcFeed       event.Feed
 	finalizedHeaderFeed event.Feed
+	snapGenFeed         event.Feed
+	doubleSignFeed      event.Feed
+	feedSubs            map[string]int // Number of active subscriptions per feed
+	feedSubsLock        sync.Mutex
+	headEventCh         chan ChainHeadEvent // Channel of the head event coalescer, nil if disabled
 	scope               event.SubscriptionScope
 	genesisBlock        *types.Block
 
@@ -275,30 +409,41 @@ type BlockChain struct {
 	// Readers don't need to take it, they can just read the database.
 	chainmu *syncx.ClosableMutex
 
+	// chainmuSince is the time the chain mutex was taken via lockChain in unix
+	// nanoseconds, zero if it is not held.
+	chainmuSince atomic.Int64
+
 	highestVerifiedHeader atomic.Pointer[types.Header]
 	currentBlock          atomic.Pointer[types.Header] // Current head of the chain
 	currentSnapBlock      atomic.Pointer[types.Header] // Current head of snap-sync
 	currentFinalBlock     atomic.Pointer[types.Header] // Latest (consensus) finalized block
 	chasingHead           atomic.Pointer[types.Header]
 
-	bodyCache     *lru.Cache[common.Hash, *types.Body]
-	bodyRLPCache  *lru.Cache[common.Hash, rlp.RawValue]
-	receiptsCache *lru.Cache[common.Hash, []*types.Receipt]
-	blockCache    *lru.Cache[common.Hash, *types.Block]
-	txLookupCache *lru.Cache[common.Hash, txLookup]
-	sidecarsCache *lru.Cache[common.Hash, types.BlobSidecars]
+	bodyCache        *lru.Cache[common.Hash, *types.Body]
+	bodyRLPCache     *lru.Cache[common.Hash, rlp.RawValue]
+	receiptsCache    *lru.Cache[common.Hash, []*types.Receipt]
+	receiptsRLPCache *lru.Cache[common.Hash, rlp.RawValue]
+	blockCache       *lru.Cache[common.Hash, *types.Block]
+	txLookupCache    *lru.Cache[common.Hash, txLookup]
+	sidecarsCache    *lru.Cache[common.Hash, types.BlobSidecars]
 
 	// future blocks are blocks added for later processing
 	futureBlocks *lru.Cache[common.Hash, *types.Block]
 	// Cache for the blocks that failed to pass MPT root verification
 	badBlockCache *lru.Cache[common.Hash, time.Time]
 
+	senderCacher *txSenderCacher // Background transaction sender recoverer
+
 	// trusted diff layers
 	diffLayerCache             *exlru.Cache                          // Cache for the diffLayers
 	diffLayerChanCache         *exlru.Cache                          // Cache for the difflayer channel
+	diffLayerChanLock          sync.Mutex                            // Lock serializing the closing of the difflayer channels
+	diffLayerCacheSize         int                                   // Maximum number of entries in the diff layer caches
 	diffQueue                  *prque.Prque[int64, *types.DiffLayer] // A Priority queue to store recent diff layer
 	diffQueueBuffer            chan *types.DiffLayer
 	diffLayerFreezerBlockLimit uint64
+	residentDiffLayers         uint64 // Number of recent blocks whose diff layers stay cached after persistence
+	maxDiffForkDist            uint64 // Maximum distance from the head of the blocks considered possible forks
 
 	wg            sync.WaitGroup
 	quit          chan struct{} // shutdown signal, closed in Stop.
@@ -307,14 +452,57 @@ type BlockChain struct {
 
 	engine     consensus.Engine
 	prefetcher Prefetcher
-	validator  Validator // Block and state validator interface
-	processor  Processor // Block transaction processor interface
+	validator  atomic.Pointer[Validator] // Block and state validator interface, replaceable at runtime
+	processor  atomic.Pointer[Processor] // Block transaction processor interface, replaceable at runtime
 	forker     *ForkChoice
 	vmConfig   vm.Config
 	pipeCommit bool
 
+	// remoteVerifyFraction is the fraction of blocks verified remotely in the
+	// remote verify mode, 0 verifies all of them.
+	remoteVerifyFraction float64
+
+	// finalityReorgProtection rejects the reorgs dropping finalized blocks.
+	finalityReorgProtection bool
+
+	// diffFollower allows importing blocks by applying their diff layers.
+	diffFollower bool
+
+	// reorgChurn counts the consecutive single block reorgs at the same height,
+	// reorgChurnHeight is the height they happened at. Guarded by chainmu.
+	reorgChurn       int
+	reorgChurnHeight uint64
+
+	// senderFilter reports the transaction senders whose blocks are rejected.
+	senderFilter func(common.Address) bool
+
+	// insertResults collects the per block outcome of a detailed chain insertion,
+	// nil otherwise. Protected by chainmu.
+	insertResults map[common.Hash]BlockInsertResult
+
+	// snapJournalLock serializes the snapshot journaling of JournalSnapshot.
+	snapJournalLock sync.Mutex
+
+	// headHooks are invoked synchronously on every canonical head change, in
+	// registration order.
+	headHooks     []headHook
+	headHookID    uint64
+	headHooksLock sync.RWMutex
+
+	// gasWindow measures the gas throughput of the recently imported blocks.
+	gasWindow *gasWindow
+
+	// insertTotals aggregates the insertion stats of all chain insertions.
+	insertTotals     InsertStatsSnapshot
+	insertTotalsLock sync.Mutex
+
+	// lastReorgReexec is the cost of the last pruned state re-execution.
+	lastReorgReexec     ReorgReexecStats
+	lastReorgReexecLock sync.Mutex
+
 	// monitor
-	doubleSignMonitor *monitor.DoubleSignMonitor
+	doubleSignMonitor        *monitor.DoubleSignMonitor
+	doubleSignMonitorEnabled atomic.Bool // Whether the chain head events are verified by the monitor
 }
 
 // NewBlockChain returns a fully initialised block chain using information
@@ -331,8 +519,43 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, genesis *Genesis
 			"triesInMemory", cacheConfig.TriesInMemory, "scheme", cacheConfig.StateScheme)
 	}
 
-	diffLayerCache, _ := exlru.New(diffLayerCacheLimit)
-	diffLayerChanCache, _ := exlru.New(diffLayerCacheLimit)
+	diffLayerCacheSize := cacheConfig.DiffLayerCacheLimit
+	if diffLayerCacheSize <= 0 {
+		diffLayerCacheSize = diffLayerCacheLimit
+	}
+	txLookupCacheSize := cacheConfig.TxLookupCacheLimit
+	if txLookupCacheSize <= 0 {
+		txLookupCacheSize = txLookupCacheLimit
+	}
+	receiptsCacheSize := cacheConfig.ReceiptsCacheLimit
+	if receiptsCacheSize <= 0 {
+		receiptsCacheSize = receiptsCacheLimit
+	}
+	blockCacheSize := cacheConfig.BlockCacheLimit
+	if blockCacheSize <= 0 {
+		blockCacheSize = blockCacheLimit
+	}
+	bodyCacheSize := cacheConfig.BodyCacheLimit
+	if bodyCacheSize <= 0 {
+		bodyCacheSize = bodyCacheLimit
+	}
+	gasWindowSize := cacheConfig.GasThroughputWindow
+	if gasWindowSize <= 0 {
+		gasWindowSize = gasThroughputWindow
+	}
+	diffQueueBufferSize := cacheConfig.DiffQueueBufferSize
+	if diffQueueBufferSize <= 0 {
+		diffQueueBufferSize = diffQueueBufferLimit
+	}
+	diffLayerCache, _ := exlru.New(diffLayerCacheSize)
+
+	// Every resident diff layer holds the full state diff of its block, which is
+	// up to a few megabytes for busy blocks, the window is bounded by the cache.
+	residentDiffLayers := cacheConfig.ResidentDiffLayers
+	if residentDiffLayers > diffLayerCacheSize {
+		log.Warn("Resident diff layers exceed the diff layer cache", "provided", residentDiffLayers, "updated", diffLayerCacheSize)
+		residentDiffLayers = diffLayerCacheSize
+	}
 
 	// Open trie database with provided config
 	triedb := triedb.NewDatabase(db, cacheConfig.triedbConfig())
@@ -363,30 +586,46 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, genesis *Genesis
 		db:                 db,
 		triedb:             triedb,
 		triegc:             prque.New[int64, common.Hash](nil),
+		pinnedRoots:        make(map[common.Hash]int),
 		quit:               make(chan struct{}),
 		triesInMemory:      cacheConfig.TriesInMemory,
 		chainmu:            syncx.NewClosableMutex(),
-		bodyCache:          lru.NewCache[common.Hash, *types.Body](bodyCacheLimit),
-		bodyRLPCache:       lru.NewCache[common.Hash, rlp.RawValue](bodyCacheLimit),
-		receiptsCache:      lru.NewCache[common.Hash, []*types.Receipt](receiptsCacheLimit),
+		bodyCache:          lru.NewCache[common.Hash, *types.Body](bodyCacheSize),
+		bodyRLPCache:       lru.NewCache[common.Hash, rlp.RawValue](bodyCacheSize),
+		receiptsCache:      lru.NewCache[common.Hash, []*types.Receipt](receiptsCacheSize),
+		receiptsRLPCache:   lru.NewCache[common.Hash, rlp.RawValue](receiptsRLPCacheLimit),
 		sidecarsCache:      lru.NewCache[common.Hash, types.BlobSidecars](sidecarsCacheLimit),
-		blockCache:         lru.NewCache[common.Hash, *types.Block](blockCacheLimit),
-		txLookupCache:      lru.NewCache[common.Hash, txLookup](txLookupCacheLimit),
+		blockCache:         lru.NewCache[common.Hash, *types.Block](blockCacheSize),
+		txLookupCache:      lru.NewCache[common.Hash, txLookup](txLookupCacheSize),
 		futureBlocks:       lru.NewCache[common.Hash, *types.Block](maxFutureBlocks),
 		badBlockCache:      lru.NewCache[common.Hash, time.Time](maxBadBlockLimit),
 		diffLayerCache:     diffLayerCache,
-		diffLayerChanCache: diffLayerChanCache,
+		diffLayerCacheSize: diffLayerCacheSize,
 		engine:             engine,
 		vmConfig:           vmConfig,
 		diffQueue:          prque.New[int64, *types.DiffLayer](nil),
-		diffQueueBuffer:    make(chan *types.DiffLayer),
+		diffQueueBuffer:    make(chan *types.DiffLayer, diffQueueBufferSize),
+		gasWindow:          newGasWindow(gasWindowSize),
+		maxDiffForkDist:    maxDiffForkDist,
+	}
+	if cacheConfig.MaxDiffForkDist > 0 {
+		bc.maxDiffForkDist = cacheConfig.MaxDiffForkDist
 	}
+	if residentDiffLayers > 0 {
+		bc.residentDiffLayers = uint64(residentDiffLayers)
+	}
+	// Release the waiters of the diff layers evicted before being cached
+	bc.diffLayerChanCache, _ = exlru.NewWithEvict(diffLayerCacheSize, func(key, value interface{}) {
+		bc.closeDiffLayerCh(value.(chan struct{}))
+	})
 	bc.flushInterval.Store(int64(cacheConfig.TrieTimeLimit))
 	bc.forker = NewForkChoice(bc, shouldPreserve)
 	bc.stateCache = state.NewDatabaseWithNodeDB(bc.db, bc.triedb)
-	bc.validator = NewBlockValidator(chainConfig, bc, engine)
+	var validator Validator = NewBlockValidator(chainConfig, bc, engine)
+	bc.validator.Store(&validator)
 	bc.prefetcher = NewStatePrefetcher(chainConfig, bc, engine)
-	bc.processor = NewStateProcessor(chainConfig, bc, engine)
+	var processor Processor = NewStateProcessor(chainConfig, bc, engine)
+	bc.processor.Store(&processor)
 
 	var err error
 	bc.hc, err = NewHeaderChain(db, chainConfig, engine, bc.insertStopped)
@@ -490,7 +729,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, genesis *Genesis
 		}
 		if needRewind {
 			log.Error("Truncating ancient chain", "from", bc.CurrentHeader().Number.Uint64(), "to", low)
-			if err := bc.SetHead(low); err != nil {
+			if _, err := bc.setHead(low); err != nil {
 				return nil, err
 			}
 		}
@@ -508,7 +747,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, genesis *Genesis
 			// make sure the headerByNumber (if present) is in our current canonical chain
 			if headerByNumber != nil && headerByNumber.Hash() == header.Hash() {
 				log.Error("Found bad hash, rewinding chain", "number", header.Number, "hash", header.ParentHash)
-				if err := bc.SetHead(header.Number.Uint64() - 1); err != nil {
+				if _, err := bc.setHead(header.Number.Uint64() - 1); err != nil {
 					return nil, err
 				}
 				log.Error("Chain rewind was successful, resuming normal operation")
@@ -535,7 +774,8 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, genesis *Genesis
 			NoBuild:    bc.cacheConfig.SnapshotNoBuild,
 			AsyncBuild: !bc.cacheConfig.SnapshotWait,
 		}
-		bc.snaps, _ = snapshot.New(snapconfig, bc.db, bc.triedb, head.Root, int(bc.cacheConfig.TriesInMemory), bc.NoTries())
+		snaps, _ := snapshot.New(snapconfig, bc.db, bc.triedb, head.Root, int(bc.cacheConfig.TriesInMemory), bc.NoTries())
+		bc.snaps.Store(snaps)
 	}
 	// do options before start any routine
 	for _, option := range options {
@@ -548,15 +788,38 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, genesis *Genesis
 	bc.wg.Add(1)
 	go bc.updateFutureBlocks()
 
+	bc.senderCacher = SenderCacher
+	if workers := bc.cacheConfig.SenderCacheWorkers; workers > 0 {
+		bc.senderCacher = newTxSenderCacher(workers)
+	}
+
+	if bc.cacheConfig.HeadEventCoalesce > 0 {
+		bc.headEventCh = make(chan ChainHeadEvent)
+		bc.wg.Add(1)
+		go bc.headEventLoop(bc.cacheConfig.HeadEventCoalesce)
+	}
+
 	// Need persist and prune diff layer
 	if bc.db.DiffStore() != nil {
 		bc.wg.Add(1)
 		go bc.trustedDiffLayerLoop()
 	}
+	// The generation tracker tolerates a missing snapshot, run it whenever the
+	// snapshot can be enabled at runtime.
+	if bc.cacheConfig.SnapshotLimit > 0 {
+		bc.wg.Add(1)
+		go bc.snapGenLoop()
+	}
+	// Archive nodes flush every state and path based nodes manage their own
+	// buffer, idle flushing is only meaningful for hash based full nodes.
+	if delay := bc.cacheConfig.IdleFlushDelay; delay > 0 && !bc.cacheConfig.TrieDirtyDisabled && bc.triedb.Scheme() == rawdb.HashScheme {
+		bc.wg.Add(1)
+		go bc.idleFlushLoop(delay)
+	}
 	if bc.pipeCommit {
 		// check current block and rewind invalid one
 		bc.wg.Add(1)
-		go bc.rewindInvalidHeaderBlockLoop()
+		go bc.rewindInvalidHeaderBlockLoop(bc.cacheConfig.rewindBadBlockInterval())
 	}
 
 	if bc.doubleSignMonitor != nil {
@@ -570,7 +833,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, genesis *Genesis
 		if compat.RewindToTime > 0 {
 			bc.SetHeadWithTimestamp(compat.RewindToTime)
 		} else {
-			bc.SetHead(compat.RewindToBlock)
+			bc.setHead(compat.RewindToBlock)
 		}
 		rawdb.WriteChainConfig(db, genesisHash, chainConfig)
 	}
@@ -590,11 +853,14 @@ func (bc *BlockChain) NoTries() bool {
 	return bc.stateCache.NoTries()
 }
 
+// possibleSystemReceipts is the number of trailing receipts in a block that might
+// belong to system transactions: one slash tx, two reward distribute txs.
+const possibleSystemReceipts = 3
+
 func (bc *BlockChain) cacheReceipts(hash common.Hash, receipts types.Receipts, block *types.Block) {
 	// TODO, This is a hot fix for the block hash of logs is `0x0000000000000000000000000000000000000000000000000000000000000000` for system tx
 	// Please check details in https://github.com/bnb-chain/bsc/issues/443
 	// This is a temporary fix, the official fix should be a hard fork.
-	const possibleSystemReceipts = 3 // One slash tx, two reward distribute txs.
 	numOfReceipts := len(receipts)
 	for i := numOfReceipts - 1; i >= 0 && i >= numOfReceipts-possibleSystemReceipts; i-- {
 		for j := 0; j < len(receipts[i].Logs); j++ {
@@ -619,13 +885,16 @@ func (bc *BlockChain) cacheReceipts(hash common.Hash, receipts types.Receipts, b
 	}
 
 	bc.receiptsCache.Add(hash, receipts)
+	receiptsCacheGauge.Update(int64(bc.receiptsCache.Len()))
 }
 
-func (bc *BlockChain) cacheDiffLayer(diffLayer *types.DiffLayer, diffLayerCh chan struct{}) {
-	// The difflayer in the system is stored by the map structure,
-	// so it will be out of order.
-	// It must be sorted first and then cached,
-	// otherwise the DiffHash calculated by different nodes will be inconsistent
+// sortDiffLayer sorts the content of the diff layer in place.
+//
+// The difflayer in the system is stored by the map structure,
+// so it will be out of order.
+// It must be sorted first and then cached,
+// otherwise the DiffHash calculated by different nodes will be inconsistent
+func sortDiffLayer(diffLayer *types.DiffLayer) {
 	sort.SliceStable(diffLayer.Codes, func(i, j int) bool {
 		return diffLayer.Codes[i].Hash.Hex() < diffLayer.Codes[j].Hash.Hex()
 	})
@@ -642,22 +911,104 @@ func (bc *BlockChain) cacheDiffLayer(diffLayer *types.DiffLayer, diffLayerCh cha
 		// Sort keys and vals by key.
 		sort.Sort(&diffLayer.Storages[index])
 	}
+}
+
+// diffLayerSorted reports whether the content of the diff layer is already in
+// the order established by sortDiffLayer.
+func diffLayerSorted(diffLayer *types.DiffLayer) bool {
+	if !sort.SliceIsSorted(diffLayer.Codes, func(i, j int) bool {
+		return diffLayer.Codes[i].Hash.Hex() < diffLayer.Codes[j].Hash.Hex()
+	}) {
+		return false
+	}
+	if !sort.SliceIsSorted(diffLayer.Destructs, func(i, j int) bool {
+		return diffLayer.Destructs[i].Hex() < diffLayer.Destructs[j].Hex()
+	}) {
+		return false
+	}
+	if !sort.SliceIsSorted(diffLayer.Accounts, func(i, j int) bool {
+		return diffLayer.Accounts[i].Account.Hex() < diffLayer.Accounts[j].Account.Hex()
+	}) {
+		return false
+	}
+	if !sort.SliceIsSorted(diffLayer.Storages, func(i, j int) bool {
+		return diffLayer.Storages[i].Account.Hex() < diffLayer.Storages[j].Account.Hex()
+	}) {
+		return false
+	}
+	for index := range diffLayer.Storages {
+		if !sort.IsSorted(&diffLayer.Storages[index]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedDiffLayer returns the diff layer itself if its content is already
+// sorted, otherwise a sorted copy of it. The given diff layer is never modified,
+// as it might be shared with concurrent readers.
+func sortedDiffLayer(diffLayer *types.DiffLayer) *types.DiffLayer {
+	if diffLayerSorted(diffLayer) {
+		return diffLayer
+	}
+	sorted := &types.DiffLayer{
+		BlockHash: diffLayer.BlockHash,
+		Number:    diffLayer.Number,
+		Receipts:  diffLayer.Receipts,
+		Codes:     slices.Clone(diffLayer.Codes),
+		Destructs: slices.Clone(diffLayer.Destructs),
+		Accounts:  slices.Clone(diffLayer.Accounts),
+		Storages:  make([]types.DiffStorage, len(diffLayer.Storages)),
+	}
+	for index, storage := range diffLayer.Storages {
+		sorted.Storages[index] = types.DiffStorage{
+			Account: storage.Account,
+			Keys:    slices.Clone(storage.Keys),
+			Vals:    slices.Clone(storage.Vals),
+		}
+	}
+	sortDiffLayer(sorted)
+	return sorted
+}
 
-	if bc.diffLayerCache.Len() >= diffLayerCacheLimit {
+func (bc *BlockChain) cacheDiffLayer(diffLayer *types.DiffLayer, diffLayerCh chan struct{}) {
+	sortDiffLayer(diffLayer)
+
+	if bc.diffLayerCache.Len() >= bc.diffLayerCacheSize {
 		bc.diffLayerCache.RemoveOldest()
 	}
 
 	bc.diffLayerCache.Add(diffLayer.BlockHash, diffLayer)
-	close(diffLayerCh)
+	bc.closeDiffLayerCh(diffLayerCh)
 
 	if bc.db.DiffStore() != nil {
-		// push to priority queue before persisting
-		bc.diffQueueBuffer <- diffLayer
+		// push to priority queue before persisting, diff layers are only an
+		// optimization, so drop them rather than stall if the queue is full
+		select {
+		case bc.diffQueueBuffer <- diffLayer:
+		default:
+			diffQueueDropMeter.Mark(1)
+			log.Warn("Diff layer queue full, dropping diff layer", "number", diffLayer.Number, "hash", diffLayer.BlockHash)
+		}
+	}
+}
+
+// closeDiffLayerCh closes a difflayer channel unless already closed. Channels
+// are closed both when their diff layer is cached and when they're evicted.
+func (bc *BlockChain) closeDiffLayerCh(diffLayerCh chan struct{}) {
+	bc.diffLayerChanLock.Lock()
+	defer bc.diffLayerChanLock.Unlock()
+
+	select {
+	case <-diffLayerCh:
+	default:
+		close(diffLayerCh)
 	}
 }
 
 func (bc *BlockChain) cacheBlock(hash common.Hash, block *types.Block) {
 	bc.blockCache.Add(hash, block)
+	blockCacheGauge.Update(int64(bc.blockCache.Len()))
 	if bc.chainConfig.IsCancun(block.Number(), block.Time()) {
 		bc.sidecarsCache.Add(hash, block.Sidecars())
 	}
@@ -722,6 +1073,7 @@ func (bc *BlockChain) loadLastState() error {
 	// Everything seems to be fine, set as the head block
 	bc.currentBlock.Store(headBlock.Header())
 	headBlockGauge.Update(int64(headBlock.NumberU64()))
+	updateHeadLag(headBlock.Time())
 	justifiedBlockGauge.Update(int64(bc.GetJustifiedNumber(headBlock.Header())))
 	finalizedBlockGauge.Update(int64(bc.getFinalizedNumber(headBlock.Header())))
 
@@ -778,22 +1130,62 @@ func (bc *BlockChain) loadLastState() error {
 // SetHead rewinds the local chain to a new head. Depending on whether the node
 // was snap synced or full synced and in which state, the method will try to
 // delete minimal data from disk whilst retaining chain consistency.
+//
+// ErrSetHeadNoRewind is returned if the requested head is at or above the
+// current head header, in which case the chain is left untouched.
 func (bc *BlockChain) SetHead(head uint64) error {
+	_, err := bc.SetHeadWithResult(head)
+	return err
+}
+
+// SetHeadResult describes the rewind done by SetHeadWithResult.
+type SetHeadResult struct {
+	OldNumber uint64      // Number of the head block before the rewind
+	OldHash   common.Hash // Hash of the head block before the rewind
+	NewNumber uint64      // Number of the head block after the rewind
+	NewHash   common.Hash // Hash of the head block after the rewind
+	Removed   uint64      // Number of blocks rewound from the canonical chain
+}
+
+// SetHeadWithResult works like SetHead, but also reports the range the head
+// block was rewound over. Note, the new head may be below the requested one if
+// the state of the latter isn't available.
+func (bc *BlockChain) SetHeadWithResult(head uint64) (SetHeadResult, error) {
+	if current := bc.CurrentHeader().Number.Uint64(); head >= current {
+		return SetHeadResult{}, fmt.Errorf("%w: target %d, head %d", ErrSetHeadNoRewind, head, current)
+	}
+	return bc.setHead(head)
+}
+
+// setHead is the internal version of SetHeadWithResult without the rewind
+// check. The startup repair and the config upgrade rewind rely on it, where
+// the head header may already sit at the target.
+func (bc *BlockChain) setHead(head uint64) (SetHeadResult, error) {
+	old := bc.CurrentBlock()
 	if _, err := bc.setHeadBeyondRoot(head, 0, common.Hash{}, false); err != nil {
-		return err
+		return SetHeadResult{}, err
 	}
 	// Send chain head event to update the transaction pool
 	header := bc.CurrentBlock()
+	result := SetHeadResult{
+		OldNumber: old.Number.Uint64(),
+		OldHash:   old.Hash(),
+		NewNumber: header.Number.Uint64(),
+		NewHash:   header.Hash(),
+	}
+	if result.OldNumber > result.NewNumber {
+		result.Removed = result.OldNumber - result.NewNumber
+	}
 	block := bc.GetBlock(header.Hash(), header.Number.Uint64())
 	if block == nil {
 		// This should never happen. In practice, previously currentBlock
 		// contained the entire block whereas now only a "marker", so there
 		// is an ever so slight chance for a race we should handle.
 		log.Error("Current block not found in database", "block", header.Number, "hash", header.Hash())
-		return fmt.Errorf("current block missing: #%d [%x..]", header.Number, header.Hash().Bytes()[:4])
+		return result, fmt.Errorf("current block missing: #%d [%x..]", header.Number, header.Hash().Bytes()[:4])
 	}
-	bc.chainHeadFeed.Send(ChainHeadEvent{Block: block})
-	return nil
+	bc.sendChainHeadEvent(ChainHeadEvent{Block: block})
+	return result, nil
 }
 
 // SetHeadWithTimestamp rewinds the local chain to a new head that has at max
@@ -814,17 +1206,53 @@ func (bc *BlockChain) SetHeadWithTimestamp(timestamp uint64) error {
 		log.Error("Current block not found in database", "block", header.Number, "hash", header.Hash())
 		return fmt.Errorf("current block missing: #%d [%x..]", header.Number, header.Hash().Bytes()[:4])
 	}
-	bc.chainHeadFeed.Send(ChainHeadEvent{Block: block})
+	bc.sendChainHeadEvent(ChainHeadEvent{Block: block})
+	return nil
+}
+
+// ResetToBlock rewinds the local chain to the canonical block with the given
+// hash, e.g. after detecting corruption above it. The block must be below the
+// current head and its state must be available, otherwise the chain is left
+// untouched.
+func (bc *BlockChain) ResetToBlock(hash common.Hash) error {
+	header := bc.GetHeaderByHash(hash)
+	if header == nil {
+		return fmt.Errorf("unknown block %x", hash)
+	}
+	number := header.Number.Uint64()
+	if bc.GetCanonicalHash(number) != hash {
+		return fmt.Errorf("%w: #%d [%x..]", ErrResetNotCanonical, number, hash.Bytes()[:4])
+	}
+	if !bc.HasBlockAndState(hash, number) {
+		return fmt.Errorf("%w: #%d [%x..]", ErrResetNoState, number, hash.Bytes()[:4])
+	}
+	current := bc.CurrentBlock()
+	if number >= current.Number.Uint64() {
+		return fmt.Errorf("%w: target %d, head %d", ErrSetHeadNoRewind, number, current.Number)
+	}
+	if _, err := bc.setHeadBeyondRoot(number, 0, common.Hash{}, false); err != nil {
+		return err
+	}
+	head := bc.CurrentBlock()
+	log.Warn("Reset chain to block", "from", current.Number, "fromhash", current.Hash(), "to", head.Number, "tohash", head.Hash())
+
+	// Send chain head event to update the transaction pool
+	block := bc.GetBlock(head.Hash(), head.Number.Uint64())
+	if block == nil {
+		log.Error("Current block not found in database", "block", head.Number, "hash", head.Hash())
+		return fmt.Errorf("current block missing: #%d [%x..]", head.Number, head.Hash().Bytes()[:4])
+	}
+	bc.sendChainHeadEvent(ChainHeadEvent{Block: block})
 	return nil
 }
 
 func (bc *BlockChain) tryRewindBadBlocks() {
-	if !bc.chainmu.TryLock() {
+	if !bc.lockChain() {
 		return
 	}
-	defer bc.chainmu.Unlock()
+	defer bc.unlockChain()
 	block := bc.CurrentBlock()
-	snaps := bc.snaps
+	snaps := bc.snaps.Load()
 	// Verified and Result is false
 	if snaps != nil && snaps.Snapshot(block.Root) != nil &&
 		snaps.Snapshot(block.Root).Verified() && !snaps.Snapshot(block.Root).WaitAndGetVerifyRes() {
@@ -838,6 +1266,41 @@ func (bc *BlockChain) tryRewindBadBlocks() {
 	}
 }
 
+// PinState exempts the state of the given root from the trie garbage collection
+// until it's unpinned, e.g. to keep a historical state available for tracing.
+// Only states still held in memory (or already persisted) can be kept alive,
+// and every pinned state holds on to its dirty trie nodes, hence the number of
+// pinned roots should be kept low.
+func (bc *BlockChain) PinState(root common.Hash) {
+	bc.commitLock.Lock()
+	defer bc.commitLock.Unlock()
+
+	if _, ok := bc.pinnedRoots[root]; ok {
+		return
+	}
+	bc.pinnedRoots[root] = 0
+	if len(bc.pinnedRoots) > maxPinnedStates {
+		log.Warn("Too many pinned states, memory usage may grow", "pinned", len(bc.pinnedRoots), "root", root)
+	}
+}
+
+// UnpinState releases a state pinned by PinState, making it eligible for the
+// trie garbage collection again. If the state was already due for collection,
+// it's dereferenced right away.
+func (bc *BlockChain) UnpinState(root common.Hash) {
+	bc.commitLock.Lock()
+	defer bc.commitLock.Unlock()
+
+	pending, ok := bc.pinnedRoots[root]
+	if !ok {
+		return
+	}
+	delete(bc.pinnedRoots, root)
+	for ; pending > 0; pending-- {
+		bc.triedb.Dereference(root)
+	}
+}
+
 // rewindHashHead implements the logic of rewindHead in the context of hash scheme.
 func (bc *BlockChain) rewindHashHead(head *types.Header, root common.Hash) (*types.Header, uint64) {
 	var (
@@ -1028,10 +1491,10 @@ func (bc *BlockChain) SetFinalized(header *types.Header) {
 //
 // The method returns the block number where the requested root cap was found.
 func (bc *BlockChain) setHeadBeyondRoot(head uint64, time uint64, root common.Hash, repair bool) (uint64, error) {
-	if !bc.chainmu.TryLock() {
+	if !bc.lockChain() {
 		return 0, errChainStopped
 	}
-	defer bc.chainmu.Unlock()
+	defer bc.unlockChain()
 
 	var (
 		// Track the block number of the requested root hash
@@ -1054,9 +1517,10 @@ func (bc *BlockChain) setHeadBeyondRoot(head uint64, time uint64, root common.Ha
 						NoBuild:    bc.cacheConfig.SnapshotNoBuild,
 						AsyncBuild: !bc.cacheConfig.SnapshotWait,
 					}
-					bc.snaps, _ = snapshot.New(snapconfig, bc.db, bc.triedb, header.Root, int(bc.cacheConfig.TriesInMemory), bc.NoTries())
+					snaps, _ := snapshot.New(snapconfig, bc.db, bc.triedb, header.Root, int(bc.cacheConfig.TriesInMemory), bc.NoTries())
+					bc.snaps.Store(snaps)
 				}
-				defer func() { bc.snaps = nil }()
+				defer bc.snaps.Store(nil)
 			}
 
 			var newHeadBlock *types.Header
@@ -1069,6 +1533,7 @@ func (bc *BlockChain) setHeadBeyondRoot(head uint64, time uint64, root common.Ha
 			// to low, so it's safe to update in-memory markers directly.
 			bc.currentBlock.Store(newHeadBlock)
 			headBlockGauge.Update(int64(newHeadBlock.Number.Uint64()))
+			updateHeadLag(newHeadBlock.Time)
 
 			// The head state is missing, which is only possible in the path-based
 			// scheme. This situation occurs when the chain head is rewound below
@@ -1153,11 +1618,16 @@ func (bc *BlockChain) setHeadBeyondRoot(head uint64, time uint64, root common.Ha
 	}
 	// Clear out any stale content from the caches
 	bc.bodyCache.Purge()
+	bodyCacheGauge.Update(0)
 	bc.bodyRLPCache.Purge()
 	bc.receiptsCache.Purge()
+	receiptsCacheGauge.Update(0)
+	bc.receiptsRLPCache.Purge()
 	bc.sidecarsCache.Purge()
 	bc.blockCache.Purge()
+	blockCacheGauge.Update(0)
 	bc.txLookupCache.Purge()
+	txLookupCacheGauge.Update(0)
 	bc.futureBlocks.Purge()
 
 	if finalized := bc.CurrentFinalBlock(); finalized != nil && head < finalized.Number.Uint64() {
@@ -1187,24 +1657,85 @@ func (bc *BlockChain) SnapSyncCommitHead(hash common.Hash) error {
 		return fmt.Errorf("non existent state [%x..]", root[:4])
 	}
 	// If all checks out, manually set the head block.
-	if !bc.chainmu.TryLock() {
+	if !bc.lockChain() {
 		return errChainStopped
 	}
 	bc.currentBlock.Store(block.Header())
 	headBlockGauge.Update(int64(block.NumberU64()))
+	updateHeadLag(block.Time())
 	justifiedBlockGauge.Update(int64(bc.GetJustifiedNumber(block.Header())))
 	finalizedBlockGauge.Update(int64(bc.getFinalizedNumber(block.Header())))
-	bc.chainmu.Unlock()
+	bc.unlockChain()
 
 	// Destroy any existing state snapshot and regenerate it in the background,
 	// also resuming the normal maintenance of any previously paused snapshot.
-	if bc.snaps != nil {
-		bc.snaps.Rebuild(root)
+	if snaps := bc.snaps.Load(); snaps != nil {
+		snaps.Rebuild(root)
 	}
 	log.Info("Committed new head block", "number", block.Number(), "hash", hash)
 	return nil
 }
 
+// SnapSyncCommitHeadVerified is like SnapSyncCommitHead, but also waits for the
+// snapshot of the new head to be generated from its state trie and verifies it
+// against the state root, e.g. for untrusted snap sync pivots. If the generation
+// does not complete within the timeout or the verification fails, the previous
+// head is restored and an error returned.
+//
+// Note, the generation iterates the entire state and the verification does so
+// again, which takes hours on mainnet, during which the call blocks.
+func (bc *BlockChain) SnapSyncCommitHeadVerified(hash common.Hash, timeout time.Duration) error {
+	snaps := bc.snaps.Load()
+	if snaps == nil {
+		return errors.New("snapshot is not enabled")
+	}
+	prev := bc.CurrentBlock()
+	if err := bc.SnapSyncCommitHead(hash); err != nil {
+		return err
+	}
+	root := bc.CurrentBlock().Root
+
+	err := waitSnapshotGenerated(snaps, root, timeout)
+	if err == nil {
+		err = snaps.Verify(root)
+	}
+	if err == nil {
+		log.Info("Verified new head block state", "hash", hash, "root", root)
+		return nil
+	}
+	log.Error("Failed to verify new head block state, restoring previous head", "hash", hash, "root", root, "err", err)
+	if rerr := bc.SnapSyncCommitHead(prev.Hash()); rerr != nil {
+		log.Error("Failed to restore previous head block", "number", prev.Number, "hash", prev.Hash(), "err", rerr)
+	}
+	return fmt.Errorf("state verification of head %x failed: %w", hash, err)
+}
+
+// waitSnapshotGenerated waits until the snapshot generation of the given root
+// completes, up to the given timeout.
+func waitSnapshotGenerated(snaps *snapshot.Tree, root common.Hash, timeout time.Duration) error {
+	var (
+		deadline = time.NewTimer(timeout)
+		recheck  = time.NewTicker(100 * time.Millisecond)
+	)
+	defer deadline.Stop()
+	defer recheck.Stop()
+
+	for {
+		progress, err := snaps.GenerationProgress()
+		if err != nil {
+			return err
+		}
+		if progress.Root == root && progress.Done {
+			return nil
+		}
+		select {
+		case <-recheck.C:
+		case <-deadline.C:
+			return fmt.Errorf("snapshot generation timed out, %d accounts and %d slots indexed", progress.Accounts, progress.Slots)
+		}
+	}
+}
+
 // UpdateChasingHead update remote best chain head, used by DA check now.
 func (bc *BlockChain) UpdateChasingHead(head *types.Header) {
 	bc.chasingHead.Store(head)
@@ -1215,6 +1746,74 @@ func (bc *BlockChain) ChasingHead() *types.Header {
 	return bc.chasingHead.Load()
 }
 
+// RepairTxIndex re-derives the transaction lookup entries of the canonical
+// blocks in the [from, to] range, and deletes the entries pointing into the
+// range for transactions of non-canonical blocks. It returns the number of
+// corrected entries.
+func (bc *BlockChain) RepairTxIndex(from, to uint64) (int, error) {
+	if from > to {
+		return 0, fmt.Errorf("invalid range: from %d > to %d", from, to)
+	}
+	if !bc.lockChain() {
+		return 0, errChainStopped
+	}
+	defer bc.unlockChain()
+
+	if head := bc.CurrentBlock().Number.Uint64(); to > head {
+		return 0, fmt.Errorf("range beyond the chain head: to %d > head %d", to, head)
+	}
+	var (
+		fixed int
+		batch = bc.db.NewBatch()
+	)
+	for number := from; number <= to; number++ {
+		hash := rawdb.ReadCanonicalHash(bc.db, number)
+		block := rawdb.ReadBlock(bc.db, hash, number)
+		if block == nil {
+			return fixed, fmt.Errorf("canonical block #%d missing", number)
+		}
+		canonical := make(map[common.Hash]struct{}, len(block.Transactions()))
+		for _, tx := range block.Transactions() {
+			canonical[tx.Hash()] = struct{}{}
+			if entry := rawdb.ReadTxLookupEntry(bc.db, tx.Hash()); entry == nil || *entry != number {
+				fixed++
+			}
+		}
+		rawdb.WriteTxLookupEntriesByBlock(batch, block)
+
+		// Drop the entries of side chain transactions which aren't canonical here
+		for _, side := range rawdb.ReadAllHashes(bc.db, number) {
+			if side == hash {
+				continue
+			}
+			body := rawdb.ReadBody(bc.db, side, number)
+			if body == nil {
+				continue
+			}
+			for _, tx := range body.Transactions {
+				if _, ok := canonical[tx.Hash()]; ok {
+					continue
+				}
+				if entry := rawdb.ReadTxLookupEntry(bc.db, tx.Hash()); entry != nil && *entry == number {
+					rawdb.DeleteTxLookupEntry(batch, tx.Hash())
+					fixed++
+				}
+			}
+		}
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return fixed, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return fixed, err
+	}
+	bc.txLookupCache.Purge()
+	return fixed, nil
+}
+
 // Reset purges the entire blockchain, restoring it to its genesis state.
 func (bc *BlockChain) Reset() error {
 	return bc.ResetWithGenesisBlock(bc.genesisBlock)
@@ -1224,13 +1823,13 @@ func (bc *BlockChain) Reset() error {
 // specified genesis state.
 func (bc *BlockChain) ResetWithGenesisBlock(genesis *types.Block) error {
 	// Dump the entire block chain and purge the caches
-	if err := bc.SetHead(0); err != nil {
+	if err := bc.SetHead(0); err != nil && !errors.Is(err, ErrSetHeadNoRewind) {
 		return err
 	}
-	if !bc.chainmu.TryLock() {
+	if !bc.lockChain() {
 		return errChainStopped
 	}
-	defer bc.chainmu.Unlock()
+	defer bc.unlockChain()
 
 	// Prepare the genesis block and reinitialise the chain
 	blockBatch := bc.db.BlockStore().NewBatch()
@@ -1245,6 +1844,7 @@ func (bc *BlockChain) ResetWithGenesisBlock(genesis *types.Block) error {
 	bc.genesisBlock = genesis
 	bc.currentBlock.Store(bc.genesisBlock.Header())
 	headBlockGauge.Update(int64(bc.genesisBlock.NumberU64()))
+	updateHeadLag(bc.genesisBlock.Time())
 	justifiedBlockGauge.Update(int64(bc.genesisBlock.NumberU64()))
 	finalizedBlockGauge.Update(int64(bc.genesisBlock.NumberU64()))
 	bc.hc.SetGenesis(bc.genesisBlock.Header())
@@ -1291,6 +1891,38 @@ func (bc *BlockChain) ExportN(w io.Writer, first uint64, last uint64) error {
 	return nil
 }
 
+// ExportHeaders writes a subset of the canonical header chain to the given writer.
+func (bc *BlockChain) ExportHeaders(w io.Writer, first uint64, last uint64) error {
+	if first > last {
+		return fmt.Errorf("export failed: first (%d) is greater than last (%d)", first, last)
+	}
+	log.Info("Exporting batch of headers", "count", last-first+1)
+
+	var (
+		parentHash common.Hash
+		start      = time.Now()
+		reported   = time.Now()
+	)
+	for nr := first; nr <= last; nr++ {
+		header := bc.GetHeaderByNumber(nr)
+		if header == nil {
+			return fmt.Errorf("export failed on #%d: not found", nr)
+		}
+		if nr > first && header.ParentHash != parentHash {
+			return errors.New("export failed: chain reorg during export")
+		}
+		parentHash = header.Hash()
+		if err := rlp.Encode(w, header); err != nil {
+			return err
+		}
+		if time.Since(reported) >= statsReportLimit {
+			log.Info("Exporting headers", "exported", nr-first, "elapsed", common.PrettyDuration(time.Since(start)))
+			reported = time.Now()
+		}
+	}
+	return nil
+}
+
 // writeHeadBlock injects a new head block into the current block chain. This method
 // assumes that the block is indeed a true head. It will also reset the head
 // header and the head snap sync block to this very same block if they are older
@@ -1319,8 +1951,144 @@ func (bc *BlockChain) writeHeadBlock(block *types.Block) {
 
 	bc.currentBlock.Store(block.Header())
 	headBlockGauge.Update(int64(block.NumberU64()))
+	updateHeadLag(block.Time())
 	justifiedBlockGauge.Update(int64(bc.GetJustifiedNumber(block.Header())))
 	finalizedBlockGauge.Update(int64(bc.getFinalizedNumber(block.Header())))
+
+	bc.runHeadHooks(block)
+}
+
+// headHook is a callback registered via RegisterHeadHook.
+type headHook struct {
+	id uint64
+	fn func(block *types.Block)
+}
+
+// RegisterHeadHook registers a callback that is invoked synchronously with the
+// new head block every time the canonical head changes, after the head markers
+// are updated and before the next block is processed. Unlike the event feeds,
+// the chain waits for the hooks, so the returned function must be called to
+// unregister the hook.
+//
+// Hooks run while holding the chain mutex: they must be fast and must not call
+// back into the chain write path (inserts, SetHead, etc.), or they deadlock.
+func (bc *BlockChain) RegisterHeadHook(fn func(block *types.Block)) (unregister func()) {
+	bc.headHooksLock.Lock()
+	defer bc.headHooksLock.Unlock()
+
+	bc.headHookID++
+	id := bc.headHookID
+	bc.headHooks = append(bc.headHooks, headHook{id: id, fn: fn})
+
+	return func() {
+		bc.headHooksLock.Lock()
+		defer bc.headHooksLock.Unlock()
+
+		for i, hook := range bc.headHooks {
+			if hook.id == id {
+				bc.headHooks = append(bc.headHooks[:i:i], bc.headHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// runHeadHooks invokes the registered head hooks with the new head block.
+func (bc *BlockChain) runHeadHooks(block *types.Block) {
+	bc.headHooksLock.RLock()
+	hooks := bc.headHooks
+	bc.headHooksLock.RUnlock()
+
+	for _, hook := range hooks {
+		hook.fn(block)
+	}
+}
+
+// JournalSnapshot journals the snapshot layers of the current head to the
+// database without stopping the chain, e.g. for hot backups, and returns the
+// root of the disk layer. The snapshot tree is locked while journaling, so the
+// snapshot maintenance of the block imports is briefly paused.
+func (bc *BlockChain) JournalSnapshot() (common.Hash, error) {
+	bc.snapJournalLock.Lock()
+	defer bc.snapJournalLock.Unlock()
+
+	snaps := bc.snaps.Load()
+	if snaps == nil {
+		return common.Hash{}, errors.New("snapshot is not enabled")
+	}
+	return snaps.Journal(bc.CurrentBlock().Root)
+}
+
+// DisableSnapshot journals and releases the state snapshot at runtime, e.g. to
+// reclaim its memory under pressure. Afterwards the chain runs trie-only, just
+// like a node started without snapshot. It is a no-op if the snapshot is not
+// enabled.
+//
+// StateDBs opened before the call keep a reference to the released tree. Their
+// reads keep working: layers that went stale report ErrSnapshotStale and the
+// StateDB falls back to the trie. Their commits only update the discarded tree
+// and are logged as warnings. Once EnableSnapshot regenerates the snapshot, the
+// disk data behind the old tree is overwritten, so such StateDBs must not be
+// kept across a disable/enable cycle and have to be reopened.
+func (bc *BlockChain) DisableSnapshot() error {
+	if !bc.lockChain() {
+		return errChainStopped
+	}
+	defer bc.unlockChain()
+
+	bc.snapJournalLock.Lock()
+	defer bc.snapJournalLock.Unlock()
+
+	snaps := bc.snaps.Swap(nil)
+	if snaps == nil {
+		return nil
+	}
+
+	if _, err := snaps.Journal(bc.CurrentBlock().Root); err != nil {
+		log.Warn("Failed to journal disabled state snapshot", "err", err)
+	}
+	snaps.Release()
+	log.Info("Disabled state snapshot")
+	return nil
+}
+
+// EnableSnapshot recreates the state snapshot against the current head root,
+// using the snapshot settings of the cache config. It is a no-op if the snapshot
+// is already enabled.
+//
+// Note, the journal written by DisableSnapshot does not match the head anymore
+// once blocks were imported in between, so enabling usually means regenerating
+// the snapshot from the state trie: a full iteration of the state that takes
+// hours on mainnet. Unless SnapshotWait is set, the generation runs in the
+// background and the chain falls back to the trie until it is done.
+func (bc *BlockChain) EnableSnapshot() error {
+	if bc.cacheConfig.SnapshotLimit <= 0 {
+		return errors.New("snapshot cache is not configured")
+	}
+	if !bc.lockChain() {
+		return errChainStopped
+	}
+	defer bc.unlockChain()
+
+	bc.snapJournalLock.Lock()
+	defer bc.snapJournalLock.Unlock()
+
+	if bc.snaps.Load() != nil {
+		return nil
+	}
+	head := bc.CurrentBlock()
+	snapconfig := snapshot.Config{
+		CacheSize:  bc.cacheConfig.SnapshotLimit,
+		NoBuild:    bc.cacheConfig.SnapshotNoBuild,
+		AsyncBuild: !bc.cacheConfig.SnapshotWait,
+	}
+	snaps, err := snapshot.New(snapconfig, bc.db, bc.triedb, head.Root, int(bc.cacheConfig.TriesInMemory), bc.NoTries())
+	if err != nil {
+		return err
+	}
+	bc.snaps.Store(snaps)
+	log.Info("Enabled state snapshot", "root", head.Root)
+	return nil
 }
 
 // stopWithoutSaving stops the blockchain service. If any imports are currently in progress
@@ -1352,6 +2120,11 @@ func (bc *BlockChain) stopWithoutSaving() {
 	// returned.
 	bc.chainmu.Close()
 	bc.wg.Wait()
+
+	// Release the dedicated sender cacher, the shared one lives on
+	if bc.senderCacher != SenderCacher {
+		bc.senderCacher.close()
+	}
 }
 
 // Stop stops the blockchain service. If any imports are currently in progress
@@ -1361,12 +2134,12 @@ func (bc *BlockChain) Stop() {
 
 	// Ensure that the entirety of the state snapshot is journaled to disk.
 	var snapBase common.Hash
-	if bc.snaps != nil {
+	if snaps := bc.snaps.Load(); snaps != nil {
 		var err error
-		if snapBase, err = bc.snaps.Journal(bc.CurrentBlock().Root); err != nil {
+		if snapBase, err = snaps.Journal(bc.CurrentBlock().Root); err != nil {
 			log.Error("Failed to journal state snapshot", "err", err)
 		}
-		bc.snaps.Release()
+		snaps.Release()
 	}
 	if bc.triedb.Scheme() == rawdb.PathScheme {
 		// Ensure that the in-memory trie nodes are journaled to disk properly.
@@ -1375,28 +2148,44 @@ func (bc *BlockChain) Stop() {
 		}
 	} else {
 		// Ensure the state of a recent block is also stored to disk before exiting.
-		// We're writing three different states to catch different restart scenarios:
+		// Unless configured otherwise, we're writing three different states to
+		// catch different restart scenarios:
 		//  - HEAD:     So we don't need to reprocess any blocks in the general case
 		//  - HEAD-1:   So we don't do large reorgs if our HEAD becomes an uncle
 		//  - HEAD-127: So we have a hard limit on the number of blocks reexecuted
 		if !bc.cacheConfig.TrieDirtyDisabled {
 			triedb := bc.triedb
-			var once sync.Once
-			for _, offset := range []uint64{0, 1, TriesInMemory - 1} {
-				if number := bc.CurrentBlock().Number.Uint64(); number > offset {
-					recent := bc.GetBlockByNumber(number - offset)
-					log.Info("Writing cached state to disk", "block", recent.Number(), "hash", recent.Hash(), "root", recent.Root())
-					if err := triedb.Commit(recent.Root(), true); err != nil {
-						log.Error("Failed to commit recent state trie", "err", err)
-					} else {
-						rawdb.WriteSafePointBlockNumber(bc.db, recent.NumberU64())
-						once.Do(func() {
-							rawdb.WriteHeadBlockHash(bc.db.BlockStore(), recent.Hash())
-						})
-					}
-				}
+			var (
+				offsets   = slices.Clone(bc.cacheConfig.ShutdownCommitOffsets)
+				committed []uint64
+			)
+			if len(offsets) == 0 {
+				offsets = []uint64{0, 1, TriesInMemory - 1}
 			}
-
+			// Commit the closest state first, the head marker is moved to it
+			slices.Sort(offsets)
+			offsets = slices.Compact(offsets)
+
+			for _, offset := range offsets {
+				number := bc.CurrentBlock().Number.Uint64()
+				if number <= offset {
+					log.Debug("Skipping state commit beyond genesis", "offset", offset, "head", number)
+					break
+				}
+				recent := bc.GetBlockByNumber(number - offset)
+				log.Info("Writing cached state to disk", "block", recent.Number(), "hash", recent.Hash(), "root", recent.Root())
+				if err := triedb.Commit(recent.Root(), true); err != nil {
+					log.Error("Failed to commit recent state trie", "err", err)
+				} else {
+					rawdb.WriteSafePointBlockNumber(bc.db, recent.NumberU64())
+					if len(committed) == 0 {
+						rawdb.WriteHeadBlockHash(bc.db.BlockStore(), recent.Hash())
+					}
+					committed = append(committed, offset)
+				}
+			}
+			log.Info("Committed cached states on shutdown", "offsets", committed)
+
 			if snapBase != (common.Hash{}) {
 				log.Info("Writing snapshot state to disk", "root", snapBase)
 				if err := triedb.Commit(snapBase, true); err != nil {
@@ -1405,8 +2194,15 @@ func (bc *BlockChain) Stop() {
 					rawdb.WriteSafePointBlockNumber(bc.db, bc.CurrentBlock().Number.Uint64())
 				}
 			}
+			roots := make([]common.Hash, 0, bc.triegc.Size())
 			for !bc.triegc.Empty() {
-				triedb.Dereference(bc.triegc.PopItem())
+				roots = append(roots, bc.triegc.PopItem())
+			}
+			dereferenceRoots(triedb, roots)
+			for root, pending := range bc.pinnedRoots {
+				for ; pending > 0; pending-- {
+					triedb.Dereference(root)
+				}
 			}
 			if _, size, _, _ := triedb.Size(); size != 0 {
 				log.Error("Dangling trie nodes after full cleanup")
@@ -1427,11 +2223,53 @@ func (bc *BlockChain) StopInsert() {
 	bc.procInterrupt.Store(true)
 }
 
+// lockChain takes the chain mutex for a write operation, blocking until it is
+// available, and records when it was taken. The time spent waiting for the mutex
+// is reported by the chain/mu/wait timer. False is returned if the chain is
+// stopped.
+func (bc *BlockChain) lockChain() bool {
+	start := time.Now()
+	if !bc.chainmu.TryLock() {
+		return false
+	}
+	chainMuWaitTimer.UpdateSince(start)
+	bc.chainmuSince.Store(time.Now().UnixNano())
+	return true
+}
+
+// unlockChain releases the chain mutex taken via lockChain and reports how long
+// it was held. The chain/mu/held gauge only keeps the most recent hold time, it
+// is overwritten by every write operation.
+func (bc *BlockChain) unlockChain() {
+	if since := bc.chainmuSince.Swap(0); since != 0 {
+		chainMuHeldGauge.Update(time.Now().UnixNano() - since)
+	}
+	bc.chainmu.Unlock()
+}
+
+// ChainMuHeldDuration returns how long the chain mutex has been held by the
+// current write operation, zero if no write operation is running. The most
+// recent completed hold time is reported in nanoseconds by the chain/mu/held
+// gauge, which doesn't keep any history.
+func (bc *BlockChain) ChainMuHeldDuration() time.Duration {
+	since := bc.chainmuSince.Load()
+	if since == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - since)
+}
+
 // insertStopped returns true after StopInsert has been called.
 func (bc *BlockChain) insertStopped() bool {
 	return bc.procInterrupt.Load()
 }
 
+// InsertionEnabled reports whether the chain is accepting block inserts, i.e.
+// it has been neither stopped nor interrupted with StopInsert.
+func (bc *BlockChain) InsertionEnabled() bool {
+	return !bc.insertStopped() && !bc.stopping.Load()
+}
+
 func (bc *BlockChain) procFutureBlocks() {
 	blocks := make([]*types.Block, 0, bc.futureBlocks.Len())
 	for _, hash := range bc.futureBlocks.Keys() {
@@ -1446,8 +2284,14 @@ func (bc *BlockChain) procFutureBlocks() {
 		// Insert one by one as chain insertion needs contiguous ancestry between blocks
 		for i := range blocks {
 			bc.InsertChain(blocks[i : i+1])
+
+			// Blocks still too far in the future are queued up again
+			if hash := blocks[i].Hash(); !bc.futureBlocks.Contains(hash) && bc.HasBlock(hash, blocks[i].NumberU64()) {
+				futurePromotedMeter.Mark(1)
+			}
 		}
 	}
+	futureQueuedGauge.Update(int64(bc.futureBlocks.Len()))
 }
 
 // WriteStatus status of write
@@ -1459,9 +2303,26 @@ const (
 	SideStatTy
 )
 
+// BlockInsertResult is the outcome of the import of a single block.
+type BlockInsertResult struct {
+	Hash    common.Hash
+	Number  uint64
+	Status  WriteStatus // Status of the block write, NonStatTy if not written
+	Skipped bool        // Whether the block was already known and not executed
+	Queued  bool        // Whether the block was queued as a future block
+}
+
 // InsertReceiptChain attempts to complete an already existing header chain with
 // transaction and receipt data.
 func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain []types.Receipts, ancientLimit uint64) (int, error) {
+	return bc.InsertReceiptChainWithContext(context.Background(), blockChain, receiptChain, ancientLimit)
+}
+
+// InsertReceiptChainWithContext is InsertReceiptChain that can additionally be
+// aborted through the given context, e.g. when snap sync switches pivot. The
+// ancient store is truncated back if the cancellation interrupts an ancient
+// write, the live data written before the interruption is left in place.
+func (bc *BlockChain) InsertReceiptChainWithContext(ctx context.Context, blockChain types.Blocks, receiptChain []types.Receipts, ancientLimit uint64) (int, error) {
 	// We don't require the chainMu here since we want to maximize the
 	// concurrency of header insertion and receipt insertion.
 	bc.wg.Add(1)
@@ -1517,10 +2378,10 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 	// updateHead updates the head snap sync block if the inserted blocks are better
 	// and returns an indicator whether the inserted blocks are canonical.
 	updateHead := func(head *types.Block) bool {
-		if !bc.chainmu.TryLock() {
+		if !bc.lockChain() {
 			return false
 		}
-		defer bc.chainmu.Unlock()
+		defer bc.unlockChain()
 
 		// Rewind may have occurred, skip in that case.
 		if bc.CurrentHeader().Number.Cmp(head.Number()) >= 0 {
@@ -1566,6 +2427,9 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 			return 0, fmt.Errorf("containing header #%d [%x..] unknown", last.Number(), last.Hash().Bytes()[:4])
 		}
 
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		// Write all chain data to ancients.
 		td := bc.GetTd(first.Hash(), first.NumberU64())
 		writeSize, err := rawdb.WriteAncientBlocksWithBlobs(bc.db, blockChain, receiptChain, td)
@@ -1581,6 +2445,14 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 		}
 		// Update the current snap block because all block data is now present in DB.
 		previousSnapBlock := bc.CurrentSnapBlock().Number.Uint64()
+		if err := ctx.Err(); err != nil {
+			// The insert was cancelled before the snap block was moved, drop
+			// the freshly written ancients to keep the store consistent.
+			if _, err := bc.db.TruncateHead(previousSnapBlock + 1); err != nil {
+				log.Error("Can't truncate ancient store after cancelled insert", "err", err)
+			}
+			return 0, err
+		}
 		if !updateHead(blockChain[len(blockChain)-1]) {
 			// We end up here if the header chain has reorg'ed, and the blocks/receipts
 			// don't match the canonical chain.
@@ -1628,6 +2500,10 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 			if bc.insertStopped() {
 				return 0, errInsertionInterrupted
 			}
+			// Abort if the caller cancelled the insertion
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
 			// Short circuit if the owner header is unknown
 			if !bc.HasHeader(block.Hash(), block.NumberU64()) {
 				return i, fmt.Errorf("containing header #%d [%x..] unknown", block.Number(), block.Hash().Bytes()[:4])
@@ -1755,6 +2631,133 @@ func (bc *BlockChain) writeKnownBlock(block *types.Block) error {
 	return nil
 }
 
+// commitTrieDB references the state of a freshly written block in the trie
+// database and garbage collects or flushes the older states as needed.
+func (bc *BlockChain) commitTrieDB(block *types.Block) error {
+	bc.commitLock.Lock()
+	defer bc.commitLock.Unlock()
+
+	// If node is running in path mode, skip explicit gc operation
+	// which is unnecessary in this mode.
+	if bc.triedb.Scheme() == rawdb.PathScheme {
+		return nil
+	}
+
+	triedb := bc.stateCache.TrieDB()
+	// If we're running an archive node, always flush
+	if bc.cacheConfig.TrieDirtyDisabled {
+		return triedb.Commit(block.Root(), false)
+	}
+	// Full but not archive node, do proper garbage collection
+	triedb.Reference(block.Root(), common.Hash{}) // metadata reference to keep trie alive
+	bc.triegc.Push(block.Root(), -int64(block.NumberU64()))
+
+	// Flush limits are not considered for the first TriesInMemory blocks.
+	current := block.NumberU64()
+	if current <= TriesInMemory {
+		return nil
+	}
+	// If we exceeded our memory allowance, flush matured singleton nodes to disk
+	var (
+		_, nodes, _, imgs = triedb.Size()
+		limit             = common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024
+	)
+	trieDirtyGauge.Update(int64(nodes))
+	triePreimageGauge.Update(int64(imgs))
+
+	if nodes > limit || imgs > 4*1024*1024 {
+		triedb.Cap(limit - ethdb.IdealBatchSize)
+		trieCapCounter.Inc(1)
+	}
+	// Find the next state trie we need to commit
+	chosen := current - bc.triesInMemory
+	flushInterval := time.Duration(bc.flushInterval.Load())
+	// If we exceeded out time allowance, flush an entire trie to disk
+	if bc.gcproc > flushInterval {
+		canWrite := true
+		if posa, ok := bc.engine.(consensus.PoSA); ok {
+			if !posa.EnoughDistance(bc, block.Header()) {
+				canWrite = false
+			}
+		}
+		if canWrite {
+			// If the header is missing (canonical chain behind), we're reorging a low
+			// diff sidechain. Suspend committing until this operation is completed.
+			header := bc.GetHeaderByNumber(chosen)
+			if header == nil {
+				log.Warn("Reorg in progress, trie commit postponed", "number", chosen)
+			} else {
+				// If we're exceeding limits but haven't reached a large enough memory gap,
+				// warn the user that the system is becoming unstable.
+				if chosen < bc.lastWrite+bc.triesInMemory && bc.gcproc >= 2*flushInterval {
+					log.Info("State in memory for too long, committing", "time", bc.gcproc, "allowance", flushInterval, "optimum", float64(chosen-bc.lastWrite)/float64(bc.triesInMemory))
+				}
+				// Flush an entire trie and restart the counters
+				triedb.Commit(header.Root, true)
+				rawdb.WriteSafePointBlockNumber(bc.db, chosen)
+				bc.lastWrite = chosen
+				bc.gcproc = 0
+			}
+		}
+	}
+	// Garbage collect anything below our required write retention
+	var stale []common.Hash
+	for !bc.triegc.Empty() {
+		root, number := bc.triegc.Pop()
+		if uint64(-number) > chosen {
+			bc.triegc.Push(root, number)
+			break
+		}
+		// Pinned states are kept alive, they're released on unpin
+		if _, ok := bc.pinnedRoots[root]; ok {
+			bc.pinnedRoots[root]++
+			continue
+		}
+		stale = append(stale, root)
+	}
+	dereferenceRoots(triedb, stale)
+	return nil
+}
+
+// dereferenceRoots dereferences the given state roots from the trie database
+// with a pool of at most GOMAXPROCS workers, returning once all are done.
+func dereferenceRoots(db *triedb.Database, roots []common.Hash) {
+	var (
+		wg    sync.WaitGroup
+		tasks = make(chan common.Hash)
+	)
+	for i := 0; i < min(runtime.GOMAXPROCS(0), len(roots)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for root := range tasks {
+				db.Dereference(root)
+			}
+		}()
+	}
+	for _, root := range roots {
+		tasks <- root
+	}
+	close(tasks)
+	wg.Wait()
+}
+
+// filterPreimages returns the preimages accepted by the configured preimage
+// filter, all of them if there is none.
+func (bc *BlockChain) filterPreimages(preimages map[common.Hash][]byte) map[common.Hash][]byte {
+	filter := bc.cacheConfig.PreimageFilter
+	if filter == nil {
+		return preimages
+	}
+	filtered := make(map[common.Hash][]byte)
+	for hash, preimage := range preimages {
+		if filter(preimage) {
+			filtered[hash] = preimage
+		}
+	}
+	return filtered
+}
+
 // writeBlockWithState writes block, metadata and corresponding state data to the
 // database.
 func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.Receipt, state *state.StateDB) error {
@@ -1771,10 +2774,11 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 	//
 	// Note all the components of block(td, hash->number map, header, body, receipts)
 	// should be written atomically. BlockBatch is used for containing all components.
+	preimages := bc.filterPreimages(state.Preimages())
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
-		rawdb.WritePreimages(bc.db, state.Preimages())
+		rawdb.WritePreimages(bc.db, preimages)
 		blockBatch := bc.db.BlockStore().NewBatch()
 		rawdb.WriteTd(blockBatch, block.Hash(), block.NumberU64(), externTd)
 		rawdb.WriteBlock(blockBatch, block)
@@ -1783,7 +2787,7 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 		if bc.chainConfig.IsCancun(block.Number(), block.Time()) {
 			rawdb.WriteBlobSidecars(blockBatch, block.Hash(), block.NumberU64(), block.Sidecars())
 		}
-		rawdb.WritePreimages(blockBatch, state.Preimages())
+		rawdb.WritePreimages(blockBatch, preimages)
 		if err := blockBatch.Write(); err != nil {
 			log.Crit("Failed to write block into disk", "err", err)
 		}
@@ -1791,84 +2795,11 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 	}()
 
 	tryCommitTrieDB := func() error {
-		bc.commitLock.Lock()
-		defer bc.commitLock.Unlock()
-
-		// If node is running in path mode, skip explicit gc operation
-		// which is unnecessary in this mode.
-		if bc.triedb.Scheme() == rawdb.PathScheme {
-			return nil
-		}
-
-		triedb := bc.stateCache.TrieDB()
-		// If we're running an archive node, always flush
-		if bc.cacheConfig.TrieDirtyDisabled {
-			return triedb.Commit(block.Root(), false)
-		}
-		// Full but not archive node, do proper garbage collection
-		triedb.Reference(block.Root(), common.Hash{}) // metadata reference to keep trie alive
-		bc.triegc.Push(block.Root(), -int64(block.NumberU64()))
-
-		// Flush limits are not considered for the first TriesInMemory blocks.
-		current := block.NumberU64()
-		if current <= TriesInMemory {
-			return nil
-		}
-		// If we exceeded our memory allowance, flush matured singleton nodes to disk
-		var (
-			_, nodes, _, imgs = triedb.Size()
-			limit             = common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024
-		)
-		if nodes > limit || imgs > 4*1024*1024 {
-			triedb.Cap(limit - ethdb.IdealBatchSize)
-		}
-		// Find the next state trie we need to commit
-		chosen := current - bc.triesInMemory
-		flushInterval := time.Duration(bc.flushInterval.Load())
-		// If we exceeded out time allowance, flush an entire trie to disk
-		if bc.gcproc > flushInterval {
-			canWrite := true
-			if posa, ok := bc.engine.(consensus.PoSA); ok {
-				if !posa.EnoughDistance(bc, block.Header()) {
-					canWrite = false
-				}
-			}
-			if canWrite {
-				// If the header is missing (canonical chain behind), we're reorging a low
-				// diff sidechain. Suspend committing until this operation is completed.
-				header := bc.GetHeaderByNumber(chosen)
-				if header == nil {
-					log.Warn("Reorg in progress, trie commit postponed", "number", chosen)
-				} else {
-					// If we're exceeding limits but haven't reached a large enough memory gap,
-					// warn the user that the system is becoming unstable.
-					if chosen < bc.lastWrite+bc.triesInMemory && bc.gcproc >= 2*flushInterval {
-						log.Info("State in memory for too long, committing", "time", bc.gcproc, "allowance", flushInterval, "optimum", float64(chosen-bc.lastWrite)/float64(bc.triesInMemory))
-					}
-					// Flush an entire trie and restart the counters
-					triedb.Commit(header.Root, true)
-					rawdb.WriteSafePointBlockNumber(bc.db, chosen)
-					bc.lastWrite = chosen
-					bc.gcproc = 0
-				}
-			}
-		}
-		// Garbage collect anything below our required write retention
-		wg2 := sync.WaitGroup{}
-		for !bc.triegc.Empty() {
-			root, number := bc.triegc.Pop()
-			if uint64(-number) > chosen {
-				bc.triegc.Push(root, number)
-				break
-			}
-			wg2.Add(1)
-			go func() {
-				triedb.Dereference(root)
-				wg2.Done()
-			}()
-		}
-		wg2.Wait()
-		return nil
+		return bc.commitTrieDB(block)
+	}
+	// The diff layer of blocks with empty body is never used, skip building it.
+	if block.Header().TxHash == types.EmptyRootHash {
+		state.SkipDiffLayer()
 	}
 	// Commit all cached state changes into underlying memory database.
 	_, diffLayer, err := state.Commit(block.NumberU64(), bc.tryRewindBadBlocks, tryCommitTrieDB)
@@ -1884,12 +2815,16 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 		diffLayer.Number = block.NumberU64()
 
 		diffLayerCh := make(chan struct{})
-		if bc.diffLayerChanCache.Len() >= diffLayerCacheLimit {
+		if bc.diffLayerChanCache.Len() >= bc.diffLayerCacheSize {
 			bc.diffLayerChanCache.RemoveOldest()
 		}
 		bc.diffLayerChanCache.Add(diffLayer.BlockHash, diffLayerCh)
 
-		go bc.cacheDiffLayer(diffLayer, diffLayerCh)
+		if bc.cacheConfig.SyncDiffPersistence {
+			bc.cacheDiffLayer(diffLayer, diffLayerCh)
+		} else {
+			go bc.cacheDiffLayer(diffLayer, diffLayerCh)
+		}
 	}
 	wg.Wait()
 	return nil
@@ -1898,10 +2833,10 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 // WriteBlockAndSetHead writes the given block and all associated state to the database,
 // and applies the block as the new chain head.
 func (bc *BlockChain) WriteBlockAndSetHead(block *types.Block, receipts []*types.Receipt, logs []*types.Log, state *state.StateDB, emitHeadEvent bool) (status WriteStatus, err error) {
-	if !bc.chainmu.TryLock() {
+	if !bc.lockChain() {
 		return NonStatTy, errChainStopped
 	}
-	defer bc.chainmu.Unlock()
+	defer bc.unlockChain()
 
 	return bc.writeBlockAndSetHead(block, receipts, logs, state, emitHeadEvent)
 }
@@ -1951,7 +2886,7 @@ func (bc *BlockChain) writeBlockAndSetHead(block *types.Block, receipts []*types
 			}
 		}
 		if emitHeadEvent {
-			bc.chainHeadFeed.Send(ChainHeadEvent{Block: block})
+			bc.sendChainHeadEvent(ChainHeadEvent{Block: block})
 			if finalizedHeader != nil {
 				bc.finalizedHeaderFeed.Send(FinalizedHeaderEvent{finalizedHeader})
 			}
@@ -1978,6 +2913,7 @@ func (bc *BlockChain) addFutureBlock(block *types.Block) error {
 		return nil
 	}
 	bc.futureBlocks.Add(block.Hash(), block)
+	futureQueuedGauge.Update(int64(bc.futureBlocks.Len()))
 	return nil
 }
 
@@ -1986,6 +2922,30 @@ func (bc *BlockChain) addFutureBlock(block *types.Block) error {
 // the index number of the failing block as well an error describing what went
 // wrong. After insertion is done, all accumulated events will be fired.
 func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
+	return bc.insertChainRecorded(chain, nil)
+}
+
+// InsertChainDetailed works like InsertChain, but reports the outcome of the
+// import for every block of the given chain, in order. Blocks which weren't
+// reached because of an earlier failure are reported as not written.
+func (bc *BlockChain) InsertChainDetailed(chain types.Blocks) ([]BlockInsertResult, error) {
+	records := make(map[common.Hash]BlockInsertResult)
+	_, err := bc.insertChainRecorded(chain, records)
+
+	results := make([]BlockInsertResult, len(chain))
+	for i, block := range chain {
+		if result, ok := records[block.Hash()]; ok {
+			results[i] = result
+		} else {
+			results[i] = BlockInsertResult{Hash: block.Hash(), Number: block.NumberU64(), Status: NonStatTy}
+		}
+	}
+	return results, err
+}
+
+// insertChainRecorded implements InsertChain, recording the outcome of every
+// block import into records if it's non-nil.
+func (bc *BlockChain) insertChainRecorded(chain types.Blocks, records map[common.Hash]BlockInsertResult) (int, error) {
 	// Sanity check that we have something meaningful to import
 	if len(chain) == 0 {
 		return 0, nil
@@ -1994,6 +2954,110 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 	defer bc.blockProcFeed.Send(false)
 
 	// Do a sanity check that the provided chain is actually ordered and linked.
+	if err := checkContiguous(chain); err != nil {
+		return 0, err
+	}
+	// Pre-checks passed, start the full block imports
+	if !bc.lockChain() {
+		return 0, errChainStopped
+	}
+	defer bc.unlockChain()
+
+	if records != nil {
+		bc.insertResults = records
+		defer func() { bc.insertResults = nil }()
+	}
+	return bc.insertChain(chain, true)
+}
+
+// InsertChainNoReorg works like InsertChain, but refuses to import the batch
+// with ErrReorgRejected, without writing any of its blocks, if doing so would
+// reorganise the canonical chain. Blocks which extend the chain or are stored as
+// side blocks are imported as usual.
+//
+// Forks of equal weight are considered reorgs, regardless of how the tie would
+// be broken on import.
+func (bc *BlockChain) InsertChainNoReorg(chain types.Blocks) (int, error) {
+	if len(chain) == 0 {
+		return 0, nil
+	}
+	if err := checkContiguous(chain); err != nil {
+		return 0, err
+	}
+	bc.blockProcFeed.Send(true)
+	defer bc.blockProcFeed.Send(false)
+
+	if !bc.lockChain() {
+		return 0, errChainStopped
+	}
+	defer bc.unlockChain()
+
+	if err := bc.checkNoReorg(chain); err != nil {
+		return 0, err
+	}
+	return bc.insertChain(chain, true)
+}
+
+// checkNoReorg replays the fork choice of the import of the given contiguous
+// chain, returning ErrReorgRejected if any of its blocks would become the new
+// head without extending the previous one. The chain mutex is assumed to be held.
+func (bc *BlockChain) checkNoReorg(chain types.Blocks) error {
+	td := bc.GetTd(chain[0].ParentHash(), chain[0].NumberU64()-1)
+	if td == nil {
+		return nil // Unknown ancestor, leave it to the import to report
+	}
+	var (
+		reader  = &batchTdReader{ChainReader: bc, tds: make(map[common.Hash]*big.Int)}
+		forker  = &ForkChoice{chain: reader, rand: rand.New(tieSource{}), preserve: bc.forker.preserve}
+		current = bc.CurrentBlock()
+	)
+	for _, block := range chain {
+		td = new(big.Int).Add(td, block.Difficulty())
+		if bc.GetCanonicalHash(block.NumberU64()) == block.Hash() {
+			continue
+		}
+		reader.tds[block.Hash()] = td
+
+		reorg, err := forker.ReorgNeededWithFastFinality(current, block.Header())
+		if err != nil {
+			return err
+		}
+		if !reorg {
+			continue
+		}
+		if block.ParentHash() != current.Hash() {
+			return fmt.Errorf("%w: block #%d [%x..] replaces head #%d [%x..]", ErrReorgRejected,
+				block.NumberU64(), block.Hash().Bytes()[:4], current.Number, current.Hash().Bytes()[:4])
+		}
+		current = block.Header()
+	}
+	return nil
+}
+
+// batchTdReader is a fork choice chain reader which knows the total difficulties
+// of the blocks of a batch before they're written.
+type batchTdReader struct {
+	ChainReader
+	tds map[common.Hash]*big.Int
+}
+
+// GetTd returns the total difficulty of a batch block, or of a local block.
+func (r *batchTdReader) GetTd(hash common.Hash, number uint64) *big.Int {
+	if td, ok := r.tds[hash]; ok {
+		return td
+	}
+	return r.ChainReader.GetTd(hash, number)
+}
+
+// tieSource is a random source making the fork choice break every tie of total
+// difficulty in favour of the external chain.
+type tieSource struct{}
+
+func (tieSource) Int63() int64 { return 0 }
+func (tieSource) Seed(int64)   {}
+
+// checkContiguous checks that the provided chain is actually ordered and linked.
+func checkContiguous(chain types.Blocks) error {
 	for i := 1; i < len(chain); i++ {
 		block, prev := chain[i], chain[i-1]
 		if block.NumberU64() != prev.NumberU64()+1 || block.ParentHash() != prev.Hash() {
@@ -2004,16 +3068,92 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 				"prevnumber", prev.Number(),
 				"prevhash", prev.Hash(),
 			)
-			return 0, fmt.Errorf("non contiguous insert: item %d is #%d [%x..], item %d is #%d [%x..] (parent [%x..])", i-1, prev.NumberU64(),
+			return fmt.Errorf("non contiguous insert: item %d is #%d [%x..], item %d is #%d [%x..] (parent [%x..])", i-1, prev.NumberU64(),
 				prev.Hash().Bytes()[:4], i, block.NumberU64(), block.Hash().Bytes()[:4], block.ParentHash().Bytes()[:4])
 		}
 	}
-	// Pre-checks passed, start the full block imports
-	if !bc.chainmu.TryLock() {
-		return 0, errChainStopped
+	return nil
+}
+
+// checkSenders rejects the block if any of its transactions was sent from an
+// address refused by the sender filter. The senders are usually already cached
+// by the background sender recovery.
+func (bc *BlockChain) checkSenders(block *types.Block) error {
+	if bc.senderFilter == nil {
+		return nil
 	}
-	defer bc.chainmu.Unlock()
-	return bc.insertChain(chain, true)
+	signer := types.MakeSigner(bc.chainConfig, block.Number(), block.Time())
+	for i, tx := range block.Transactions() {
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			return fmt.Errorf("could not recover sender of tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+		}
+		if bc.senderFilter(from) {
+			return fmt.Errorf("%w: tx %d [%v] from %v", ErrFilteredSender, i, tx.Hash().Hex(), from)
+		}
+	}
+	return nil
+}
+
+// checkBodyRoots verifies the transaction and uncle roots of the block header
+// against the ones derived from the block body.
+func checkBodyRoots(block *types.Block) error {
+	header := block.Header()
+	if hash := types.DeriveSha(block.Transactions(), trie.NewStackTrie(nil)); hash != header.TxHash {
+		return fmt.Errorf("transaction root hash mismatch: have %x, want %x", hash, header.TxHash)
+	}
+	if hash := types.CalcUncleHash(block.Uncles()); hash != header.UncleHash {
+		return fmt.Errorf("uncle root hash mismatch: have %x, want %x", hash, header.UncleHash)
+	}
+	return nil
+}
+
+// recordInsert records the import outcome of a block if a detailed insertion is
+// in progress. The chain mutex is assumed to be held.
+func (bc *BlockChain) recordInsert(block *types.Block, status WriteStatus, skipped, queued bool) {
+	if bc.insertResults == nil {
+		return
+	}
+	bc.insertResults[block.Hash()] = BlockInsertResult{
+		Hash:    block.Hash(),
+		Number:  block.NumberU64(),
+		Status:  status,
+		Skipped: skipped,
+		Queued:  queued,
+	}
+}
+
+// addInsertStats folds the stats of a finished chain insertion into the totals.
+func (bc *BlockChain) addInsertStats(stats InsertStatsSnapshot, elapsed time.Duration) {
+	bc.insertTotalsLock.Lock()
+	defer bc.insertTotalsLock.Unlock()
+
+	bc.insertTotals.Processed += stats.Processed
+	bc.insertTotals.Queued += stats.Queued
+	bc.insertTotals.Ignored += stats.Ignored
+	bc.insertTotals.UsedGas += stats.UsedGas
+	bc.insertTotals.InsertTime += elapsed
+}
+
+// ReorgReexecStats is the cost of re-executing the pruned ancestors of a block,
+// needed to regenerate their state before a reorg onto a side chain or the
+// import of a block on top of them.
+type ReorgReexecStats struct {
+	Blocks int           // Number of ancestor blocks scheduled for re-execution
+	Time   time.Duration // Time spent re-executing them
+}
+
+// reportReorgReexec records the cost of a finished re-execution, replacing the
+// previous one.
+func (bc *BlockChain) reportReorgReexec(blocks int, start time.Time) {
+	stats := ReorgReexecStats{Blocks: blocks, Time: time.Since(start)}
+
+	reorgReexecBlocksGauge.Update(int64(stats.Blocks))
+	reorgReexecTimer.Update(stats.Time)
+
+	bc.lastReorgReexecLock.Lock()
+	bc.lastReorgReexec = stats
+	bc.lastReorgReexecLock.Unlock()
 }
 
 // insertChain is the internal implementation of InsertChain, which assumes that
@@ -2030,18 +3170,25 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 		return 0, nil
 	}
 
+	// Track the insertion for idle detection, both ends count as activity
+	bc.lastInsert.Store(time.Now().UnixNano())
+	defer func() { bc.lastInsert.Store(time.Now().UnixNano()) }()
+
 	// Start a parallel signature recovery (signer will fluke on fork transition, minimal perf loss)
 	signer := types.MakeSigner(bc.chainConfig, chain[0].Number(), chain[0].Time())
-	go SenderCacher.RecoverFromBlocks(signer, chain)
+	go bc.senderCacher.RecoverFromBlocks(signer, chain)
 
 	var (
 		stats     = insertStats{startTime: mclock.Now()}
 		lastCanon *types.Block
 	)
+	defer func(start time.Time) {
+		bc.addInsertStats(stats.total(), time.Since(start))
+	}(time.Now())
 	// Fire a single chain head event if we've progressed the chain
 	defer func() {
 		if lastCanon != nil && bc.CurrentBlock().Hash() == lastCanon.Hash() {
-			bc.chainHeadFeed.Send(ChainHeadEvent{lastCanon})
+			bc.sendChainHeadEvent(ChainHeadEvent{lastCanon})
 			if posa, ok := bc.Engine().(consensus.PoSA); ok {
 				if finalizedHeader := posa.GetFinalizedHeader(bc, lastCanon.Header()); finalizedHeader != nil {
 					bc.finalizedHeaderFeed.Send(FinalizedHeaderEvent{finalizedHeader})
@@ -2066,7 +3213,8 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 	defer close(abort)
 
 	// Peek the error for the first block to decide the directing import logic
-	it := newInsertIterator(chain, results, bc.validator)
+	validator := bc.Validator()
+	it := newInsertIterator(chain, results, validator)
 	block, err := it.next()
 
 	// Left-trim all the known blocks that don't need to build snapshot
@@ -2097,6 +3245,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 			}
 			log.Debug("Ignoring already known block", "number", block.Number(), "hash", block.Hash())
 			stats.ignored++
+			bc.recordInsert(block, NonStatTy, true, false)
 
 			block, err = it.next()
 		}
@@ -2113,6 +3262,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 			if err := bc.writeKnownBlock(block); err != nil {
 				return it.index, err
 			}
+			bc.recordInsert(block, CanonStatTy, true, false)
 			lastCanon = block
 
 			block, err = it.next()
@@ -2139,6 +3289,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 			if err := bc.addFutureBlock(block); err != nil {
 				return it.index, err
 			}
+			bc.recordInsert(block, NonStatTy, false, true)
 			block, err = it.next()
 		}
 		stats.queued += it.processed()
@@ -2168,6 +3319,18 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 			bc.reportBlock(block, nil, ErrBannedHash)
 			return it.index, ErrBannedHash
 		}
+		// If the block contains transactions from filtered senders, reject it
+		if err := bc.checkSenders(block); err != nil {
+			bc.reportBlock(block, nil, err)
+			return it.index, err
+		}
+		// If the body doesn't match the header, reject it before execution
+		if bc.cacheConfig.StrictBodyValidation {
+			if err := checkBodyRoots(block); err != nil {
+				bc.reportBlock(block, nil, err)
+				return it.index, err
+			}
+		}
 		// If the block is known (in the middle of the chain), it's a special case for
 		// Clique blocks where they can share state among each other, so importing an
 		// older block might complete the state of the subsequent one. In this case,
@@ -2200,6 +3363,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 			if err := bc.writeKnownBlock(block); err != nil {
 				return it.index, err
 			}
+			bc.recordInsert(block, CanonStatTy, true, false)
 			stats.processed++
 
 			// We can assume that logs are empty here, since the only way for consecutive
@@ -2215,7 +3379,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 			parent = bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
 		}
 
-		statedb, err := state.NewWithSharedPool(parent.Root, bc.stateCache, bc.snaps)
+		statedb, err := state.NewWithSharedPool(parent.Root, bc.stateCache, bc.snaps.Load())
 		if err != nil {
 			return it.index, err
 		}
@@ -2225,17 +3389,21 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 		statedb.StartPrefetcher("chain")
 		interruptCh := make(chan struct{})
 		// For diff sync, it may fallback to full sync, so we still do prefetch
-		if len(block.Transactions()) >= prefetchTxNumber {
+		if len(block.Transactions()) >= prefetchTxNumber &&
+			(!bc.cacheConfig.NoSnapshotPrefetch || !bc.cacheConfig.NoTriePrefetchInAdvance) {
 			// do Prefetch in a separate goroutine to avoid blocking the critical path
-
-			// 1.do state prefetch for snapshot cache
 			throwaway := statedb.CopyDoPrefetch()
-			go bc.prefetcher.Prefetch(block, throwaway, &bc.vmConfig, interruptCh)
 
+			// 1.do state prefetch for snapshot cache
+			if !bc.cacheConfig.NoSnapshotPrefetch {
+				go bc.prefetcher.Prefetch(block, throwaway, &bc.vmConfig, interruptCh)
+			}
 			// 2.do trie prefetch for MPT trie node cache
 			// it is for the big state trie tree, prefetch based on transaction's From/To address.
 			// trie prefetcher is thread safe now, ok to prefetch in a separate routine
-			go throwaway.TriePrefetchInAdvance(block, signer)
+			if !bc.cacheConfig.NoTriePrefetchInAdvance {
+				go throwaway.TriePrefetchInAdvance(block, signer)
+			}
 		}
 
 		// Process block using the parent state as reference point
@@ -2244,7 +3412,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 		}
 		statedb.SetExpectedStateRoot(block.Root())
 		pstart := time.Now()
-		statedb, receipts, logs, usedGas, err := bc.processor.Process(block, statedb, bc.vmConfig)
+		statedb, receipts, logs, usedGas, err := bc.Processor().Process(block, statedb, bc.vmConfig)
 		close(interruptCh) // state prefetch can be stopped
 		if err != nil {
 			bc.reportBlock(block, receipts, err)
@@ -2253,9 +3421,17 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 		}
 		ptime := time.Since(pstart)
 
+		// Cross check the gas used reported by the processor if requested, the
+		// validator is expected to cover it, but might be replaced
+		if bc.cacheConfig.StrictGasValidation && usedGas != block.GasUsed() {
+			err := fmt.Errorf("invalid gas used (remote: %d local: %d)", block.GasUsed(), usedGas)
+			bc.reportBlock(block, receipts, err)
+			statedb.StopPrefetcher()
+			return it.index, err
+		}
 		// Validate the state using the default validator
 		vstart := time.Now()
-		if err := bc.validator.ValidateState(block, statedb, receipts, usedGas); err != nil {
+		if err := validator.ValidateState(block, statedb, receipts, usedGas); err != nil {
 			log.Error("validate state failed", "error", err)
 			bc.reportBlock(block, receipts, err)
 			statedb.StopPrefetcher()
@@ -2282,6 +3458,10 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 		blockExecutionTimer.Update(ptime - trieRead)                    // The time spent on EVM processing
 		blockValidationTimer.Update(vtime - (triehash + trieUpdate))    // The time spent on block validation
 
+		// Track the trie reads of the block, spikes of these point to cold caches
+		accountTrieReadGauge.Update(int64(statedb.AccountTrieReads))
+		storageTrieReadGauge.Update(int64(statedb.StorageTrieReads))
+
 		// Write the block to the chain and get the status.
 		var (
 			wstart = time.Now()
@@ -2307,14 +3487,16 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 
 		blockWriteTimer.Update(time.Since(wstart) - statedb.AccountCommits - statedb.StorageCommits - statedb.SnapshotCommits - statedb.TrieDBCommits)
 		blockInsertTimer.UpdateSince(start)
+		bc.gasWindow.add(usedGas, time.Since(start))
 
 		// Report the import stats before returning the various results
 		stats.processed++
 		stats.usedGas += usedGas
+		bc.recordInsert(block, status, false, false)
 
 		var snapDiffItems, snapBufItems common.StorageSize
-		if bc.snaps != nil {
-			snapDiffItems, snapBufItems, _ = bc.snaps.Size()
+		if snaps := bc.snaps.Load(); snaps != nil {
+			snapDiffItems, snapBufItems, _ = snaps.Size()
 		}
 		trieDiffNodes, trieBufNodes, trieImmutableBufNodes, _ := bc.triedb.Size()
 		stats.report(chain, it.index, snapDiffItems, snapBufItems, trieDiffNodes, trieBufNodes, trieImmutableBufNodes, status == CanonStatTy)
@@ -2360,12 +3542,14 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 		if err := bc.addFutureBlock(block); err != nil {
 			return it.index, err
 		}
+		bc.recordInsert(block, NonStatTy, false, true)
 		block, err = it.next()
 
 		for ; block != nil && errors.Is(err, consensus.ErrUnknownAncestor); block, err = it.next() {
 			if err := bc.addFutureBlock(block); err != nil {
 				return it.index, err
 			}
+			bc.recordInsert(block, NonStatTy, false, true)
 			stats.queued++
 		}
 	}
@@ -2405,6 +3589,21 @@ func (bc *BlockChain) GetHighestVerifiedHeader() *types.Header {
 	return bc.highestVerifiedHeader.Load()
 }
 
+// SeedHighestVerifiedHeader sets the highest verified header, e.g. to carry it
+// over a coordinated restart. The header must be known locally and it is only
+// taken if its total difficulty is higher than the current one, so the highest
+// verified header never moves backwards.
+func (bc *BlockChain) SeedHighestVerifiedHeader(header *types.Header) error {
+	if header == nil || header.Number == nil {
+		return errors.New("invalid header")
+	}
+	if bc.GetHeaderByHash(header.Hash()) == nil {
+		return fmt.Errorf("unknown header #%d [%x..]", header.Number, header.Hash().Bytes()[:4])
+	}
+	bc.updateHighestVerifiedHeader(header)
+	return nil
+}
+
 // insertSideChain is called when an import batch hits upon a pruned ancestor
 // error, which happens when a sidechain with a sufficiently old fork-block is
 // found.
@@ -2434,6 +3633,7 @@ func (bc *BlockChain) insertSideChain(block *types.Block, it *insertIterator) (i
 				// we can get it directly, and not (like further below) use
 				// the parent and then add the block on top
 				externTd = bc.GetTd(block.Hash(), block.NumberU64())
+				bc.recordInsert(block, NonStatTy, true, false)
 				continue
 			}
 			if canonical != nil && canonical.Root() == block.Root() {
@@ -2462,6 +3662,7 @@ func (bc *BlockChain) insertSideChain(block *types.Block, it *insertIterator) (i
 			if err := bc.writeBlockWithoutState(block, externTd); err != nil {
 				return it.index, err
 			}
+			bc.recordInsert(block, SideStatTy, false, false)
 			log.Debug("Injected sidechain block", "number", block.Number(), "hash", block.Hash(),
 				"diff", block.Difficulty(), "elapsed", common.PrettyDuration(time.Since(start)),
 				"txs", len(block.Transactions()), "gas", block.GasUsed(), "uncles", len(block.Uncles()),
@@ -2505,6 +3706,8 @@ func (bc *BlockChain) insertSideChain(block *types.Block, it *insertIterator) (i
 	if parent == nil {
 		return it.index, errors.New("missing parent")
 	}
+	defer bc.reportReorgReexec(len(hashes), time.Now())
+
 	// Import all the pruned blocks to make the state available
 	var (
 		blocks []*types.Block
@@ -2577,6 +3780,8 @@ func (bc *BlockChain) recoverAncestors(block *types.Block) (common.Hash, error)
 	if parent == nil {
 		return common.Hash{}, errors.New("missing parent")
 	}
+	defer bc.reportReorgReexec(len(hashes), time.Now())
+
 	// Import all the pruned blocks to make the state available
 	for i := len(hashes) - 1; i >= 0; i-- {
 		// If the chain is terminating, stop processing blocks
@@ -2600,28 +3805,133 @@ func (bc *BlockChain) recoverAncestors(block *types.Block) (common.Hash, error)
 	return block.Hash(), nil
 }
 
-// collectLogs collects the logs that were generated or removed during
-// the processing of a block. These logs are later announced as deleted or reborn.
-func (bc *BlockChain) collectLogs(b *types.Block, removed bool) []*types.Log {
-	var blobGasPrice *big.Int
-	excessBlobGas := b.ExcessBlobGas()
-	if excessBlobGas != nil {
-		blobGasPrice = eip4844.CalcBlobFee(*excessBlobGas)
+// StateAtBlock returns the state after the given block. If the state is not
+// available anymore, the closest ancestor with state is searched within reexec
+// blocks and the blocks on top of it are re-executed to rebuild it.
+//
+// The ancestor state is opened through an ephemeral trie database and the
+// re-executed blocks are never committed, so neither the live trie database
+// nor the chain database is written to. The rebuilt state is only held by the
+// returned statedb.
+func (bc *BlockChain) StateAtBlock(block *types.Block, reexec uint64) (*state.StateDB, error) {
+	if bc.HasState(block.Root()) {
+		return bc.StateAt(block.Root())
 	}
-	receipts := rawdb.ReadRawReceipts(bc.db, b.Hash(), b.NumberU64())
-	if err := receipts.DeriveFields(bc.chainConfig, b.Hash(), b.NumberU64(), b.Time(), b.BaseFee(), blobGasPrice, b.Transactions()); err != nil {
-		log.Error("Failed to derive block receipts fields", "hash", b.Hash(), "number", b.NumberU64(), "err", err)
+	if bc.triedb.Scheme() == rawdb.PathScheme {
+		return nil, errors.New("historical state not available in path scheme")
 	}
-	var logs []*types.Log
-	for _, receipt := range receipts {
-		for _, log := range receipt.Logs {
-			if removed {
-				log.Removed = true
+	// Gather the ancestors to re-execute (full blocks may be memory heavy)
+	var (
+		hashes  []common.Hash
+		numbers []uint64
+		current = block
+
+		tdb      = triedb.NewDatabase(bc.db, triedb.HashDefaults)
+		database = state.NewDatabaseWithNodeDB(bc.db, tdb)
+		statedb  *state.StateDB
+	)
+	for i := uint64(0); i < reexec; i++ {
+		if current.NumberU64() == 0 {
+			return nil, errors.New("genesis state is missing")
+		}
+		hashes = append(hashes, current.Hash())
+		numbers = append(numbers, current.NumberU64())
+
+		parent := bc.GetBlock(current.ParentHash(), current.NumberU64()-1)
+		if parent == nil {
+			return nil, fmt.Errorf("missing block #%d [%x..]", current.NumberU64()-1, current.ParentHash().Bytes()[:4])
+		}
+		current = parent
+
+		if sdb, err := state.New(current.Root(), database, nil); err == nil {
+			statedb = sdb
+			break
+		}
+	}
+	if statedb == nil {
+		return nil, fmt.Errorf("no state available within %d ancestors of block #%d [%x..]", reexec, block.NumberU64(), block.Hash().Bytes()[:4])
+	}
+	// State is available at the ancestor, re-execute the blocks on top of it
+	var (
+		start     = time.Now()
+		logged    = time.Now()
+		processor = bc.Processor()
+	)
+	for i := len(hashes) - 1; i >= 0; i-- {
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Regenerating historical state", "block", numbers[i], "target", block.NumberU64(), "remaining", i, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+		next := block
+		if i != 0 {
+			if next = bc.GetBlock(hashes[i], numbers[i]); next == nil {
+				return nil, fmt.Errorf("missing block #%d [%x..]", numbers[i], hashes[i].Bytes()[:4])
 			}
-			logs = append(logs, log)
 		}
+		var err error
+		statedb, _, _, _, err = processor.Process(next, statedb, bc.vmConfig)
+		if err != nil {
+			return nil, fmt.Errorf("processing block #%d failed: %v", next.NumberU64(), err)
+		}
+		// Finalize the state and carry it over to the next block uncommitted,
+		// a commit would write the deployed contract code to the chain database.
+		statedb.Finalise(bc.chainConfig.IsEIP158(next.Number()))
 	}
-	return logs
+	log.Debug("Historical state regenerated", "number", block.NumberU64(), "hash", block.Hash(), "reexec", len(hashes), "elapsed", common.PrettyDuration(time.Since(start)))
+	return statedb, nil
+}
+
+// ReplayBlock re-executes the given block on top of its parent state with the
+// supplied vm config, e.g. to trace its transactions. The block itself is not
+// committed and the chain markers are left untouched, the results are only
+// returned to the caller. If the parent state has to be regenerated, it is
+// rebuilt in memory only as described at StateAtBlock.
+func (bc *BlockChain) ReplayBlock(block *types.Block, cfg vm.Config) (types.Receipts, []*types.Log, uint64, error) {
+	if block.NumberU64() == 0 {
+		return nil, nil, 0, errors.New("genesis is not replayable")
+	}
+	parent := bc.GetBlock(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, nil, 0, consensus.ErrUnknownAncestor
+	}
+	statedb, err := bc.StateAtBlock(parent, replayBlockReexec)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer statedb.StopPrefetcher()
+
+	_, receipts, logs, usedGas, err := bc.Processor().Process(block, statedb, cfg)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return receipts, logs, usedGas, nil
+}
+
+// collectLogs collects the logs that were generated or removed during
+// the processing of a block. These logs are later announced as deleted or reborn.
+func (bc *BlockChain) collectLogs(b *types.Block, removed bool) []*types.Log {
+	var blobGasPrice *big.Int
+	excessBlobGas := b.ExcessBlobGas()
+	if excessBlobGas != nil {
+		blobGasPrice = eip4844.CalcBlobFee(*excessBlobGas)
+	}
+	receipts := rawdb.ReadRawReceipts(bc.db, b.Hash(), b.NumberU64())
+	if receipts == nil && len(b.Transactions()) > 0 {
+		// The receipts may be pruned while the diff layer still carries them
+		receipts = bc.diffLayerReceipts(b.Hash(), b.Header())
+	} else if err := receipts.DeriveFields(bc.chainConfig, b.Hash(), b.NumberU64(), b.Time(), b.BaseFee(), blobGasPrice, b.Transactions()); err != nil {
+		log.Error("Failed to derive block receipts fields", "hash", b.Hash(), "number", b.NumberU64(), "err", err)
+	}
+	var logs []*types.Log
+	for _, receipt := range receipts {
+		for _, log := range receipt.Logs {
+			if removed {
+				log.Removed = true
+			}
+			logs = append(logs, log)
+		}
+	}
+	return logs
 }
 
 // reorg takes two blocks, an old chain and a new chain and will reconstruct the
@@ -2691,6 +4001,16 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 		}
 	}
 
+	// Finalized blocks must never be reorged out, refuse if protection is on
+	if bc.finalityReorgProtection {
+		if posa, ok := bc.engine.(consensus.PoSA); ok {
+			if finalized := posa.GetFinalizedHeader(bc, oldHead); finalized != nil && commonBlock.NumberU64() < finalized.Number.Uint64() {
+				err := fmt.Errorf("%w: common ancestor #%d, finalized #%d", ErrFinalizedReorg, commonBlock.NumberU64(), finalized.Number.Uint64())
+				bc.reportBlock(newHead, nil, err)
+				return err
+			}
+		}
+	}
 	// Ensure the user sees large reorgs
 	if len(oldChain) > 0 && len(newChain) > 0 {
 		logFn := log.Info
@@ -2704,6 +4024,21 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 		blockReorgAddMeter.Mark(int64(len(newChain)))
 		blockReorgDropMeter.Mark(int64(len(oldChain)))
 		blockReorgMeter.Mark(1)
+
+		// Track the head flipping between blocks at the same height
+		if len(oldChain) == 1 && len(newChain) == 1 {
+			blockReorgChurnMeter.Mark(1)
+			if bc.reorgChurn > 0 && bc.reorgChurnHeight == newHead.NumberU64() {
+				bc.reorgChurn++
+			} else {
+				bc.reorgChurn, bc.reorgChurnHeight = 1, newHead.NumberU64()
+			}
+			if bc.reorgChurn >= reorgChurnWarnThreshold {
+				log.Warn("Repeated reorgs at the same height", "number", newHead.Number(), "count", bc.reorgChurn)
+			}
+		} else {
+			bc.reorgChurn = 0
+		}
 	} else if len(newChain) > 0 {
 		// Special case happens in the post merge stage that current head is
 		// the ancestor of new head while these two blocks are not consecutive
@@ -2719,6 +4054,7 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 	// weird scenario that canonical chain is changed while the
 	// stale lookups are still cached.
 	bc.txLookupCache.Purge()
+	txLookupCacheGauge.Update(0)
 
 	// Insert the new chain(except the head block(reverse order)),
 	// taking care of the proper incremental order.
@@ -2742,6 +4078,14 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 	for _, tx := range diffs {
 		rawdb.DeleteTxLookupEntry(indexesBatch, tx)
 	}
+	// Retain the receipts of the dropped blocks before they become unreachable
+	if bc.cacheConfig.RetainOrphanReceipts {
+		for _, block := range oldChain {
+			if receipts := rawdb.ReadReceiptsRLP(bc.db, block.Hash(), block.NumberU64()); len(receipts) > 0 {
+				rawdb.WriteOrphanReceiptsRLP(indexesBatch, block.Hash(), receipts)
+			}
+		}
+	}
 	// Delete all hash markers that are not part of the new canonical chain.
 	// Because the reorg function does not handle new chain head, all hash
 	// markers greater than or equal to new chain head should be deleted.
@@ -2768,10 +4112,17 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 	// high, so the events are sent in batches of size around 512.
 
 	// Deleted logs + blocks:
-	var deletedLogs []*types.Log
+	var (
+		deletedLogs   []*types.Log
+		removedBlocks = make([]*types.Block, 0, len(oldChain))
+	)
 	for i := len(oldChain) - 1; i >= 0; i-- {
+		// Drop the encoded receipts of the blocks removed from the canon chain.
+		bc.receiptsRLPCache.Remove(oldChain[i].Hash())
+
 		// Also send event for blocks removed from the canon chain.
 		bc.chainSideFeed.Send(ChainSideEvent{Block: oldChain[i]})
+		removedBlocks = append(removedBlocks, oldChain[i])
 
 		// Collect deleted logs for notification
 		if logs := bc.collectLogs(oldChain[i], true); len(logs) > 0 {
@@ -2785,6 +4136,9 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 	if len(deletedLogs) > 0 {
 		bc.rmLogsFeed.Send(RemovedLogsEvent{deletedLogs})
 	}
+	if len(removedBlocks) > 0 {
+		bc.chainSideBatchFeed.Send(ChainSideBatchEvent{Blocks: removedBlocks})
+	}
 
 	// New logs:
 	var rebirthLogs []*types.Log
@@ -2809,10 +4163,10 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 // updating. It relies on the additional SetCanonical call to finalize the entire
 // procedure.
 func (bc *BlockChain) InsertBlockWithoutSetHead(block *types.Block) error {
-	if !bc.chainmu.TryLock() {
+	if !bc.lockChain() {
 		return errChainStopped
 	}
-	defer bc.chainmu.Unlock()
+	defer bc.unlockChain()
 
 	_, err := bc.insertChain(types.Blocks{block}, false)
 	return err
@@ -2822,10 +4176,10 @@ func (bc *BlockChain) InsertBlockWithoutSetHead(block *types.Block) error {
 // block. It's possible that the state of the new head is missing, and it will
 // be recovered in this function as well.
 func (bc *BlockChain) SetCanonical(head *types.Block) (common.Hash, error) {
-	if !bc.chainmu.TryLock() {
+	if !bc.lockChain() {
 		return common.Hash{}, errChainStopped
 	}
-	defer bc.chainmu.Unlock()
+	defer bc.unlockChain()
 
 	// Re-execute the reorged chain in case the head state is missing.
 	if !bc.HasState(head.Root()) {
@@ -2849,7 +4203,7 @@ func (bc *BlockChain) SetCanonical(head *types.Block) (common.Hash, error) {
 	if len(logs) > 0 {
 		bc.logsFeed.Send(logs)
 	}
-	bc.chainHeadFeed.Send(ChainHeadEvent{Block: head})
+	bc.sendChainHeadEvent(ChainHeadEvent{Block: head})
 
 	context := []interface{}{
 		"number", head.Number(),
@@ -2878,8 +4232,141 @@ func (bc *BlockChain) updateFutureBlocks() {
 	}
 }
 
-func (bc *BlockChain) rewindInvalidHeaderBlockLoop() {
-	recheck := time.NewTicker(rewindBadBlockInterval)
+// sendChainHeadEvent sends the chain head event to the subscribers, either
+// directly or through the coalescer if enabled.
+func (bc *BlockChain) sendChainHeadEvent(ev ChainHeadEvent) {
+	updateHeadLag(ev.Block.Time())
+	if bc.headEventCh == nil {
+		bc.chainHeadFeed.Send(ev)
+		return
+	}
+	select {
+	case bc.headEventCh <- ev:
+	case <-bc.quit:
+	}
+}
+
+// updateHeadLag reports how far behind the wall clock the head block is.
+func updateHeadLag(blockTime uint64) {
+	headLagGauge.Update(time.Now().Unix() - int64(blockTime))
+}
+
+// headEventLoop coalesces the chain head events, only the latest head within
+// each window is forwarded to the subscribers. The window starts with the first
+// event after the previous delivery, so the final head is always delivered.
+func (bc *BlockChain) headEventLoop(window time.Duration) {
+	timer := time.NewTimer(window)
+	timer.Stop()
+	defer func() {
+		timer.Stop()
+		bc.wg.Done()
+	}()
+	var (
+		pending *ChainHeadEvent
+		timeout <-chan time.Time
+	)
+	for {
+		select {
+		case ev := <-bc.headEventCh:
+			if pending == nil {
+				timer.Reset(window)
+				timeout = timer.C
+			}
+			pending = &ev
+		case <-timeout:
+			bc.chainHeadFeed.Send(*pending)
+			pending, timeout = nil, nil
+		case <-bc.quit:
+			if pending != nil {
+				bc.chainHeadFeed.Send(*pending)
+			}
+			return
+		}
+	}
+}
+
+// idleFlushLoop flushes the state of the chain head to disk once no blocks were
+// imported for the given delay, limiting the amount of state lost in a crash
+// while the chain is idle.
+func (bc *BlockChain) idleFlushLoop(delay time.Duration) {
+	recheck := time.NewTicker(delay / 2)
+	defer func() {
+		recheck.Stop()
+		bc.wg.Done()
+	}()
+	var flushed common.Hash
+	for {
+		select {
+		case <-recheck.C:
+			if time.Since(time.Unix(0, bc.lastInsert.Load())) < delay {
+				continue
+			}
+			head := bc.CurrentBlock()
+			if head.Root == flushed {
+				continue
+			}
+			bc.commitLock.Lock()
+			if err := bc.triedb.Commit(head.Root, false); err != nil {
+				log.Error("Failed to flush idle state", "number", head.Number, "root", head.Root, "err", err)
+			} else {
+				rawdb.WriteSafePointBlockNumber(bc.db, head.Number.Uint64())
+				bc.lastWrite = head.Number.Uint64()
+				bc.gcproc = 0
+				flushed = head.Root
+				log.Debug("Flushed idle state", "number", head.Number, "root", head.Root)
+			}
+			bc.commitLock.Unlock()
+		case <-bc.quit:
+			return
+		}
+	}
+}
+
+// snapGenLoop periodically reports the progress of the snapshot generation to
+// the subscribers, including the completion of the generation.
+func (bc *BlockChain) snapGenLoop() {
+	recheck := time.NewTicker(snapGenRecheckInterval)
+	defer func() {
+		recheck.Stop()
+		bc.wg.Done()
+	}()
+	var (
+		last       snapshot.GenerationProgress
+		generating bool
+	)
+	for {
+		select {
+		case <-recheck.C:
+			snaps := bc.snaps.Load()
+			if snaps == nil {
+				continue
+			}
+			progress, err := snaps.GenerationProgress()
+			if err != nil || progress == last {
+				continue
+			}
+			last = progress
+
+			// Complete snapshots are only reported once, right after generation
+			if progress.Done && !generating {
+				continue
+			}
+			generating = !progress.Done
+			bc.snapGenFeed.Send(SnapGenEvent{
+				Root:     progress.Root,
+				Accounts: progress.Accounts,
+				Slots:    progress.Slots,
+				Storage:  progress.Storage,
+				Done:     progress.Done,
+			})
+		case <-bc.quit:
+			return
+		}
+	}
+}
+
+func (bc *BlockChain) rewindInvalidHeaderBlockLoop(interval time.Duration) {
+	recheck := time.NewTicker(interval)
 	defer func() {
 		recheck.Stop()
 		bc.wg.Done()
@@ -2951,6 +4438,16 @@ func (bc *BlockChain) trustedDiffLayerLoop() {
 					rawdb.WriteDiffLayer(batch, diffLayer.BlockHash, diffLayer)
 					staleHash := bc.GetCanonicalHash(uint64(-prio) - bc.diffLayerFreezerBlockLimit)
 					rawdb.DeleteDiffLayer(batch, staleHash)
+
+					// Keep the recent layers hot for the verify requests, the
+					// older ones can be served from the freezer from now on.
+					if bc.residentDiffLayers > 0 {
+						if currentHeight-diffLayer.Number < bc.residentDiffLayers {
+							bc.diffLayerCache.Add(diffLayer.BlockHash, diffLayer)
+						} else {
+							bc.diffLayerCache.Remove(diffLayer.BlockHash)
+						}
+					}
 				}
 				if batch != nil && batch.ValueSize() > ethdb.IdealBatchSize {
 					if err := batch.Write(); err != nil {
@@ -2970,7 +4467,7 @@ func (bc *BlockChain) trustedDiffLayerLoop() {
 }
 
 func (bc *BlockChain) startDoubleSignMonitor() {
-	eventChan := make(chan ChainHeadEvent, monitor.MaxCacheHeader)
+	eventChan := make(chan ChainHeadEvent, bc.doubleSignMonitor.CacheSize())
 	sub := bc.SubscribeChainHeadEvent(eventChan)
 	defer func() {
 		sub.Unsubscribe()
@@ -2981,7 +4478,7 @@ func (bc *BlockChain) startDoubleSignMonitor() {
 	for {
 		select {
 		case event := <-eventChan:
-			if bc.doubleSignMonitor != nil {
+			if bc.doubleSignMonitor != nil && bc.doubleSignMonitorEnabled.Load() {
 				bc.doubleSignMonitor.Verify(event.Block.Header())
 			}
 		case <-bc.quit:
@@ -3001,7 +4498,8 @@ func (bc *BlockChain) skipBlock(err error, it *insertIterator) bool {
 	}
 	// If we're not using snapshots, we can skip this, since we have both block
 	// and (trie-) state
-	if bc.snaps == nil {
+	snaps := bc.snaps.Load()
+	if snaps == nil {
 		return true
 	}
 	var (
@@ -3009,7 +4507,7 @@ func (bc *BlockChain) skipBlock(err error, it *insertIterator) bool {
 		parentRoot common.Hash
 	)
 	// If we also have the snapshot-state, we can skip the processing.
-	if bc.snaps.Snapshot(header.Root) != nil {
+	if snaps.Snapshot(header.Root) != nil {
 		return true
 	}
 	// In this case, we have the trie-state but not snapshot-state. If the parent
@@ -3025,7 +4523,7 @@ func (bc *BlockChain) skipBlock(err error, it *insertIterator) bool {
 		return false // Theoretically impossible case
 	}
 	// Parent is also missing snapshot: we can skip this. Otherwise process.
-	if bc.snaps.Snapshot(parentRoot) == nil {
+	if snaps.Snapshot(parentRoot) == nil {
 		return true
 	}
 	return false
@@ -3093,10 +4591,10 @@ func (bc *BlockChain) InsertHeaderChain(chain []*types.Header) (int, error) {
 		return i, err
 	}
 
-	if !bc.chainmu.TryLock() {
+	if !bc.lockChain() {
 		return 0, errChainStopped
 	}
-	defer bc.chainmu.Unlock()
+	defer bc.unlockChain()
 	_, err := bc.hc.InsertHeaderChain(chain, start, bc.forker)
 	return 0, err
 }
@@ -3123,23 +4621,108 @@ func EnableBlockValidator(chainConfig *params.ChainConfig, engine consensus.Engi
 				return nil, err
 			}
 			go vm.mainLoop()
-			bc.validator = NewBlockValidator(chainConfig, bc, engine, EnableRemoteVerifyManager(vm))
+			var validator Validator = NewBlockValidator(chainConfig, bc, engine, EnableRemoteVerifyManager(vm))
+			bc.validator.Store(&validator)
+		}
+		return bc, nil
+	}
+}
+
+// EnableSampledRemoteVerify makes the remote verify mode of EnableBlockValidator
+// ask the peers to verify only the given fraction of the blocks, picked at
+// random. Blocks with a competing block at the same height, e.g. reorg
+// candidates, are always verified.
+//
+// This weakens the remote verify guarantee: a state divergence in a block that
+// isn't sampled goes unnoticed unless a later sampled block diverges too, so
+// the node may build on an invalid state for longer.
+func EnableSampledRemoteVerify(fraction float64) BlockChainOption {
+	return func(bc *BlockChain) (*BlockChain, error) {
+		if fraction <= 0 || fraction > 1 {
+			return nil, fmt.Errorf("invalid remote verify fraction %v, must be within (0, 1]", fraction)
 		}
+		bc.remoteVerifyFraction = fraction
 		return bc, nil
 	}
 }
 
-func EnableDoubleSignChecker(bc *BlockChain) (*BlockChain, error) {
-	bc.doubleSignMonitor = monitor.NewDoubleSignMonitor()
+// EnableFinalityReorgProtection rejects any reorg whose common ancestor is below
+// the finalized block of the current head. It only has an effect with the PoSA
+// consensus engines, which provide fast finality.
+func EnableFinalityReorgProtection(bc *BlockChain) (*BlockChain, error) {
+	bc.finalityReorgProtection = true
 	return bc, nil
 }
 
+// EnableDiffFollower allows ApplyDiffLayer to import blocks by applying the
+// state changes of diff layers produced by a trusted node, without executing
+// them. It's only supported with the hash state scheme.
+func EnableDiffFollower(bc *BlockChain) (*BlockChain, error) {
+	if bc.triedb.Scheme() != rawdb.HashScheme {
+		return nil, fmt.Errorf("diff follower mode requires the %s state scheme", rawdb.HashScheme)
+	}
+	bc.diffFollower = true
+	return bc, nil
+}
+
+// EnableSenderFilter rejects the import of any block containing a transaction
+// from a sender the filter returns true for, the block is reported as bad.
+//
+// WARNING: this deliberately breaks consensus. A filtered block which is valid
+// for the rest of the network will never be imported, so the node forks off the
+// canonical chain and stalls (or follows a minority fork) until the filter is
+// changed. Only use it if refusing such blocks is worth losing the sync.
+func EnableSenderFilter(filter func(common.Address) bool) BlockChainOption {
+	return func(bc *BlockChain) (*BlockChain, error) {
+		bc.senderFilter = filter
+		return bc, nil
+	}
+}
+
+// EnableDoubleSignChecker starts a monitor checking the new chain heads against
+// the last cacheSize headers for blocks double signed by the same validator, 0
+// meaning monitor.MaxCacheHeader. Each tracked header is kept in memory, as well
+// as the buffered head events, so a larger window catches equivocations across
+// more blocks at the cost of a few KB per extra header.
+func EnableDoubleSignChecker(cacheSize int) BlockChainOption {
+	return func(bc *BlockChain) (*BlockChain, error) {
+		if cacheSize == 0 {
+			cacheSize = monitor.MaxCacheHeader
+		}
+		if cacheSize < monitor.MinCacheHeader {
+			return nil, fmt.Errorf("double sign monitor cache too small: %d, min %d", cacheSize, monitor.MinCacheHeader)
+		}
+		bc.doubleSignMonitor = monitor.NewDoubleSignMonitor(cacheSize, func(h1, h2 *types.Header) {
+			bc.doubleSignFeed.Send(DoubleSignEvent{Header1: h1, Header2: h2, Signer: h1.Coinbase})
+		})
+		bc.doubleSignMonitorEnabled.Store(true)
+		return bc, nil
+	}
+}
+
+// SetDoubleSignMonitorEnabled pauses or resumes the verification of the new
+// chain heads by the double sign monitor. The monitor keeps running while paused
+// and the headers imported meanwhile are never checked. It's a noop if the chain
+// wasn't created with EnableDoubleSignChecker.
+func (bc *BlockChain) SetDoubleSignMonitorEnabled(enabled bool) {
+	bc.doubleSignMonitorEnabled.Store(enabled)
+}
+
+// DoubleSignReports returns the most recent double sign violations detected by
+// the monitor, or nil if the monitor isn't enabled.
+func (bc *BlockChain) DoubleSignReports() []monitor.DoubleSignReport {
+	if bc.doubleSignMonitor == nil {
+		return nil
+	}
+	return bc.doubleSignMonitor.Reports()
+}
+
 func (bc *BlockChain) GetVerifyResult(blockNumber uint64, blockHash common.Hash, diffHash common.Hash) *VerifyResult {
 	var res VerifyResult
 	res.BlockNumber = blockNumber
 	res.BlockHash = blockHash
 
-	if blockNumber > bc.CurrentHeader().Number.Uint64()+maxDiffForkDist {
+	if blockNumber > bc.CurrentHeader().Number.Uint64()+bc.maxDiffForkDist {
 		res.Status = types.StatusBlockTooNew
 		return &res
 	} else if blockNumber > bc.CurrentHeader().Number.Uint64() {
@@ -3149,7 +4732,7 @@ func (bc *BlockChain) GetVerifyResult(blockNumber uint64, blockHash common.Hash,
 
 	header := bc.GetHeaderByHash(blockHash)
 	if header == nil {
-		if blockNumber > bc.CurrentHeader().Number.Uint64()-maxDiffForkDist {
+		if blockNumber > bc.CurrentHeader().Number.Uint64()-bc.maxDiffForkDist {
 			res.Status = types.StatusPossibleFork
 			return &res
 		}
@@ -3199,53 +4782,518 @@ func (bc *BlockChain) GetTrustedDiffLayer(blockHash common.Hash) *types.DiffLaye
 	return diff
 }
 
-func CalculateDiffHash(d *types.DiffLayer) (common.Hash, error) {
-	if d == nil {
-		return common.Hash{}, errors.New("nil diff layer")
+// DiffLayerSize returns the size of the RLP encoding of the trusted diff layer
+// of the given block, i.e. the space it takes in the diff store. Persisted diff
+// layers are measured without decoding them. ErrDiffLayerNotFound is returned
+// if the diff layer is unknown.
+func (bc *BlockChain) DiffLayerSize(blockHash common.Hash) (int, error) {
+	if cached, ok := bc.diffLayerCache.Get(blockHash); ok {
+		enc, err := rlp.EncodeToBytes(cached.(*types.DiffLayer))
+		if err != nil {
+			return 0, err
+		}
+		return len(enc), nil
+	}
+	if diffStore := bc.db.DiffStore(); diffStore != nil {
+		if enc := rawdb.ReadDiffLayerRLP(diffStore, blockHash); len(enc) > 0 {
+			return len(enc), nil
+		}
 	}
+	return 0, fmt.Errorf("%w: %x", ErrDiffLayerNotFound, blockHash)
+}
 
-	diff := &types.ExtDiffLayer{
-		BlockHash: d.BlockHash,
-		Receipts:  make([]*types.ReceiptForStorage, 0),
-		Number:    d.Number,
-		Codes:     d.Codes,
-		Destructs: d.Destructs,
-		Accounts:  d.Accounts,
-		Storages:  d.Storages,
+// WaitDiffLayerReady waits until the diff layer of a just imported block is
+// cached, up to the given timeout, and returns it. Blocks whose diff layer is not
+// being cached are looked up immediately. ErrDiffLayerWaitTimeout is returned on
+// timeout and ErrDiffLayerNotFound if the diff layer is unknown, e.g. for empty
+// blocks or when it was evicted before being cached.
+func (bc *BlockChain) WaitDiffLayerReady(blockHash common.Hash, timeout time.Duration) (*types.DiffLayer, error) {
+	if cached, ok := bc.diffLayerChanCache.Get(blockHash); ok {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-cached.(chan struct{}):
+		case <-timer.C:
+			return nil, fmt.Errorf("%w: %x", ErrDiffLayerWaitTimeout, blockHash)
+		}
+	}
+	diff := bc.GetTrustedDiffLayer(blockHash)
+	if diff == nil {
+		return nil, fmt.Errorf("%w: %x", ErrDiffLayerNotFound, blockHash)
 	}
+	return diff, nil
+}
 
-	for index, account := range diff.Accounts {
-		full, err := types.FullAccount(account.Blob)
-		if err != nil {
-			return common.Hash{}, fmt.Errorf("decode full account error: %v", err)
+// ApplyDiffLayer imports the block following the current head by applying the
+// state changes of its diff layer, as produced by a trusted node, instead of
+// executing its transactions. The header and body are validated as usual, and
+// the resulting state root and receipts are checked against the header, but
+// the correctness of the state transition itself is taken on trust.
+//
+// It requires the chain to be created with EnableDiffFollower.
+func (bc *BlockChain) ApplyDiffLayer(block *types.Block, diffLayer *types.DiffLayer) error {
+	if !bc.diffFollower {
+		return errDiffFollowerDisabled
+	}
+	if !bc.lockChain() {
+		return errChainStopped
+	}
+	defer bc.unlockChain()
+
+	return bc.applyDiffLayer(block, diffLayer)
+}
+
+// InsertChainWithDiffLayers works like InsertChain, but imports the blocks by
+// applying their trusted diff layers instead of executing them, the same way as
+// ApplyDiffLayer does. Diff layers are matched to the blocks by hash. Blocks
+// without a diff layer, or whose diff layer can't be applied, e.g. because it
+// doesn't lead to the state root of the header, are executed instead.
+//
+// It requires the chain to be created with EnableDiffFollower.
+func (bc *BlockChain) InsertChainWithDiffLayers(chain types.Blocks, diffs []*types.DiffLayer) (int, error) {
+	if !bc.diffFollower {
+		return 0, errDiffFollowerDisabled
+	}
+	if len(chain) == 0 {
+		return 0, nil
+	}
+	if err := checkContiguous(chain); err != nil {
+		return 0, err
+	}
+	layers := make(map[common.Hash]*types.DiffLayer, len(diffs))
+	for _, diff := range diffs {
+		if diff != nil {
+			layers[diff.BlockHash] = diff
+		}
+	}
+	bc.blockProcFeed.Send(true)
+	defer bc.blockProcFeed.Send(false)
+
+	if !bc.lockChain() {
+		return 0, errChainStopped
+	}
+	defer bc.unlockChain()
+
+	for i, block := range chain {
+		if diff, ok := layers[block.Hash()]; ok {
+			err := bc.applyDiffLayer(block, diff)
+			if err == nil {
+				diffApplyMeter.Mark(1)
+				continue
+			}
+			log.Debug("Failed to apply diff layer, executing block", "number", block.Number(), "hash", block.Hash(), "err", err)
+		}
+		diffFallbackMeter.Mark(1)
+		if _, err := bc.insertChain(types.Blocks{block}, true); err != nil {
+			return i, err
 		}
-		// set account root to empty root
-		full.Root = types.EmptyRootHash
-		diff.Accounts[index].Blob = types.SlimAccountRLP(*full)
 	}
+	return len(chain), nil
+}
 
-	rawData, err := rlp.EncodeToBytes(diff)
+// applyDiffLayer is the internal implementation of ApplyDiffLayer. This function
+// expects the chain mutex to be held.
+func (bc *BlockChain) applyDiffLayer(block *types.Block, diffLayer *types.DiffLayer) error {
+	if diffLayer.BlockHash != block.Hash() || diffLayer.Number != block.NumberU64() {
+		return fmt.Errorf("%w: diff layer for #%d [%x..], block #%d [%x..]", errDiffLayerMismatch,
+			diffLayer.Number, diffLayer.BlockHash.Bytes()[:4], block.NumberU64(), block.Hash().Bytes()[:4])
+	}
+	head := bc.CurrentBlock()
+	if block.ParentHash() != head.Hash() {
+		return fmt.Errorf("block #%d [%x..] is not a child of the head #%d [%x..]",
+			block.NumberU64(), block.Hash().Bytes()[:4], head.Number, head.Hash().Bytes()[:4])
+	}
+	if err := bc.engine.VerifyHeader(bc, block.Header()); err != nil {
+		return err
+	}
+	if err := bc.Validator().ValidateBody(block); err != nil {
+		return err
+	}
+	// Validate the receipts against the header, they're stored as is
+	receipts := diffLayer.Receipts
+	var blobGasPrice *big.Int
+	if block.ExcessBlobGas() != nil {
+		blobGasPrice = eip4844.CalcBlobFee(*block.ExcessBlobGas())
+	}
+	if err := receipts.DeriveFields(bc.chainConfig, block.Hash(), block.NumberU64(), block.Time(), block.BaseFee(), blobGasPrice, block.Transactions()); err != nil {
+		return err
+	}
+	if rbloom := types.CreateBloom(receipts); rbloom != block.Bloom() {
+		return fmt.Errorf("invalid bloom (remote: %x  local: %x)", block.Bloom(), rbloom)
+	}
+	if receiptSha := types.DeriveSha(receipts, trie.NewStackTrie(nil)); receiptSha != block.ReceiptHash() {
+		return fmt.Errorf("invalid receipt root hash (remote: %x local: %x)", block.ReceiptHash(), receiptSha)
+	}
+	// Apply the state changes and ensure they lead to the expected root
+	root, nodes, err := applyDiffLayerToTries(bc.triedb, head.Root, diffLayer)
 	if err != nil {
-		return common.Hash{}, fmt.Errorf("encode new diff error: %v", err)
+		return err
+	}
+	if root != block.Root() {
+		return fmt.Errorf("invalid merkle root (remote: %x local: %x)", block.Root(), root)
+	}
+	if err := bc.triedb.Update(root, head.Root, block.NumberU64(), nodes, nil); err != nil {
+		return err
+	}
+	codeBatch := bc.db.NewBatch()
+	for _, code := range diffLayer.Codes {
+		rawdb.WriteCode(codeBatch, code.Hash, code.Code)
+	}
+	if err := codeBatch.Write(); err != nil {
+		return err
 	}
+	if snaps := bc.snaps.Load(); snaps != nil && root != head.Root {
+		destructs, accounts, storages := diffLayerToSnapshot(diffLayer)
+		if err := snaps.Update(root, head.Root, destructs, accounts, storages, nil); err != nil {
+			log.Warn("Failed to update snapshot tree", "from", head.Root, "to", root, "err", err)
+		}
+		if err := snaps.Cap(root, snaps.CapLimit()); err != nil {
+			log.Warn("Failed to cap snapshot tree", "root", root, "layers", snaps.CapLimit(), "err", err)
+		}
+	}
+	// Write the block with its metadata and make it the new head
+	ptd := bc.GetTd(block.ParentHash(), block.NumberU64()-1)
+	if ptd == nil {
+		return consensus.ErrUnknownAncestor
+	}
+	blockBatch := bc.db.BlockStore().NewBatch()
+	rawdb.WriteTd(blockBatch, block.Hash(), block.NumberU64(), new(big.Int).Add(block.Difficulty(), ptd))
+	rawdb.WriteBlock(blockBatch, block)
+	rawdb.WriteReceipts(blockBatch, block.Hash(), block.NumberU64(), receipts)
+	if bc.chainConfig.IsCancun(block.Number(), block.Time()) {
+		rawdb.WriteBlobSidecars(blockBatch, block.Hash(), block.NumberU64(), block.Sidecars())
+	}
+	if err := blockBatch.Write(); err != nil {
+		log.Crit("Failed to write block into disk", "err", err)
+	}
+	if err := bc.commitTrieDB(block); err != nil {
+		return err
+	}
+	if block.Header().TxHash != types.EmptyRootHash {
+		diffLayerCh := make(chan struct{})
+		bc.diffLayerChanCache.Add(diffLayer.BlockHash, diffLayerCh)
+		if bc.cacheConfig.SyncDiffPersistence {
+			bc.cacheDiffLayer(diffLayer, diffLayerCh)
+		} else {
+			go bc.cacheDiffLayer(diffLayer, diffLayerCh)
+		}
+	}
+	bc.writeHeadBlock(block)
+
+	var logs []*types.Log
+	for _, receipt := range receipts {
+		logs = append(logs, receipt.Logs...)
+	}
+	bc.chainFeed.Send(ChainEvent{Block: block, Hash: block.Hash(), Logs: logs})
+	if len(logs) > 0 {
+		bc.logsFeed.Send(logs)
+	}
+	bc.sendChainHeadEvent(ChainHeadEvent{Block: block})
+
+	log.Debug("Applied diff layer", "number", block.Number(), "hash", block.Hash(), "root", root,
+		"accounts", len(diffLayer.Accounts), "storages", len(diffLayer.Storages))
+	return nil
+}
 
-	hasher := sha3.NewLegacyKeccak256()
-	_, err = hasher.Write(rawData)
+// applyDiffLayerToTries applies the state changes of a diff layer on top of the
+// state of the parent root, returning the new state root and the dirty nodes.
+// The diff layer keys are hashed, so the raw tries are updated directly.
+func applyDiffLayerToTries(db *triedb.Database, parentRoot common.Hash, diffLayer *types.DiffLayer) (common.Hash, *trienode.MergedNodeSet, error) {
+	accTrie, err := trie.New(trie.StateTrieID(parentRoot), db)
 	if err != nil {
-		return common.Hash{}, fmt.Errorf("hasher write error: %v", err)
+		return common.Hash{}, nil, err
 	}
+	destructs, _, _ := diffLayerToSnapshot(diffLayer)
+	storages := make(map[common.Hash]types.DiffStorage, len(diffLayer.Storages))
+	for _, storage := range diffLayer.Storages {
+		storages[storage.Account] = storage
+	}
+	accounts := make(map[common.Hash]struct{}, len(diffLayer.Accounts))
+	for _, account := range diffLayer.Accounts {
+		accounts[account.Account] = struct{}{}
+	}
+	nodes := trienode.NewMergedNodeSet()
 
+	// Delete the destructed accounts which were not resurrected
+	for hash := range destructs {
+		if _, ok := accounts[hash]; ok {
+			continue
+		}
+		if err := accTrie.Delete(hash[:]); err != nil {
+			return common.Hash{}, nil, err
+		}
+	}
+	for _, diffAccount := range diffLayer.Accounts {
+		hash := diffAccount.Account
+		if len(diffAccount.Blob) == 0 {
+			if err := accTrie.Delete(hash[:]); err != nil {
+				return common.Hash{}, nil, err
+			}
+			continue
+		}
+		account, err := types.FullAccount(diffAccount.Blob)
+		if err != nil {
+			return common.Hash{}, nil, err
+		}
+		// Resolve the storage to update on, starting anew for resurrected accounts
+		storageRoot := types.EmptyRootHash
+		if _, destructed := destructs[hash]; !destructed {
+			blob, err := accTrie.Get(hash[:])
+			if err != nil {
+				return common.Hash{}, nil, err
+			}
+			if len(blob) > 0 {
+				var prev types.StateAccount
+				if err := rlp.DecodeBytes(blob, &prev); err != nil {
+					return common.Hash{}, nil, err
+				}
+				storageRoot = prev.Root
+			}
+		}
+		if storage, ok := storages[hash]; ok {
+			stTrie, err := trie.New(trie.StorageTrieID(parentRoot, hash, storageRoot), db)
+			if err != nil {
+				return common.Hash{}, nil, err
+			}
+			for i, key := range storage.Keys {
+				if len(storage.Vals[i]) == 0 {
+					err = stTrie.Delete(key[:])
+				} else {
+					err = stTrie.Update(key[:], storage.Vals[i])
+				}
+				if err != nil {
+					return common.Hash{}, nil, err
+				}
+			}
+			root, set, err := stTrie.Commit(false)
+			if err != nil {
+				return common.Hash{}, nil, err
+			}
+			if set != nil {
+				if err := nodes.Merge(set); err != nil {
+					return common.Hash{}, nil, err
+				}
+			}
+			storageRoot = root
+		}
+		if storageRoot != account.Root {
+			return common.Hash{}, nil, fmt.Errorf("storage root mismatch for account %x: have %x, want %x", hash, storageRoot, account.Root)
+		}
+		data, err := rlp.EncodeToBytes(account)
+		if err != nil {
+			return common.Hash{}, nil, err
+		}
+		if err := accTrie.Update(hash[:], data); err != nil {
+			return common.Hash{}, nil, err
+		}
+	}
+	root, set, err := accTrie.Commit(true)
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	if set != nil {
+		if err := nodes.Merge(set); err != nil {
+			return common.Hash{}, nil, err
+		}
+	}
+	return root, nodes, nil
+}
+
+// diffLayerToSnapshot converts the state changes of a diff layer to the format
+// expected by the snapshot tree.
+func diffLayerToSnapshot(diffLayer *types.DiffLayer) (map[common.Hash]struct{}, map[common.Hash][]byte, map[common.Hash]map[common.Hash][]byte) {
+	destructs := make(map[common.Hash]struct{}, len(diffLayer.Destructs))
+	for _, addr := range diffLayer.Destructs {
+		destructs[crypto.Keccak256Hash(addr[:])] = struct{}{}
+	}
+	accounts := make(map[common.Hash][]byte, len(diffLayer.Accounts))
+	for _, account := range diffLayer.Accounts {
+		accounts[account.Account] = account.Blob
+	}
+	storages := make(map[common.Hash]map[common.Hash][]byte, len(diffLayer.Storages))
+	for _, storage := range diffLayer.Storages {
+		slots := make(map[common.Hash][]byte, len(storage.Keys))
+		for i, key := range storage.Keys {
+			slots[key] = storage.Vals[i]
+		}
+		storages[storage.Account] = slots
+	}
+	return destructs, accounts, storages
+}
+
+// GetDiffAccountsForRange returns the accounts touched by the canonical blocks
+// in the range [from, to], mapping each account to the numbers of the blocks
+// which changed it. Self-destructed accounts are included too.
+//
+// Note, the map is keyed by the keccak256 hash of the account address, not by
+// the address itself, as that's how the diff layers track the accounts. Callers
+// looking for an address have to hash it with crypto.Keccak256Hash first.
+//
+// Every block in the range is resolved from the diff layer cache or the diff
+// store, which makes this a disk heavy operation for ranges that are no longer
+// cached, hence the range is capped to maxDiffAccountsRange blocks. The diff
+// layers of just imported blocks are waited for up to diffAccountsWaitTimeout
+// each, ErrDiffLayerWaitTimeout is returned if one is still not cached then.
+func (bc *BlockChain) GetDiffAccountsForRange(from, to uint64) (map[common.Hash][]uint64, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid range: from %d > to %d", from, to)
+	}
+	if to-from >= maxDiffAccountsRange {
+		return nil, fmt.Errorf("range too large: %d blocks, max %d", to-from+1, maxDiffAccountsRange)
+	}
+	accounts := make(map[common.Hash][]uint64)
+	for number := from; number <= to; number++ {
+		header := bc.GetHeaderByNumber(number)
+		if header == nil {
+			return nil, fmt.Errorf("block #%d not found", number)
+		}
+		// Empty blocks don't have a diff layer, nothing was touched
+		if header.TxHash == types.EmptyRootHash {
+			continue
+		}
+		// Wait for the diff layer if it's still being cached
+		diff, err := bc.WaitDiffLayerReady(header.Hash(), diffAccountsWaitTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("block #%d: %w", number, err)
+		}
+		for _, account := range diff.Accounts {
+			accounts[account.Account] = append(accounts[account.Account], number)
+		}
+		for _, addr := range diff.Destructs {
+			hash := crypto.Keccak256Hash(addr.Bytes())
+			if blocks := accounts[hash]; len(blocks) == 0 || blocks[len(blocks)-1] != number {
+				accounts[hash] = append(blocks, number)
+			}
+		}
+	}
+	return accounts, nil
+}
+
+// DiffHasher computes the hash of diff layers the same way as CalculateDiffHash,
+// but reuses the keccak state and the scratch buffers across calls to cut down
+// the allocations when hashing a large number of diff layers.
+type DiffHasher struct {
+	lock     sync.Mutex
+	sha      crypto.KeccakState
+	slim     types.SlimAccount
+	blobs    bytes.Buffer
+	offsets  []int
+	accounts []types.DiffAccount
+}
+
+// NewDiffHasher creates a diff layer hasher with empty scratch buffers.
+func NewDiffHasher() *DiffHasher {
+	return &DiffHasher{sha: crypto.NewKeccakState()}
+}
+
+// Hash returns the diff hash of the given diff layer. The account storage roots
+// are zeroed before encoding, the diff layer itself is left untouched. It is
+// safe to call Hash concurrently, the invocations are serialized.
+func (h *DiffHasher) Hash(d *types.DiffLayer) (common.Hash, error) {
+	if d == nil {
+		return common.Hash{}, errors.New("nil diff layer")
+	}
+	// Diff layers loaded from disk or received from peers are not guaranteed
+	// to be in the same order as the locally cached ones, sort them first.
+	d = sortedDiffLayer(d)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// Re-encode all the accounts into the shared blob buffer with an empty
+	// storage root, the slices are only taken after the buffer stopped growing.
+	h.blobs.Reset()
+	h.offsets = h.offsets[:0]
+	for _, account := range d.Accounts {
+		if err := rlp.DecodeBytes(account.Blob, &h.slim); err != nil {
+			return common.Hash{}, fmt.Errorf("decode full account error: %v", err)
+		}
+		// set account root to empty root
+		h.slim.Root = nil
+		if bytes.Equal(h.slim.CodeHash, types.EmptyCodeHash[:]) {
+			h.slim.CodeHash = nil
+		}
+		if err := rlp.Encode(&h.blobs, &h.slim); err != nil {
+			return common.Hash{}, fmt.Errorf("encode slim account error: %v", err)
+		}
+		h.offsets = append(h.offsets, h.blobs.Len())
+	}
+	h.accounts = h.accounts[:0]
+	blobs, start := h.blobs.Bytes(), 0
+	for index, account := range d.Accounts {
+		h.accounts = append(h.accounts, types.DiffAccount{
+			Account: account.Account,
+			Blob:    blobs[start:h.offsets[index]:h.offsets[index]],
+		})
+		start = h.offsets[index]
+	}
+	diff := &types.ExtDiffLayer{
+		BlockHash: d.BlockHash,
+		Receipts:  []*types.ReceiptForStorage{},
+		Number:    d.Number,
+		Codes:     d.Codes,
+		Destructs: d.Destructs,
+		Accounts:  h.accounts,
+		Storages:  d.Storages,
+	}
+	h.sha.Reset()
+	if err := rlp.Encode(h.sha, diff); err != nil {
+		return common.Hash{}, fmt.Errorf("encode new diff error: %v", err)
+	}
 	var hash common.Hash
-	hasher.Sum(hash[:0])
+	h.sha.Read(hash[:])
 	return hash, nil
 }
 
+// defaultDiffHasher is the shared hasher backing CalculateDiffHash.
+var defaultDiffHasher = NewDiffHasher()
+
+// CalculateDiffHash returns the hash of the diff layer with all the account
+// storage roots zeroed.
+func CalculateDiffHash(d *types.DiffLayer) (common.Hash, error) {
+	return defaultDiffHasher.Hash(d)
+}
+
 // SetBlockValidatorAndProcessorForTesting sets the current validator and processor.
 // This method can be used to force an invalid blockchain to be verified for tests.
 // This method is unsafe and should only be used before block import starts.
 func (bc *BlockChain) SetBlockValidatorAndProcessorForTesting(v Validator, p Processor) {
-	bc.validator = v
-	bc.processor = p
+	bc.validator.Store(&v)
+	bc.processor.Store(&p)
+}
+
+// SetValidator replaces the block validator at runtime, waiting for the block
+// import in progress to finish, and returns the previous validator. If the new
+// validator has no remote verify manager, the one of the previous validator
+// keeps receiving the verify responses, the ancestor verification is however
+// up to the new validator. Nothing is replaced and nil is returned if the chain
+// is already stopped.
+func (bc *BlockChain) SetValidator(v Validator) Validator {
+	if !bc.lockChain() {
+		return nil
+	}
+	defer bc.unlockChain()
+
+	prev := bc.Validator()
+	if manager := prev.RemoteVerifyManager(); manager != nil && v.RemoteVerifyManager() == nil {
+		v = &remoteVerifyValidator{Validator: v, manager: manager}
+	}
+	bc.validator.Store(&v)
+	return prev
+}
+
+// SetProcessor replaces the block processor at runtime, waiting for the block
+// import in progress to finish, and returns the previous processor. The caller
+// must ensure the new processor is compatible with the current chain config.
+// Nothing is replaced and nil is returned if the chain is already stopped.
+func (bc *BlockChain) SetProcessor(p Processor) Processor {
+	if !bc.lockChain() {
+		return nil
+	}
+	defer bc.unlockChain()
+
+	return *bc.processor.Swap(&p)
 }
 
 // SetTrieFlushInterval configures how often in-memory tries are persisted to disk.
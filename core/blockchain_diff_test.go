@@ -21,7 +21,9 @@
 package core
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"math/big"
 	"testing"
 	"time"
@@ -35,6 +37,9 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/holiman/uint256"
+	"golang.org/x/exp/slices"
 )
 
 var (
@@ -427,3 +432,730 @@ func TestGetRootByDiffHash(t *testing.T) {
 	testGetRootByDiffHash(t, chain1, chain2, 24, types.StatusBlockNewer)
 	testGetRootByDiffHash(t, chain1, chain2, 35, types.StatusBlockTooNew)
 }
+
+// newTestDiffLayer creates a diff layer with the given number of accounts and
+// storage slots per account, the account blobs carry a non-empty storage root.
+func newTestDiffLayer(accounts, slots int) *types.DiffLayer {
+	diff := &types.DiffLayer{
+		BlockHash: common.Hash{0x01},
+		Number:    1,
+	}
+	for i := 0; i < accounts; i++ {
+		account := common.BigToHash(big.NewInt(int64(i)))
+		diff.Accounts = append(diff.Accounts, types.DiffAccount{
+			Account: account,
+			Blob: types.SlimAccountRLP(types.StateAccount{
+				Nonce:    uint64(i),
+				Balance:  uint256.NewInt(uint64(i)),
+				Root:     crypto.Keccak256Hash(account[:]),
+				CodeHash: types.EmptyCodeHash[:],
+			}),
+		})
+		storage := types.DiffStorage{Account: account}
+		for j := 0; j < slots; j++ {
+			storage.Keys = append(storage.Keys, common.BigToHash(big.NewInt(int64(j))))
+			storage.Vals = append(storage.Vals, []byte{byte(j)})
+		}
+		diff.Storages = append(diff.Storages, storage)
+	}
+	return diff
+}
+
+func TestDiffHasher(t *testing.T) {
+	diff := newTestDiffLayer(16, 4)
+	blobs := make([][]byte, len(diff.Accounts))
+	for i, account := range diff.Accounts {
+		blobs[i] = common.CopyBytes(account.Blob)
+	}
+	hasher := NewDiffHasher()
+	want, err := hasher.Hash(diff)
+	if err != nil {
+		t.Fatalf("failed to compute diff hash: %v", err)
+	}
+	// The diff layer must be left untouched by the hasher
+	for i, account := range diff.Accounts {
+		if !bytes.Equal(account.Blob, blobs[i]) {
+			t.Fatalf("account %d blob modified: have %x, want %x", i, account.Blob, blobs[i])
+		}
+	}
+	// Reusing the hasher and the package-level wrapper must yield the same hash
+	for i := 0; i < 3; i++ {
+		if have, _ := hasher.Hash(diff); have != want {
+			t.Fatalf("reused hasher mismatch: have %x, want %x", have, want)
+		}
+	}
+	if have, _ := CalculateDiffHash(diff); have != want {
+		t.Fatalf("diff hash mismatch: have %x, want %x", have, want)
+	}
+	// Storage roots are excluded from the hash
+	other := newTestDiffLayer(16, 4)
+	for i, account := range other.Accounts {
+		full, _ := types.FullAccount(account.Blob)
+		full.Root = common.Hash{byte(i)}
+		other.Accounts[i].Blob = types.SlimAccountRLP(*full)
+	}
+	if have, _ := hasher.Hash(other); have != want {
+		t.Fatalf("storage root leaked into diff hash: have %x, want %x", have, want)
+	}
+}
+
+func BenchmarkDiffHash(b *testing.B) {
+	diff := newTestDiffLayer(512, 8)
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			NewDiffHasher().Hash(diff)
+		}
+	})
+	b.Run("reuse", func(b *testing.B) {
+		hasher := NewDiffHasher()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			hasher.Hash(diff)
+		}
+	})
+}
+
+// Tests that a diff layer loaded from disk in arbitrary order hashes the same
+// as the one sorted and cached during the block import.
+func TestDiffHashDeterministicOrder(t *testing.T) {
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Assemble a diff layer in reversed order, as a map iteration could do
+	unordered := newTestDiffLayer(8, 4)
+	for i := 0; i < 4; i++ {
+		unordered.Codes = append(unordered.Codes, types.DiffCode{Hash: common.Hash{byte(i)}, Code: []byte{byte(i)}})
+		unordered.Destructs = append(unordered.Destructs, common.Address{byte(i)})
+	}
+	slices.Reverse(unordered.Codes)
+	slices.Reverse(unordered.Destructs)
+	slices.Reverse(unordered.Accounts)
+	slices.Reverse(unordered.Storages)
+	for _, storage := range unordered.Storages {
+		slices.Reverse(storage.Keys)
+		slices.Reverse(storage.Vals)
+	}
+	// Round trip through the database encoding for the on-disk path
+	blob, err := rlp.EncodeToBytes(unordered)
+	if err != nil {
+		t.Fatalf("failed to encode diff layer: %v", err)
+	}
+	var stored types.DiffLayer
+	if err := rlp.DecodeBytes(blob, &stored); err != nil {
+		t.Fatalf("failed to decode diff layer: %v", err)
+	}
+	have, err := CalculateDiffHash(&stored)
+	if err != nil {
+		t.Fatalf("failed to compute diff hash: %v", err)
+	}
+	if stored.Accounts[0].Account != unordered.Accounts[0].Account {
+		t.Fatal("diff layer reordered by the hasher")
+	}
+	// Feed the same content through the import cache path
+	chain.cacheDiffLayer(unordered, make(chan struct{}))
+	cached := chain.GetTrustedDiffLayer(unordered.BlockHash)
+	if cached == nil {
+		t.Fatal("diff layer not cached")
+	}
+	want, err := CalculateDiffHash(cached)
+	if err != nil {
+		t.Fatalf("failed to compute diff hash: %v", err)
+	}
+	if have != want {
+		t.Fatalf("diff hash mismatch: on-disk %x, cached %x", have, want)
+	}
+}
+
+// Tests that blocks with empty body don't produce any diff layer.
+func TestEmptyBlockNoDiffLayer(t *testing.T) {
+	backend := newTestBackend(16, false)
+	defer backend.close()
+	chain := backend.chain
+
+	for number := uint64(1); number <= 16; number++ {
+		block := chain.GetBlockByNumber(number)
+		_, pending := chain.diffLayerChanCache.Get(block.Hash())
+		if block.Header().TxHash == types.EmptyRootHash {
+			if pending {
+				t.Fatalf("block #%d: diff layer queued for empty block", number)
+			}
+			if chain.GetTrustedDiffLayer(block.Hash()) != nil {
+				t.Fatalf("block #%d: diff layer cached for empty block", number)
+			}
+		} else if !pending {
+			t.Fatalf("block #%d: diff layer missing for non-empty block", number)
+		}
+	}
+}
+
+func TestDiffLayerCacheLimit(t *testing.T) {
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	for _, limit := range []int{0, 4} {
+		config := *defaultCacheConfig
+		config.DiffLayerCacheLimit = limit
+		chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create chain: %v", err)
+		}
+		want := limit
+		if want == 0 {
+			want = diffLayerCacheLimit
+		}
+		for i := 0; i < want+2; i++ {
+			diff := &types.DiffLayer{BlockHash: common.Hash{byte(i), byte(i >> 8)}, Number: uint64(i)}
+			chain.cacheDiffLayer(diff, make(chan struct{}))
+		}
+		if have := chain.diffLayerCache.Len(); have != want {
+			t.Errorf("limit %d: diff layer cache size mismatch: have %d, want %d", limit, have, want)
+		}
+		chain.Stop()
+	}
+}
+
+// Tests that caching diff layers doesn't block when the persistence queue isn't
+// drained, the excess layers are dropped instead.
+func TestDiffQueueBufferFull(t *testing.T) {
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	db := rawdb.NewMemoryDatabase()
+	db.SetDiffStore(memorydb.New())
+
+	config := *defaultCacheConfig
+	config.DiffQueueBufferSize = 4
+	chain, err := NewBlockChain(db, &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	// Stop the chain to tear down the queue consumer, simulating a stalled one
+	chain.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*config.DiffQueueBufferSize; i++ {
+			diff := &types.DiffLayer{BlockHash: common.Hash{byte(i)}, Number: uint64(i)}
+			chain.cacheDiffLayer(diff, make(chan struct{}))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("diff layer caching blocked on a full queue")
+	}
+	if have := len(chain.diffQueueBuffer); have != config.DiffQueueBufferSize {
+		t.Errorf("queued diff layers mismatch: have %d, want %d", have, config.DiffQueueBufferSize)
+	}
+	// The dropped layers must still be served from memory
+	if have := chain.diffLayerCache.Len(); have != 2*config.DiffQueueBufferSize {
+		t.Errorf("cached diff layers mismatch: have %d, want %d", have, 2*config.DiffQueueBufferSize)
+	}
+}
+
+// Tests that difflayer channels evicted before their diff layer is cached are
+// closed, releasing the waiters.
+func TestDiffLayerChanEviction(t *testing.T) {
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	config := *defaultCacheConfig
+	config.DiffLayerCacheLimit = 2
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	hashes := []common.Hash{{0x01}, {0x02}, {0x03}}
+	chain.diffLayerChanCache.Add(hashes[0], make(chan struct{}))
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := chain.WaitDiffLayerReady(hashes[0], time.Minute)
+		errc <- err
+	}()
+	// Give the waiter time to pick up the channel, then evict it
+	time.Sleep(50 * time.Millisecond)
+	chain.diffLayerChanCache.Add(hashes[1], make(chan struct{}))
+	chain.diffLayerChanCache.Add(hashes[2], make(chan struct{}))
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrDiffLayerNotFound) {
+			t.Fatalf("evicted diff layer error mismatch: have %v, want %v", err, ErrDiffLayerNotFound)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter not released by eviction")
+	}
+	// Pending diff layers should time out instead
+	if _, err := chain.WaitDiffLayerReady(hashes[2], 10*time.Millisecond); !errors.Is(err, ErrDiffLayerWaitTimeout) {
+		t.Fatalf("pending diff layer error mismatch: have %v, want %v", err, ErrDiffLayerWaitTimeout)
+	}
+	// Caching a diff layer must close its channel only once
+	diff := &types.DiffLayer{BlockHash: hashes[2], Number: 3}
+	cached, _ := chain.diffLayerChanCache.Get(hashes[2])
+	chain.cacheDiffLayer(diff, cached.(chan struct{}))
+	chain.diffLayerChanCache.Remove(hashes[2])
+
+	if have, err := chain.WaitDiffLayerReady(hashes[2], time.Second); err != nil || have != diff {
+		t.Fatalf("cached diff layer mismatch: have %v, %v", have, err)
+	}
+}
+
+func TestGetDiffAccountsForRange(t *testing.T) {
+	backend := newTestBackend(16, false)
+	defer backend.close()
+	chain := backend.chain
+
+	accounts, err := chain.GetDiffAccountsForRange(1, 16)
+	if err != nil {
+		t.Fatalf("failed to get diff accounts: %v", err)
+	}
+	var want []uint64
+	for number := uint64(1); number <= 16; number++ {
+		if chain.GetHeaderByNumber(number).TxHash != types.EmptyRootHash {
+			want = append(want, number)
+		}
+	}
+	// The tester is the coinbase of every block, so it's touched by all of them
+	have := accounts[crypto.Keccak256Hash(testAddr.Bytes())]
+	if !slices.Equal(have, want) {
+		t.Fatalf("touched blocks mismatch: have %v, want %v", have, want)
+	}
+	if _, err := chain.GetDiffAccountsForRange(2, 1); err == nil {
+		t.Fatal("inverted range accepted")
+	}
+	if _, err := chain.GetDiffAccountsForRange(0, maxDiffAccountsRange); err == nil {
+		t.Fatal("oversized range accepted")
+	}
+	// Drop a diff layer and ensure it's reported
+	hash := chain.GetHeaderByNumber(1).Hash()
+	chain.diffLayerCache.Remove(hash)
+	chain.diffLayerChanCache.Remove(hash)
+	rawdb.DeleteDiffLayer(chain.db.DiffStore(), hash)
+	if _, err := chain.GetDiffAccountsForRange(1, 16); !errors.Is(err, ErrDiffLayerNotFound) {
+		t.Fatalf("missing diff layer not reported: %v", err)
+	}
+}
+
+// Tests that a follower chain can import blocks by applying the diff layers of
+// a leader chain, ending up with the same state.
+func TestApplyDiffLayer(t *testing.T) {
+	leader := newTestBackend(14, false)
+	defer leader.close()
+
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		Alloc:   GenesisAlloc{testAddr: {Balance: big.NewInt(100000000000000000)}},
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	follower, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnableDiffFollower)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer follower.Stop()
+
+	diffLayer := func(block *types.Block) *types.DiffLayer {
+		return relayDiffLayer(t, leader.chain, block)
+	}
+	// A tampered diff layer must be rejected without changing the head
+	block := leader.chain.GetBlockByNumber(1)
+	tampered := diffLayer(block)
+	tampered.Accounts = tampered.Accounts[:len(tampered.Accounts)-1]
+	if err := follower.ApplyDiffLayer(block, tampered); err == nil {
+		t.Fatal("tampered diff layer accepted")
+	}
+	if head := follower.CurrentBlock().Number.Uint64(); head != 0 {
+		t.Fatalf("head changed by tampered diff layer: #%d", head)
+	}
+	for number := uint64(1); number <= 14; number++ {
+		block := leader.chain.GetBlockByNumber(number)
+		if err := follower.ApplyDiffLayer(block, diffLayer(block)); err != nil {
+			t.Fatalf("block #%d: failed to apply diff layer: %v", number, err)
+		}
+	}
+	if have, want := follower.CurrentBlock().Hash(), leader.chain.CurrentBlock().Hash(); have != want {
+		t.Fatalf("head mismatch: have %x, want %x", have, want)
+	}
+	statedb, err := follower.State()
+	if err != nil {
+		t.Fatalf("failed to open follower state: %v", err)
+	}
+	want, _ := leader.chain.State()
+	if have, want := statedb.GetBalance(testAddr), want.GetBalance(testAddr); have.Cmp(want) != 0 {
+		t.Fatalf("balance mismatch: have %v, want %v", have, want)
+	}
+	if have, want := rawdb.ReadReceipts(follower.db, block.Hash(), 1, block.Time(), follower.Config()), leader.chain.GetReceiptsByHash(block.Hash()); len(have) != len(want) {
+		t.Fatalf("receipt count mismatch: have %d, want %d", len(have), len(want))
+	}
+	// Diff follower mode must be explicitly enabled
+	plain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer plain.Stop()
+
+	if err := plain.ApplyDiffLayer(block, diffLayer(block)); !errors.Is(err, errDiffFollowerDisabled) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errDiffFollowerDisabled)
+	}
+}
+
+// relayDiffLayer retrieves a copy of the diff layer of a block, as if relayed by
+// the given chain.
+func relayDiffLayer(t *testing.T, chain *BlockChain, block *types.Block) *types.DiffLayer {
+	t.Helper()
+
+	diff, err := chain.WaitDiffLayerReady(block.Hash(), time.Second)
+	if err != nil {
+		t.Fatalf("block #%d: failed to retrieve diff layer: %v", block.NumberU64(), err)
+	}
+	blob, err := rlp.EncodeToBytes(diff)
+	if err != nil {
+		t.Fatalf("block #%d: failed to encode diff layer: %v", block.NumberU64(), err)
+	}
+	copied := new(types.DiffLayer)
+	if err := rlp.DecodeBytes(blob, copied); err != nil {
+		t.Fatalf("block #%d: failed to decode diff layer: %v", block.NumberU64(), err)
+	}
+	return copied
+}
+
+// Tests that a follower chain can import a batch of blocks along with their diff
+// layers, executing the blocks whose diff layers are missing or don't lead to
+// the state root of the header.
+func TestInsertChainWithDiffLayers(t *testing.T) {
+	leader := newTestBackend(14, false)
+	defer leader.close()
+
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		Alloc:   GenesisAlloc{testAddr: {Balance: big.NewInt(100000000000000000)}},
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	follower, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnableDiffFollower)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer follower.Stop()
+
+	var (
+		blocks types.Blocks
+		diffs  []*types.DiffLayer
+	)
+	for number := uint64(1); number <= 14; number++ {
+		block := leader.chain.GetBlockByNumber(number)
+		blocks = append(blocks, block)
+		diffs = append(diffs, relayDiffLayer(t, leader.chain, block))
+	}
+	// Credit the coinbase more than it earned
+	addrHash := crypto.Keccak256Hash(testAddr.Bytes())
+	for i, account := range diffs[1].Accounts {
+		if account.Account != addrHash {
+			continue
+		}
+		full, err := types.FullAccount(account.Blob)
+		if err != nil {
+			t.Fatalf("failed to decode account: %v", err)
+		}
+		full.Balance.AddUint64(full.Balance, 1)
+		diffs[1].Accounts[i].Blob = types.SlimAccountRLP(*full)
+	}
+	// Drop a diff layer and an account change
+	diffs[3] = nil
+	diffs[5].Accounts = diffs[5].Accounts[:len(diffs[5].Accounts)-1]
+
+	// Change a storage slot without its storage root
+	if len(diffs[12].Storages) == 0 {
+		t.Fatal("no storage changes in block #13")
+	}
+	slot, _ := rlp.EncodeToBytes(bytes.Repeat([]byte{0xff}, 32))
+	diffs[12].Storages[0].Vals[0] = slot
+
+	// Relabel a diff layer to another block
+	diffs[7].BlockHash = blocks[8].Hash()
+	diffs[8] = nil
+
+	if n, err := follower.InsertChainWithDiffLayers(blocks, diffs); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if have, want := follower.CurrentBlock().Hash(), leader.chain.CurrentBlock().Hash(); have != want {
+		t.Fatalf("head mismatch: have %x, want %x", have, want)
+	}
+	for _, block := range blocks {
+		if !follower.HasState(block.Root()) {
+			t.Fatalf("block #%d: state missing", block.NumberU64())
+		}
+	}
+	// The diff layers of the executed blocks must be rebuilt instead of trusted
+	for _, i := range []int{1, 3, 5, 7, 8, 12} {
+		block := blocks[i]
+		have, err := CalculateDiffHash(relayDiffLayer(t, follower, block))
+		if err != nil {
+			t.Fatalf("block #%d: failed to hash diff layer: %v", block.NumberU64(), err)
+		}
+		want, err := CalculateDiffHash(relayDiffLayer(t, leader.chain, block))
+		if err != nil {
+			t.Fatalf("block #%d: failed to hash diff layer: %v", block.NumberU64(), err)
+		}
+		if have != want {
+			t.Fatalf("block #%d: diff layer mismatch: have %x, want %x", block.NumberU64(), have, want)
+		}
+	}
+	// Diff follower mode must be explicitly enabled
+	plain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer plain.Stop()
+
+	if _, err := plain.InsertChainWithDiffLayers(blocks, diffs); !errors.Is(err, errDiffFollowerDisabled) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errDiffFollowerDisabled)
+	}
+}
+
+// Tests that the most recent diff layers stay cached after being persisted to
+// the diff store, while the older ones are released.
+func TestResidentDiffLayers(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	db.SetDiffStore(memorydb.New())
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		Alloc:   GenesisAlloc{testAddr: {Balance: big.NewInt(100000000000000000)}},
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	config := *defaultCacheConfig
+	config.ResidentDiffLayers = 160
+	chain, err := NewBlockChain(db, &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnablePersistDiff(860000))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	signer := types.HomesteadSigner{}
+	bs, _ := GenerateChain(params.TestChainConfig, chain.Genesis(), ethash.NewFaker(), db, 256, func(i int, block *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testAddr), common.Address{0x1}, big.NewInt(1), params.TxGas, block.BaseFee(), nil), signer, testKey)
+		block.AddTx(tx)
+	})
+	if _, err := chain.InsertChain(bs); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	waitDifflayerCached(chain, bs)
+	for len(chain.diffQueueBuffer) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(diffLayerFreezerRecheckInterval + 2*time.Second)
+
+	// Block 120 is persisted but within the resident window of the head
+	recent := bs[119].Hash()
+	if len(rawdb.ReadDiffLayerRLP(db.DiffStore(), recent)) == 0 {
+		t.Fatal("recent diff layer not persisted")
+	}
+	if !chain.diffLayerCache.Contains(recent) {
+		t.Error("recent diff layer not kept in cache after persistence")
+	}
+	// Block 50 is persisted and outside of the resident window
+	stale := bs[49].Hash()
+	if len(rawdb.ReadDiffLayerRLP(db.DiffStore(), stale)) == 0 {
+		t.Fatal("stale diff layer not persisted")
+	}
+	if chain.diffLayerCache.Contains(stale) {
+		t.Error("stale diff layer still cached after persistence")
+	}
+}
+
+func TestSyncDiffPersistence(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	db.SetDiffStore(memorydb.New())
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		Alloc:   GenesisAlloc{testAddr: {Balance: big.NewInt(100000000000000000)}},
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	config := *defaultCacheConfig
+	config.SyncDiffPersistence = true
+	chain, err := NewBlockChain(db, &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnablePersistDiff(860000))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	signer := types.HomesteadSigner{}
+	bs, _ := GenerateChain(params.TestChainConfig, chain.Genesis(), ethash.NewFaker(), db, 8, func(i int, block *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testAddr), common.Address{0x1}, big.NewInt(1), params.TxGas, block.BaseFee(), nil), signer, testKey)
+		block.AddTx(tx)
+	})
+	if _, err := chain.InsertChain(bs); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// The diff layers must be cached as soon as the import returns
+	for _, block := range bs {
+		if !chain.diffLayerCache.Contains(block.Hash()) {
+			t.Fatalf("block #%d: diff layer not cached", block.NumberU64())
+		}
+		cached, ok := chain.diffLayerChanCache.Get(block.Hash())
+		if !ok {
+			t.Fatalf("block #%d: diff layer channel missing", block.NumberU64())
+		}
+		select {
+		case <-cached.(chan struct{}):
+		default:
+			t.Fatalf("block #%d: diff layer channel not closed", block.NumberU64())
+		}
+	}
+}
+
+func TestMaxDiffForkDist(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 30, func(i int, b *BlockGen) {})
+
+	for _, test := range []struct {
+		dist         uint64
+		older, newer types.VerifyStatus
+	}{
+		{0, types.StatusImpossibleFork, types.StatusBlockTooNew}, // default distance
+		{20, types.StatusPossibleFork, types.StatusBlockNewer},
+	} {
+		config := *defaultCacheConfig
+		config.MaxDiffForkDist = test.dist
+		chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create chain: %v", err)
+		}
+		if _, err := chain.InsertChain(blocks); err != nil {
+			t.Fatalf("failed to insert chain: %v", err)
+		}
+		// Unknown blocks 15 below and above the head
+		if res := chain.GetVerifyResult(15, common.Hash{0x1}, common.Hash{}); res.Status != test.older {
+			t.Errorf("distance %d: old block status mismatch: have %v, want %v", test.dist, res.Status, test.older)
+		}
+		if res := chain.GetVerifyResult(45, common.Hash{0x1}, common.Hash{}); res.Status != test.newer {
+			t.Errorf("distance %d: new block status mismatch: have %v, want %v", test.dist, res.Status, test.newer)
+		}
+		chain.Stop()
+	}
+}
+
+func TestDiffLayerSize(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	db.SetDiffStore(memorydb.New())
+	gspec := &Genesis{
+		Config:  params.TestChainConfig,
+		Alloc:   GenesisAlloc{testAddr: {Balance: big.NewInt(100000000000000000)}},
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	config := *defaultCacheConfig
+	config.SyncDiffPersistence = true
+	chain, err := NewBlockChain(db, &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnablePersistDiff(860000))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	signer := types.HomesteadSigner{}
+	bs, _ := GenerateChain(params.TestChainConfig, chain.Genesis(), ethash.NewFaker(), db, 2, func(i int, block *BlockGen) {
+		if i == 0 {
+			tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testAddr), common.Address{0x1}, big.NewInt(1), params.TxGas, block.BaseFee(), nil), signer, testKey)
+			block.AddTx(tx)
+		}
+	})
+	if _, err := chain.InsertChain(bs); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// Cached diff layers are measured by encoding them
+	enc, err := rlp.EncodeToBytes(chain.GetTrustedDiffLayer(bs[0].Hash()))
+	if err != nil {
+		t.Fatalf("failed to encode diff layer: %v", err)
+	}
+	if size, err := chain.DiffLayerSize(bs[0].Hash()); err != nil || size != len(enc) {
+		t.Fatalf("cached diff layer size mismatch: have %d (%v), want %d", size, err, len(enc))
+	}
+	// Persisted diff layers are measured as stored
+	persisted := common.Hash{0x1}
+	rawdb.WriteDiffLayerRLP(db.DiffStore(), persisted, enc)
+	if size, err := chain.DiffLayerSize(persisted); err != nil || size != len(enc) {
+		t.Fatalf("persisted diff layer size mismatch: have %d (%v), want %d", size, err, len(enc))
+	}
+	// Empty blocks have no diff layer
+	if _, err := chain.DiffLayerSize(bs[1].Hash()); !errors.Is(err, ErrDiffLayerNotFound) {
+		t.Fatalf("empty block error mismatch: have %v, want %v", err, ErrDiffLayerNotFound)
+	}
+}
+
+// Tests that the logs of reorged blocks are still collected from their diff
+// layers if their receipts were pruned from the database.
+func TestCollectLogsFromDiffLayer(t *testing.T) {
+	var (
+		// this code generates a log
+		code   = common.Hex2Bytes("60606040525b7f24ec1d3ff24c2f6ff210738839dbc339cd45a5294d85c79361016243157aae7b60405180905060405180910390a15b600a8060416000396000f360606040526008565b00")
+		gspec  = &Genesis{Config: params.TestChainConfig, Alloc: GenesisAlloc{testAddr: {Balance: big.NewInt(10000000000000000)}}}
+		signer = types.LatestSigner(gspec.Config)
+		db     = rawdb.NewMemoryDatabase()
+	)
+	db.SetDiffStore(memorydb.New())
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.SyncDiffPersistence = true
+	chain, err := NewBlockChain(db, config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnablePersistDiff(860000))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	rmLogsCh := make(chan RemovedLogsEvent, 1)
+	sub := chain.SubscribeRemovedLogsEvent(rmLogsCh)
+	defer sub.Unsubscribe()
+
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 2, func(i int, gen *BlockGen) {
+		if i == 1 {
+			tx, err := types.SignTx(types.NewContractCreation(gen.TxNonce(testAddr), new(big.Int), 1000000, gen.header.BaseFee, code), signer, testKey)
+			if err != nil {
+				t.Fatalf("failed to create tx: %v", err)
+			}
+			gen.AddTx(tx)
+		}
+	})
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// Prune the receipts, keeping the diff layer only
+	block := blocks[1]
+	if diff := chain.GetTrustedDiffLayer(block.Hash()); diff == nil || len(diff.Receipts) != 1 {
+		t.Fatal("diff layer receipts missing")
+	}
+	rawdb.DeleteReceipts(chain.db.BlockStore(), block.Hash(), block.NumberU64())
+	if receipts := rawdb.ReadRawReceipts(chain.db, block.Hash(), block.NumberU64()); receipts != nil {
+		t.Fatal("receipts not pruned")
+	}
+	_, fork, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, gen *BlockGen) {})
+	if _, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert forked chain: %v", err)
+	}
+	select {
+	case ev := <-rmLogsCh:
+		if len(ev.Logs) != 1 {
+			t.Fatalf("removed log count mismatch: have %d, want 1", len(ev.Logs))
+		}
+		if l := ev.Logs[0]; !l.Removed || l.BlockHash != block.Hash() {
+			t.Fatalf("removed log mismatch: %+v", l)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no removed logs event sent")
+	}
+	// The diff layer itself must be left untouched
+	if diff := chain.GetTrustedDiffLayer(block.Hash()); diff.Receipts[0].Logs[0].Removed {
+		t.Fatal("diff layer logs modified")
+	}
+}
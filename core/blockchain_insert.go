@@ -17,6 +17,7 @@
 package core
 
 import (
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -31,6 +32,86 @@ type insertStats struct {
 	usedGas                    uint64
 	lastIndex                  int
 	startTime                  mclock.AbsTime
+
+	totals InsertStatsSnapshot // Counters of the already reported sections
+}
+
+// InsertStatsSnapshot is an aggregate view of the block imports done by the
+// chain since startup.
+type InsertStatsSnapshot struct {
+	Processed     uint64        // Number of blocks processed
+	Queued        uint64        // Number of blocks queued as future blocks
+	Ignored       uint64        // Number of blocks ignored
+	UsedGas       uint64        // Total gas used by the processed blocks
+	InsertTime    time.Duration // Total time spent in chain insertions
+	AvgInsertTime time.Duration // Average insertion time per processed block
+}
+
+// total returns the counters accumulated over all the sections of the insertion,
+// including the one not reported yet.
+func (st *insertStats) total() InsertStatsSnapshot {
+	totals := st.totals
+	totals.Processed += uint64(st.processed)
+	totals.Queued += uint64(st.queued)
+	totals.Ignored += uint64(st.ignored)
+	totals.UsedGas += st.usedGas
+	return totals
+}
+
+// gasWindow is a rolling window of the gas used and the processing time of the
+// most recently imported blocks.
+type gasWindow struct {
+	gas     []uint64
+	elapsed []time.Duration
+	next    int  // Index of the slot to overwrite next
+	full    bool // Whether the window wrapped around already
+	lock    sync.Mutex
+}
+
+func newGasWindow(size int) *gasWindow {
+	return &gasWindow{
+		gas:     make([]uint64, size),
+		elapsed: make([]time.Duration, size),
+	}
+}
+
+// add records the gas used by an imported block and its processing time.
+func (w *gasWindow) add(gas uint64, elapsed time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.gas[w.next], w.elapsed[w.next] = gas, elapsed
+	if w.next++; w.next == len(w.gas) {
+		w.next, w.full = 0, true
+	}
+}
+
+// throughput returns the average gas used per block and per second of block
+// processing over the window.
+func (w *gasWindow) throughput() (float64, float64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	count := w.next
+	if w.full {
+		count = len(w.gas)
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	var (
+		gas     uint64
+		elapsed time.Duration
+	)
+	for i := 0; i < count; i++ {
+		gas += w.gas[i]
+		elapsed += w.elapsed[i]
+	}
+	perBlock := float64(gas) / float64(count)
+	if elapsed <= 0 {
+		return perBlock, 0
+	}
+	return perBlock, float64(gas) / elapsed.Seconds()
 }
 
 // statsReportLimit is the time limit during import and export after which we
@@ -92,7 +173,7 @@ func (st *insertStats) report(chain []*types.Block, index int, snapDiffItems, sn
 			log.Info("Imported new potential chain segment", context...)
 		}
 		// Bump the stats reported to the next section
-		*st = insertStats{startTime: now, lastIndex: index + 1}
+		*st = insertStats{startTime: now, lastIndex: index + 1, totals: st.total()}
 	}
 }
 
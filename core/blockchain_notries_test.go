@@ -157,12 +157,12 @@ func makeTestBackendWithRemoteValidator(blocks int, mode VerifyMode, failed *ver
 		}
 	}
 	peer.setCallBack(func(req *requestRoot) {
-		if fastnode.validator != nil && fastnode.validator.RemoteVerifyManager() != nil {
+		if fastnode.Validator().RemoteVerifyManager() != nil {
 			resp := verifier.GetVerifyResult(req.blockNumber, req.blockHash, req.diffHash)
 			if failed != nil && req.blockNumber == failed.blockNumber {
 				resp.Status = failed.status
 			}
-			fastnode.validator.RemoteVerifyManager().
+			fastnode.Validator().RemoteVerifyManager().
 				HandleRootResponse(
 					resp, peer.ID())
 		}
@@ -224,3 +224,48 @@ func TestFastNode(t *testing.T) {
 		t.Fatalf("blocks insert should be failed at height %d", failed.blockNumber+11)
 	}
 }
+
+func TestSampledRemoteVerify(t *testing.T) {
+	genDb, gspec, chain, err := newCanonical(ethash.NewFaker(), 5, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// The sampling rate must be honored approximately
+	manager := &remoteVerifyManager{bc: chain}
+	for _, fraction := range []float64{0, 0.1, 0.5, 1} {
+		chain.remoteVerifyFraction = fraction
+
+		sampled := 0
+		for i := 0; i < 10000; i++ {
+			if manager.sampled() {
+				sampled++
+			}
+		}
+		want := 10000 * fraction
+		if fraction == 0 {
+			want = 10000
+		}
+		if diff := float64(sampled) - want; diff < -500 || diff > 500 {
+			t.Fatalf("fraction %v: sampled %d blocks, want about %v", fraction, sampled, want)
+		}
+	}
+	// Blocks with competing siblings must be flagged
+	side := makeBlockChain(chain.chainConfig, chain.GetBlockByNumber(2), 1, ethash.NewFaker(), genDb, forkSeed1)
+	if _, err := chain.InsertChain(side); err != nil {
+		t.Fatalf("failed to insert side block: %v", err)
+	}
+	if !manager.suspicious(chain.GetHeaderByNumber(3)) {
+		t.Fatal("block with a sibling not flagged")
+	}
+	if manager.suspicious(chain.GetHeaderByNumber(4)) {
+		t.Fatal("block without siblings flagged")
+	}
+	// Only proper fractions are accepted
+	for _, fraction := range []float64{-0.5, 0, 1.5} {
+		if _, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnableSampledRemoteVerify(fraction)); err == nil {
+			t.Fatalf("fraction %v accepted", fraction)
+		}
+	}
+}
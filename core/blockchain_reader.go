@@ -18,15 +18,22 @@ package core
 
 import (
 	"errors"
+	"fmt"
 	"math/big"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/misc/eip4844"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/triedb"
@@ -80,6 +87,43 @@ func (bc *BlockChain) CurrentSafeBlock() *types.Header {
 	return nil
 }
 
+// SafePointBlockNumber retrieves the number of the last block whose state is
+// known to be persisted to disk, i.e. the block the chain would need to resume
+// executing from after a crash. Zero is returned if no safe point was recorded.
+func (bc *BlockChain) SafePointBlockNumber() uint64 {
+	return rawdb.ReadSafePointBlockNumber(bc.db)
+}
+
+// HeadMarker is a single chain head marker along with its total difficulty.
+type HeadMarker struct {
+	Number uint64
+	Hash   common.Hash
+	Td     *big.Int
+}
+
+// HeadStatus is a summary of the local chain head markers, the same data that
+// is reported in the logs when the chain is loaded on startup.
+type HeadStatus struct {
+	Header    HeadMarker // Current head header
+	Block     HeadMarker // Current head block (full)
+	SnapBlock HeadMarker // Current head snap-sync block
+	Pivot     *uint64    // Last snap-sync pivot marker, nil if none
+}
+
+// HeadStatus returns a summary of the current chain head markers.
+func (bc *BlockChain) HeadStatus() HeadStatus {
+	marker := func(header *types.Header) HeadMarker {
+		number, hash := header.Number.Uint64(), header.Hash()
+		return HeadMarker{Number: number, Hash: hash, Td: bc.GetTd(hash, number)}
+	}
+	return HeadStatus{
+		Header:    marker(bc.CurrentHeader()),
+		Block:     marker(bc.CurrentBlock()),
+		SnapBlock: marker(bc.CurrentSnapBlock()),
+		Pivot:     rawdb.ReadLastPivotNumber(bc.db),
+	}
+}
+
 // HasHeader checks if a block header is present in the database or not, caching
 // it if present.
 func (bc *BlockChain) HasHeader(hash common.Hash, number uint64) bool {
@@ -98,6 +142,19 @@ func (bc *BlockChain) GetHeaderByHash(hash common.Hash) *types.Header {
 	return bc.hc.GetHeaderByHash(hash)
 }
 
+// GetHeadersByHashes retrieves the block headers with the given hashes, in the
+// same order, with nil entries for the unknown ones.
+func (bc *BlockChain) GetHeadersByHashes(hashes []common.Hash) []*types.Header {
+	return bc.hc.GetHeadersByHashes(hashes)
+}
+
+// GetBlockNumber retrieves the block number belonging to the given hash from the
+// cache or database, without loading the header. Nil is returned for unknown
+// hashes.
+func (bc *BlockChain) GetBlockNumber(hash common.Hash) *uint64 {
+	return bc.hc.GetBlockNumber(hash)
+}
+
 // GetHeaderByNumber retrieves a block header from the database by number,
 // caching it (associated with its hash) if found.
 func (bc *BlockChain) GetHeaderByNumber(number uint64) *types.Header {
@@ -110,6 +167,88 @@ func (bc *BlockChain) GetHeadersFrom(number, count uint64) []rlp.RawValue {
 	return bc.hc.GetHeadersFrom(number, count)
 }
 
+// GetCommonAncestor returns the first block shared by the chains of the two given
+// blocks, walking back the higher one to the height of the other first, the same
+// way reorg does. An error is returned if either block is unknown or the chains
+// don't converge within maxCommonAncestorDepth blocks.
+func (bc *BlockChain) GetCommonAncestor(a, b common.Hash) (*types.Block, error) {
+	ha := bc.GetHeaderByHash(a)
+	if ha == nil {
+		return nil, fmt.Errorf("unknown block %x", a)
+	}
+	hb := bc.GetHeaderByHash(b)
+	if hb == nil {
+		return nil, fmt.Errorf("unknown block %x", b)
+	}
+	for depth := 0; ha.Hash() != hb.Hash(); depth++ {
+		na, nb := ha.Number.Uint64(), hb.Number.Uint64()
+		if depth >= maxCommonAncestorDepth || (na == 0 && nb == 0) {
+			return nil, fmt.Errorf("no common ancestor of %x and %x within %d blocks", a, b, maxCommonAncestorDepth)
+		}
+		if na >= nb {
+			if ha = bc.GetHeader(ha.ParentHash, na-1); ha == nil {
+				return nil, fmt.Errorf("missing ancestor #%d of %x", na-1, a)
+			}
+		}
+		if nb >= na {
+			if hb = bc.GetHeader(hb.ParentHash, nb-1); hb == nil {
+				return nil, fmt.Errorf("missing ancestor #%d of %x", nb-1, b)
+			}
+		}
+	}
+	block := bc.GetBlock(ha.Hash(), ha.Number.Uint64())
+	if block == nil {
+		return nil, fmt.Errorf("missing body of common ancestor #%d [%x]", ha.Number, ha.Hash())
+	}
+	return block, nil
+}
+
+// GetHeaderSegment retrieves up to amount headers starting at the given hash,
+// skipping skip headers between each, towards the genesis if reverse is set or
+// towards the head otherwise. The forward traversal only follows the canonical
+// chain. The segment ends early if it reaches either end of the chain.
+func (bc *BlockChain) GetHeaderSegment(from common.Hash, amount, skip int, reverse bool) []*types.Header {
+	if amount <= 0 || skip < 0 {
+		return nil
+	}
+	origin := bc.GetHeaderByHash(from)
+	if origin == nil {
+		return nil
+	}
+	var (
+		headers         = []*types.Header{origin}
+		step            = uint64(skip) + 1
+		maxNonCanonical = uint64(100)
+	)
+	for len(headers) < amount {
+		hash, number := origin.Hash(), origin.Number.Uint64()
+		if reverse {
+			if number < step {
+				break
+			}
+			ancestor, ancestorNumber := bc.GetAncestor(hash, number, step, &maxNonCanonical)
+			if ancestor == (common.Hash{}) {
+				break
+			}
+			origin = bc.GetHeader(ancestor, ancestorNumber)
+		} else {
+			origin = bc.GetHeaderByNumber(number + step)
+			if origin == nil {
+				break
+			}
+			// Ensure the origin is the canonical ancestor of the next header
+			if ancestor, _ := bc.GetAncestor(origin.Hash(), number+step, step, &maxNonCanonical); ancestor != hash {
+				break
+			}
+		}
+		if origin == nil {
+			break
+		}
+		headers = append(headers, origin)
+	}
+	return headers
+}
+
 // GetBody retrieves a block body (transactions and uncles) from the database by
 // hash, caching it if found.
 func (bc *BlockChain) GetBody(hash common.Hash) *types.Body {
@@ -127,6 +266,7 @@ func (bc *BlockChain) GetBody(hash common.Hash) *types.Body {
 	}
 	// Cache the found body for next time and return
 	bc.bodyCache.Add(hash, body)
+	bodyCacheGauge.Update(int64(bc.bodyCache.Len()))
 	return body
 }
 
@@ -185,6 +325,7 @@ func (bc *BlockChain) GetBlock(hash common.Hash, number uint64) *types.Block {
 	}
 	// Cache the found block for next time and return
 	bc.blockCache.Add(block.Hash(), block)
+	blockCacheGauge.Update(int64(bc.blockCache.Len()))
 	return block
 }
 
@@ -207,6 +348,29 @@ func (bc *BlockChain) GetBlockByNumber(number uint64) *types.Block {
 	return bc.GetBlock(hash, number)
 }
 
+// GetBlocksByNumbers retrieves the canonical blocks with the given numbers, in
+// the same order, with nil entries for the missing ones. The blocks read from
+// the database are cached just like with GetBlockByNumber.
+func (bc *BlockChain) GetBlocksByNumbers(numbers []uint64) []*types.Block {
+	blocks := make([]*types.Block, len(numbers))
+	for i, number := range numbers {
+		hash := rawdb.ReadCanonicalHash(bc.db, number)
+		if hash == (common.Hash{}) {
+			continue
+		}
+		if block, ok := bc.blockCache.Get(hash); ok {
+			blocks[i] = block
+			continue
+		}
+		if block := rawdb.ReadBlock(bc.db, hash, number); block != nil {
+			bc.blockCache.Add(hash, block)
+			blockCacheGauge.Update(int64(bc.blockCache.Len()))
+			blocks[i] = block
+		}
+	}
+	return blocks
+}
+
 // GetBlocksFromHash returns the block corresponding to hash and up to n-1 ancestors.
 // [deprecated by eth/62]
 func (bc *BlockChain) GetBlocksFromHash(hash common.Hash, n int) (blocks []*types.Block) {
@@ -235,18 +399,162 @@ func (bc *BlockChain) GetReceiptsByHash(hash common.Hash) types.Receipts {
 	if number == nil {
 		return nil
 	}
-	header := bc.GetHeader(hash, *number)
+	return bc.getReceipts(hash, *number)
+}
+
+// GetOrphanReceipts retrieves the receipts of a block reorged out of the
+// canonical chain, retained if CacheConfig.RetainOrphanReceipts is set. Only
+// the consensus fields of the receipts are populated, as the block body may not
+// be available anymore.
+func (bc *BlockChain) GetOrphanReceipts(hash common.Hash) types.Receipts {
+	return rawdb.ReadOrphanReceipts(bc.db, hash)
+}
+
+// GetReceiptsByNumber retrieves the receipts for all transactions in the
+// canonical block with the given number. An error is returned if the number is
+// above the current head or if the receipts are not available.
+func (bc *BlockChain) GetReceiptsByNumber(number uint64) (types.Receipts, error) {
+	if head := bc.CurrentSnapBlock().Number.Uint64(); number > head {
+		return nil, fmt.Errorf("block #%d is above the head #%d", number, head)
+	}
+	hash := bc.GetCanonicalHash(number)
+	if hash == (common.Hash{}) {
+		return nil, fmt.Errorf("canonical block #%d not found", number)
+	}
+	if receipts, ok := bc.receiptsCache.Get(hash); ok {
+		return receipts, nil
+	}
+	receipts := bc.getReceipts(hash, number)
+	if receipts == nil {
+		return nil, fmt.Errorf("receipts of block #%d [%x..] not found", number, hash.Bytes()[:4])
+	}
+	return receipts, nil
+}
+
+// GetBlockWithReceipts retrieves a block along with the receipts of all its
+// transactions, from the caches if available. As both are looked up by hash,
+// they always belong together, regardless of head changes in the meantime.
+func (bc *BlockChain) GetBlockWithReceipts(hash common.Hash) (*types.Block, types.Receipts, error) {
+	number := bc.GetBlockNumber(hash)
+	if number == nil {
+		return nil, nil, fmt.Errorf("block %x not found", hash)
+	}
+	block := bc.GetBlock(hash, *number)
+	if block == nil {
+		return nil, nil, fmt.Errorf("block #%d [%x..] not found", *number, hash.Bytes()[:4])
+	}
+	receipts, ok := bc.receiptsCache.Get(hash)
+	if !ok {
+		receipts = bc.getReceipts(hash, *number)
+	}
+	if receipts == nil {
+		return nil, nil, fmt.Errorf("receipts of block #%d [%x..] not found", *number, hash.Bytes()[:4])
+	}
+	return block, withSystemLogsBlockHash(receipts, hash), nil
+}
+
+// withSystemLogsBlockHash returns the receipts with the block hash set in the
+// logs of the trailing system transactions, which might miss it. The receipts
+// are copied if they need fixing, as they might be shared with the cache.
+func withSystemLogsBlockHash(receipts types.Receipts, hash common.Hash) types.Receipts {
+	var broken bool
+	for i := len(receipts) - 1; i >= 0 && i >= len(receipts)-possibleSystemReceipts; i-- {
+		for _, l := range receipts[i].Logs {
+			if l.BlockHash != hash {
+				broken = true
+			}
+		}
+	}
+	if !broken {
+		return receipts
+	}
+	fixed := slices.Clone(receipts)
+	for i := len(fixed) - 1; i >= 0 && i >= len(fixed)-possibleSystemReceipts; i-- {
+		cpy := *fixed[i]
+		cpy.Logs = make([]*types.Log, len(fixed[i].Logs))
+		for j, l := range fixed[i].Logs {
+			logCpy := *l
+			logCpy.BlockHash = hash
+			cpy.Logs[j] = &logCpy
+		}
+		fixed[i] = &cpy
+	}
+	return fixed
+}
+
+// getReceipts retrieves the receipts of the given block from the database, or
+// from its diff layer if the database has none, and caches them if found. The
+// receipts cache is expected to be checked by the caller.
+func (bc *BlockChain) getReceipts(hash common.Hash, number uint64) types.Receipts {
+	header := bc.GetHeader(hash, number)
 	if header == nil {
 		return nil
 	}
-	receipts := rawdb.ReadReceipts(bc.db, hash, *number, header.Time, bc.chainConfig)
+	receipts := rawdb.ReadReceipts(bc.db, hash, number, header.Time, bc.chainConfig)
+	if receipts == nil {
+		receipts = bc.diffLayerReceipts(hash, header)
+	}
 	if receipts == nil {
 		return nil
 	}
 	bc.receiptsCache.Add(hash, receipts)
+	receiptsCacheGauge.Update(int64(bc.receiptsCache.Len()))
 	return receipts
 }
 
+// diffLayerReceipts returns a copy of the receipts stored in the diff layer of
+// the given block with their derived fields filled in, including the block hash
+// of the system transaction logs.
+func (bc *BlockChain) diffLayerReceipts(hash common.Hash, header *types.Header) types.Receipts {
+	diffLayer := bc.GetTrustedDiffLayer(hash)
+	if diffLayer == nil || diffLayer.Receipts == nil {
+		return nil
+	}
+	body := bc.GetBody(hash)
+	if body == nil {
+		return nil
+	}
+	// The diff layer might be shared with other readers, derive the fields on a copy
+	receipts := make(types.Receipts, len(diffLayer.Receipts))
+	for i, receipt := range diffLayer.Receipts {
+		cpy := *receipt
+		cpy.Logs = make([]*types.Log, len(receipt.Logs))
+		for j, l := range receipt.Logs {
+			logCpy := *l
+			cpy.Logs[j] = &logCpy
+		}
+		receipts[i] = &cpy
+	}
+	var blobGasPrice *big.Int
+	if header.ExcessBlobGas != nil {
+		blobGasPrice = eip4844.CalcBlobFee(*header.ExcessBlobGas)
+	}
+	if err := receipts.DeriveFields(bc.chainConfig, hash, header.Number.Uint64(), header.Time, header.BaseFee, blobGasPrice, body.Transactions); err != nil {
+		log.Error("Failed to derive diff layer receipts", "hash", hash, "number", header.Number, "err", err)
+		return nil
+	}
+	return receipts
+}
+
+// GetReceiptsRLP retrieves the receipts of all transactions in a given block in
+// their network RLP encoding, caching them if found.
+func (bc *BlockChain) GetReceiptsRLP(hash common.Hash) rlp.RawValue {
+	if cached, ok := bc.receiptsRLPCache.Get(hash); ok {
+		return cached
+	}
+	receipts := bc.GetReceiptsByHash(hash)
+	if receipts == nil {
+		return nil
+	}
+	encoded, err := rlp.EncodeToBytes(receipts)
+	if err != nil {
+		log.Error("Failed to encode block receipts", "hash", hash, "err", err)
+		return nil
+	}
+	bc.receiptsRLPCache.Add(hash, encoded)
+	return encoded
+}
+
 // GetSidecarsByHash retrieves the sidecars for all transactions in a given block.
 func (bc *BlockChain) GetSidecarsByHash(hash common.Hash) types.BlobSidecars {
 	if sidecars, ok := bc.sidecarsCache.Get(hash); ok {
@@ -280,6 +588,104 @@ func (bc *BlockChain) GetCanonicalHash(number uint64) common.Hash {
 	return bc.hc.GetCanonicalHash(number)
 }
 
+// GetAllBlockHashesAtNumber returns the hashes of all the known headers at the
+// given height, canonical and side ones, along with the index of the canonical
+// hash among them. The index is -1 if there is no canonical header at the height.
+// An empty slice is returned if no header is known.
+func (bc *BlockChain) GetAllBlockHashesAtNumber(number uint64) (hashes []common.Hash, canonical int) {
+	hashes = rawdb.ReadAllHashes(bc.db.BlockStore(), number)
+	hash := bc.GetCanonicalHash(number)
+	if hash == (common.Hash{}) {
+		return hashes, -1
+	}
+	for i := range hashes {
+		if hashes[i] == hash {
+			return hashes, i
+		}
+	}
+	// Frozen canonical headers are not in the key-value store
+	return append(hashes, hash), len(hashes)
+}
+
+// GetBlockByTimestamp returns the highest canonical block with a timestamp not
+// after the given one, found by binary search over the canonical headers. The
+// genesis block is returned for timestamps before it and the head block for the
+// ones after it.
+func (bc *BlockChain) GetBlockByTimestamp(timestamp uint64) (*types.Block, error) {
+	var (
+		head    = bc.CurrentBlock().Number.Uint64()
+		missing error
+	)
+	// Find the first block after the timestamp, the one before is the result
+	n := sort.Search(int(head)+1, func(i int) bool {
+		header := bc.GetHeaderByNumber(uint64(i))
+		if header == nil {
+			if missing == nil {
+				missing = fmt.Errorf("missing canonical header #%d", i)
+			}
+			return true
+		}
+		return header.Time > timestamp
+	})
+	if missing != nil {
+		return nil, missing
+	}
+	if n > 0 {
+		n--
+	}
+	block := bc.GetBlockByNumber(uint64(n))
+	if block == nil {
+		return nil, fmt.Errorf("missing canonical block #%d", n)
+	}
+	return block, nil
+}
+
+// GetCanonicalHashes returns the canonical hashes for the block numbers in the
+// [from, to] range, with zero hashes for the missing ones. The range is capped
+// to maxCanonicalHashesRange entries, anything beyond is silently dropped.
+func (bc *BlockChain) GetCanonicalHashes(from, to uint64) []common.Hash {
+	if from > to {
+		return nil
+	}
+	if to-from >= maxCanonicalHashesRange {
+		to = from + maxCanonicalHashesRange - 1
+	}
+	hashes := make([]common.Hash, 0, to-from+1)
+	for number := from; number <= to; number++ {
+		hashes = append(hashes, rawdb.ReadCanonicalHash(bc.db, number))
+	}
+	return hashes
+}
+
+// VerifyChainContiguity walks the canonical chain in the [from, to] range and
+// checks that every block is present with its body and links to its canonical
+// parent. It returns the number of the first block failing the check, or false
+// for ok if there's none. The scan reads the database directly without holding
+// the chain mutex, so a concurrent reorg may be reported as a gap.
+func (bc *BlockChain) VerifyChainContiguity(from, to uint64) (gapAt uint64, ok bool) {
+	var parent common.Hash
+	for number := from; number <= to; number++ {
+		hash := rawdb.ReadCanonicalHash(bc.db, number)
+		if hash == (common.Hash{}) {
+			return number, false
+		}
+		header := rawdb.ReadHeader(bc.db, hash, number)
+		if header == nil || !rawdb.HasBody(bc.db, hash, number) {
+			return number, false
+		}
+		if number > from && header.ParentHash != parent {
+			return number, false
+		}
+		parent = hash
+
+		// Avoid overflowing the counter if the range ends at the max number
+		if number == to {
+			break
+		}
+	}
+	return 0, true
+}
+
 // GetAncestor retrieves the Nth ancestor of a given block. It assumes that either the given block or
 // a close ancestor of it is canonical. maxNonCanonical points to a downwards counter limiting the
 // number of blocks to be individually checked before we reach the canonical chain.
@@ -289,6 +695,63 @@ func (bc *BlockChain) GetAncestor(hash common.Hash, number, ancestor uint64, max
 	return bc.hc.GetAncestor(hash, number, ancestor, maxNonCanonical)
 }
 
+// errMissingBlock is returned by BlockIterator.Err if the iteration hit a block
+// whose parent is not available locally.
+var errMissingBlock = errors.New("missing block")
+
+// BlockIterator walks the chain backwards from a given block via the parent
+// hashes, regardless of whether the blocks are canonical or not.
+type BlockIterator struct {
+	bc     *BlockChain
+	hash   common.Hash // Hash of the next block to return
+	number uint64      // Number of the next block to return
+	done   bool        // Flag whether the iteration is finished
+	err    error       // Error hit during the iteration, if any
+}
+
+// NewBlockIterator creates a reverse block iterator starting at the block with
+// the given hash. The first call to Prev returns the head block itself.
+func (bc *BlockChain) NewBlockIterator(head common.Hash) *BlockIterator {
+	it := &BlockIterator{bc: bc, hash: head}
+	if number := bc.hc.GetBlockNumber(head); number != nil {
+		it.number = *number
+	} else {
+		it.done, it.err = true, fmt.Errorf("%w: [%x..]", errMissingBlock, head.Bytes()[:4])
+	}
+	return it
+}
+
+// Prev returns the next block walking backwards, or false if the iteration is
+// over. The iteration ends cleanly after the genesis block is returned, while
+// a missing block in the middle of the chain is reported by Err.
+func (it *BlockIterator) Prev() (*types.Block, bool) {
+	if it.done {
+		return nil, false
+	}
+	block := it.bc.GetBlock(it.hash, it.number)
+	if block == nil {
+		it.done, it.err = true, fmt.Errorf("%w: #%d [%x..]", errMissingBlock, it.number, it.hash.Bytes()[:4])
+		return nil, false
+	}
+	if block.NumberU64() == 0 {
+		it.done = true
+	} else {
+		it.hash, it.number = block.ParentHash(), block.NumberU64()-1
+	}
+	return block, true
+}
+
+// Err returns the error which terminated the iteration, or nil if the iteration
+// is still running or reached the genesis block.
+func (it *BlockIterator) Err() error {
+	return it.err
+}
+
+// Close stops the iteration, any further call to Prev returns false.
+func (it *BlockIterator) Close() {
+	it.done = true
+}
+
 // GetTransactionLookup retrieves the lookup along with the transaction
 // itself associate with the given transaction hash.
 //
@@ -328,27 +791,104 @@ func (bc *BlockChain) GetTransactionLookup(hash common.Hash) (*rawdb.LegacyTxLoo
 		lookup:      lookup,
 		transaction: tx,
 	})
+	txLookupCacheGauge.Update(int64(bc.txLookupCache.Len()))
 	return lookup, tx, nil
 }
 
+// GetTransactionReceipt retrieves the receipt of the given transaction along with
+// the hash and number of the containing block and the index of the transaction
+// within it. ErrTxNotFound is returned if the transaction is not indexed.
+func (bc *BlockChain) GetTransactionReceipt(txHash common.Hash) (*types.Receipt, common.Hash, uint64, uint64, error) {
+	lookup, _, err := bc.GetTransactionLookup(txHash)
+	if err != nil {
+		return nil, common.Hash{}, 0, 0, err
+	}
+	if lookup == nil {
+		return nil, common.Hash{}, 0, 0, ErrTxNotFound
+	}
+	receipts := bc.GetReceiptsByHash(lookup.BlockHash)
+	if uint64(len(receipts)) <= lookup.Index {
+		return nil, common.Hash{}, 0, 0, ErrTxNotFound
+	}
+	receipts = withSystemLogsBlockHash(receipts, lookup.BlockHash)
+	return receipts[lookup.Index], lookup.BlockHash, lookup.BlockIndex, lookup.Index, nil
+}
+
+// GetTransactionLogs retrieves the logs emitted by the given transaction, with
+// the block hash applied to them. ErrTxNotFound is returned if the transaction
+// is not indexed.
+func (bc *BlockChain) GetTransactionLogs(txHash common.Hash) ([]*types.Log, error) {
+	receipt, _, _, _, err := bc.GetTransactionReceipt(txHash)
+	if err != nil {
+		return nil, err
+	}
+	return receipt.Logs, nil
+}
+
 // GetTd retrieves a block's total difficulty in the canonical chain from the
 // database by hash and number, caching it if found.
 func (bc *BlockChain) GetTd(hash common.Hash, number uint64) *big.Int {
 	return bc.hc.GetTd(hash, number)
 }
 
+// GetTds retrieves the total difficulties of a batch of blocks, in the order of
+// the given hashes and numbers. Unknown blocks have a nil entry in the result.
+// An error is returned if the number of hashes and numbers mismatch.
+func (bc *BlockChain) GetTds(hashes []common.Hash, numbers []uint64) ([]*big.Int, error) {
+	if len(hashes) != len(numbers) {
+		return nil, fmt.Errorf("hash and number count mismatch: %d != %d", len(hashes), len(numbers))
+	}
+	tds := make([]*big.Int, len(hashes))
+	for i, hash := range hashes {
+		tds[i] = bc.hc.GetTd(hash, numbers[i])
+	}
+	return tds, nil
+}
+
 // HasState checks if state trie is fully present in the database or not.
 func (bc *BlockChain) HasState(hash common.Hash) bool {
 	if bc.NoTries() {
-		return bc.snaps != nil && bc.snaps.Snapshot(hash) != nil
+		return bc.HasSnapshotState(hash)
 	}
-	if bc.pipeCommit && bc.snaps != nil {
+	if snaps := bc.snaps.Load(); bc.pipeCommit && snaps != nil {
 		// If parent snap is pending on verification, treat it as state exist
-		if s := bc.snaps.Snapshot(hash); s != nil && !s.Verified() {
+		if s := snaps.Snapshot(hash); s != nil && !s.Verified() {
 			return true
 		}
 	}
-	_, err := bc.stateCache.OpenTrie(hash)
+	return bc.HasTrieState(hash)
+}
+
+// HasSnapshotState checks if the state of the given root is available in the
+// snapshot tree, which is the cheapest source for flat state reads.
+func (bc *BlockChain) HasSnapshotState(root common.Hash) bool {
+	snaps := bc.snaps.Load()
+	return snaps != nil && snaps.Snapshot(root) != nil
+}
+
+// SnapshotVerifyStatus reports whether the snapshot layer of the given root
+// exists, whether it has finished verification (only pending in pipeline
+// commit mode) and the verification result. It never blocks on a pending
+// verification, the result is false until verified.
+func (bc *BlockChain) SnapshotVerifyStatus(root common.Hash) (verified bool, result bool, exists bool) {
+	snaps := bc.snaps.Load()
+	if snaps == nil {
+		return false, false, false
+	}
+	snap := snaps.Snapshot(root)
+	if snap == nil {
+		return false, false, false
+	}
+	if !snap.Verified() {
+		return false, false, true
+	}
+	return true, snap.WaitAndGetVerifyRes(), true
+}
+
+// HasTrieState checks if the state trie of the given root is present in the
+// trie database, regardless of the snapshot.
+func (bc *BlockChain) HasTrieState(root common.Hash) bool {
+	_, err := bc.stateCache.OpenTrie(root)
 	return err == nil
 }
 
@@ -396,7 +936,7 @@ func (bc *BlockChain) State() (*state.StateDB, error) {
 
 // StateAt returns a new mutable state based on a particular point in time.
 func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
-	stateDb, err := state.New(root, bc.stateCache, bc.snaps)
+	stateDb, err := state.New(root, bc.stateCache, bc.snaps.Load())
 	if err != nil {
 		return nil, err
 	}
@@ -412,25 +952,71 @@ func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
 	return stateDb, err
 }
 
+// VerifyStateRoots checks whether the states of the canonical blocks with the
+// given numbers can be opened, e.g. to sample a freshly synced database before
+// trusting it. The result maps every number to the outcome, false if the header
+// or its state is missing. Nothing is modified.
+//
+// Note, only the presence of the state root is verified, neither the rest of
+// the trie nor the correctness of the state, which needs a full re-execution.
+func (bc *BlockChain) VerifyStateRoots(numbers []uint64) (map[uint64]bool, error) {
+	head := bc.CurrentBlock().Number.Uint64()
+	results := make(map[uint64]bool, len(numbers))
+	for _, number := range numbers {
+		if number > head {
+			return nil, fmt.Errorf("block #%d is above the head #%d", number, head)
+		}
+		header := bc.GetHeaderByNumber(number)
+		if header == nil {
+			results[number] = false
+			continue
+		}
+		_, err := bc.StateAt(header.Root)
+		results[number] = err == nil
+	}
+	return results, nil
+}
+
+// GetStateAndRelease returns a new mutable state with a shared storage pool based
+// on a particular point in time, along with a release function which must be
+// called once the state is no longer used. The release function stops any trie
+// prefetcher started on the state, so callers can simply defer it.
+func (bc *BlockChain) GetStateAndRelease(root common.Hash) (*state.StateDB, func(), error) {
+	stateDb, err := state.NewWithSharedPool(root, bc.stateCache, bc.snaps.Load())
+	if err != nil {
+		return nil, nil, err
+	}
+	// Same as StateAt, report the unavailable snapshot as an error.
+	if stateDb.NoTrie() && stateDb.GetSnap() == nil {
+		return nil, nil, errors.New("state is not available")
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(stateDb.StopPrefetcher)
+	}
+	return stateDb, release, nil
+}
+
 // Config retrieves the chain's fork configuration.
 func (bc *BlockChain) Config() *params.ChainConfig { return bc.chainConfig }
 
 // Engine retrieves the blockchain's consensus engine.
 func (bc *BlockChain) Engine() consensus.Engine { return bc.engine }
 
-// Snapshots returns the blockchain snapshot tree.
+// Snapshots returns the blockchain snapshot tree, or nil if the snapshot is
+// disabled.
 func (bc *BlockChain) Snapshots() *snapshot.Tree {
-	return bc.snaps
+	return bc.snaps.Load()
 }
 
 // Validator returns the current validator.
 func (bc *BlockChain) Validator() Validator {
-	return bc.validator
+	return *bc.validator.Load()
 }
 
 // Processor returns the current processor.
 func (bc *BlockChain) Processor() Processor {
-	return bc.processor
+	return *bc.processor.Load()
 }
 
 // StateCache returns the caching database underpinning the blockchain instance.
@@ -461,6 +1047,52 @@ func (bc *BlockChain) TxIndexProgress() (TxIndexProgress, error) {
 	return bc.txIndexer.txIndexProgress()
 }
 
+// LastReorgReexecStats returns the cost of the last re-execution of pruned
+// ancestor blocks, done to regenerate their state for a side chain reorg or a
+// block import. The stats only cover that single operation, not a sum.
+func (bc *BlockChain) LastReorgReexecStats() ReorgReexecStats {
+	bc.lastReorgReexecLock.Lock()
+	defer bc.lastReorgReexecLock.Unlock()
+
+	return bc.lastReorgReexec
+}
+
+// InsertStats returns the aggregate stats of the block imports since startup,
+// a cheap view of the import throughput.
+func (bc *BlockChain) InsertStats() InsertStatsSnapshot {
+	bc.insertTotalsLock.Lock()
+	defer bc.insertTotalsLock.Unlock()
+
+	stats := bc.insertTotals
+	if stats.Processed > 0 {
+		stats.AvgInsertTime = stats.InsertTime / time.Duration(stats.Processed)
+	}
+	return stats
+}
+
+// RecentGasThroughput returns the average gas used per block and per second of
+// block processing over the recently imported blocks, as configured by
+// CacheConfig.GasThroughputWindow.
+func (bc *BlockChain) RecentGasThroughput() (gasPerBlock float64, gasPerSecond float64) {
+	return bc.gasWindow.throughput()
+}
+
+// PauseTxIndexing defers the transaction indexing work until resumed, e.g. to
+// leave the disk IO to the block import during sync. The indexing already in
+// progress is not interrupted.
+func (bc *BlockChain) PauseTxIndexing() {
+	if bc.txIndexer != nil {
+		bc.txIndexer.pause()
+	}
+}
+
+// ResumeTxIndexing resumes the transaction indexing deferred by PauseTxIndexing.
+func (bc *BlockChain) ResumeTxIndexing() {
+	if bc.txIndexer != nil {
+		bc.txIndexer.resumeIndexing()
+	}
+}
+
 // TrieDB retrieves the low level trie database used for data storage.
 func (bc *BlockChain) TrieDB() *triedb.Database {
 	return bc.triedb
@@ -471,43 +1103,106 @@ func (bc *BlockChain) HeaderChain() *HeaderChain {
 	return bc.hc
 }
 
-// SubscribeRemovedLogsEvent registers a subscription of RemovedLogsEvent.
+// FeedStats returns the number of active subscriptions of every event feed of
+// the chain, e.g. to catch subscription leaks in long running processes. The
+// counts are approximate if subscriptions come and go concurrently. Feeds that
+// were never subscribed to are omitted.
+func (bc *BlockChain) FeedStats() map[string]int {
+	bc.feedSubsLock.Lock()
+	defer bc.feedSubsLock.Unlock()
+
+	stats := make(map[string]int, len(bc.feedSubs))
+	for feed, count := range bc.feedSubs {
+		stats[feed] = count
+	}
+	return stats
+}
+
+// trackFeedSub counts the given subscription of the named feed until it is
+// unsubscribed.
+func (bc *BlockChain) trackFeedSub(feed string, sub event.Subscription) event.Subscription {
+	bc.feedSubsLock.Lock()
+	defer bc.feedSubsLock.Unlock()
+
+	if bc.feedSubs == nil {
+		bc.feedSubs = make(map[string]int)
+	}
+	bc.feedSubs[feed]++
+	return &countedSub{Subscription: sub, done: func() {
+		bc.feedSubsLock.Lock()
+		defer bc.feedSubsLock.Unlock()
+
+		bc.feedSubs[feed]--
+	}}
+}
+
+// countedSub is a subscription that reports its first unsubscription.
+type countedSub struct {
+	event.Subscription
+	once sync.Once
+	done func()
+}
+
+func (s *countedSub) Unsubscribe() {
+	s.Subscription.Unsubscribe()
+	s.once.Do(s.done)
+}
+
+// SubscribeRemovedLogsEvent registers a subscription of RemovedLogsEvent. On a
+// reorg, the logs of the blocks dropped from the canonical chain are sent with
+// Removed set, before the logs of the new canonical blocks are sent on the logs
+// feed, so subscribers can process the removals first.
 func (bc *BlockChain) SubscribeRemovedLogsEvent(ch chan<- RemovedLogsEvent) event.Subscription {
-	return bc.scope.Track(bc.rmLogsFeed.Subscribe(ch))
+	return bc.scope.Track(bc.trackFeedSub("removedLogs", bc.rmLogsFeed.Subscribe(ch)))
 }
 
 // SubscribeChainEvent registers a subscription of ChainEvent.
 func (bc *BlockChain) SubscribeChainEvent(ch chan<- ChainEvent) event.Subscription {
-	return bc.scope.Track(bc.chainFeed.Subscribe(ch))
+	return bc.scope.Track(bc.trackFeedSub("chain", bc.chainFeed.Subscribe(ch)))
 }
 
 // SubscribeChainHeadEvent registers a subscription of ChainHeadEvent.
 func (bc *BlockChain) SubscribeChainHeadEvent(ch chan<- ChainHeadEvent) event.Subscription {
-	return bc.scope.Track(bc.chainHeadFeed.Subscribe(ch))
+	return bc.scope.Track(bc.trackFeedSub("chainHead", bc.chainHeadFeed.Subscribe(ch)))
 }
 
 // SubscribeChainBlockEvent registers a subscription of ChainBlockEvent.
 func (bc *BlockChain) SubscribeChainBlockEvent(ch chan<- ChainHeadEvent) event.Subscription {
-	return bc.scope.Track(bc.chainBlockFeed.Subscribe(ch))
+	return bc.scope.Track(bc.trackFeedSub("chainBlock", bc.chainBlockFeed.Subscribe(ch)))
 }
 
 // SubscribeChainSideEvent registers a subscription of ChainSideEvent.
 func (bc *BlockChain) SubscribeChainSideEvent(ch chan<- ChainSideEvent) event.Subscription {
-	return bc.scope.Track(bc.chainSideFeed.Subscribe(ch))
+	return bc.scope.Track(bc.trackFeedSub("chainSide", bc.chainSideFeed.Subscribe(ch)))
+}
+
+// SubscribeChainSideBatchEvent registers a subscription of ChainSideBatchEvent.
+func (bc *BlockChain) SubscribeChainSideBatchEvent(ch chan<- ChainSideBatchEvent) event.Subscription {
+	return bc.scope.Track(bc.trackFeedSub("chainSideBatch", bc.chainSideBatchFeed.Subscribe(ch)))
 }
 
 // SubscribeLogsEvent registers a subscription of []*types.Log.
 func (bc *BlockChain) SubscribeLogsEvent(ch chan<- []*types.Log) event.Subscription {
-	return bc.scope.Track(bc.logsFeed.Subscribe(ch))
+	return bc.scope.Track(bc.trackFeedSub("logs", bc.logsFeed.Subscribe(ch)))
 }
 
 // SubscribeBlockProcessingEvent registers a subscription of bool where true means
 // block processing has started while false means it has stopped.
 func (bc *BlockChain) SubscribeBlockProcessingEvent(ch chan<- bool) event.Subscription {
-	return bc.scope.Track(bc.blockProcFeed.Subscribe(ch))
+	return bc.scope.Track(bc.trackFeedSub("blockProc", bc.blockProcFeed.Subscribe(ch)))
+}
+
+// SubscribeSnapGenEvent registers a subscription of SnapGenEvent.
+func (bc *BlockChain) SubscribeSnapGenEvent(ch chan<- SnapGenEvent) event.Subscription {
+	return bc.scope.Track(bc.trackFeedSub("snapGen", bc.snapGenFeed.Subscribe(ch)))
+}
+
+// SubscribeDoubleSignEvent registers a subscription of DoubleSignEvent.
+func (bc *BlockChain) SubscribeDoubleSignEvent(ch chan<- DoubleSignEvent) event.Subscription {
+	return bc.scope.Track(bc.trackFeedSub("doubleSign", bc.doubleSignFeed.Subscribe(ch)))
 }
 
 // SubscribeFinalizedHeaderEvent registers a subscription of FinalizedHeaderEvent.
 func (bc *BlockChain) SubscribeFinalizedHeaderEvent(ch chan<- FinalizedHeaderEvent) event.Subscription {
-	return bc.scope.Track(bc.finalizedHeaderFeed.Subscribe(ch))
+	return bc.scope.Track(bc.trackFeedSub("finalizedHeader", bc.finalizedHeaderFeed.Subscribe(ch)))
 }
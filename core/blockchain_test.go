@@ -17,12 +17,16 @@
 package core
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"math/rand"
 	"os"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -36,15 +40,20 @@ import (
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/consensus/beacon"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/monitor"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/eth/tracers/logger"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+	"github.com/ethereum/go-ethereum/triedb"
 	"github.com/holiman/uint256"
 )
 
@@ -207,7 +216,7 @@ func testBlockChainImport(chain types.Blocks, pipelineCommit bool, blockchain *B
 		// Try and process the block
 		err := blockchain.engine.VerifyHeader(blockchain, block.Header())
 		if err == nil {
-			err = blockchain.validator.ValidateBody(block)
+			err = blockchain.Validator().ValidateBody(block)
 		}
 		if err != nil {
 			if err == ErrKnownBlock {
@@ -223,12 +232,12 @@ func testBlockChainImport(chain types.Blocks, pipelineCommit bool, blockchain *B
 		if pipelineCommit {
 			statedb.EnablePipeCommit()
 		}
-		statedb, receipts, _, usedGas, err := blockchain.processor.Process(block, statedb, vm.Config{})
+		statedb, receipts, _, usedGas, err := blockchain.Processor().Process(block, statedb, vm.Config{})
 		if err != nil {
 			blockchain.reportBlock(block, receipts, err)
 			return err
 		}
-		err = blockchain.validator.ValidateState(block, statedb, receipts, usedGas)
+		err = blockchain.Validator().ValidateState(block, statedb, receipts, usedGas)
 		if err != nil {
 			blockchain.reportBlock(block, receipts, err)
 			return err
@@ -4564,3 +4573,2607 @@ func makeMockTx(config *params.ChainConfig, signer types.Signer, key *ecdsa.Priv
 	tx, _ := types.SignTx(types.NewTx(raw), signer, key)
 	return tx, sidecar
 }
+
+func TestBlockIterator(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 8, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create pristine chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Walk the whole chain down to genesis
+	it := chain.NewBlockIterator(chain.CurrentBlock().Hash())
+	want := chain.CurrentBlock().Number.Uint64()
+	for block, ok := it.Prev(); ok; block, ok = it.Prev() {
+		if block.NumberU64() != want {
+			t.Fatalf("block number mismatch: have %d, want %d", block.NumberU64(), want)
+		}
+		want--
+	}
+	if want != math.MaxUint64 {
+		t.Fatalf("iteration stopped early at %d", want+1)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("unexpected error at genesis: %v", err)
+	}
+	// Break the chain in the middle and ensure it's reported
+	head := chain.CurrentBlock()
+	missing := chain.GetBlockByNumber(4)
+	rawdb.DeleteBody(chain.db.BlockStore(), missing.Hash(), missing.NumberU64())
+	chain.blockCache.Purge()
+
+	it = chain.NewBlockIterator(head.Hash())
+	for _, ok := it.Prev(); ok; _, ok = it.Prev() {
+	}
+	if err := it.Err(); !errors.Is(err, errMissingBlock) {
+		t.Fatalf("missing block not reported: %v", err)
+	}
+	// Closed iterators don't yield anything
+	it = chain.NewBlockIterator(head.Hash())
+	it.Close()
+	if _, ok := it.Prev(); ok {
+		t.Fatal("closed iterator yielded a block")
+	}
+}
+
+// Tests that chain head events fired in quick succession are coalesced into
+// the latest one when a coalescing window is configured.
+func TestChainHeadEventCoalesce(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 8, func(i int, b *BlockGen) {})
+
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.HeadEventCoalesce = 200 * time.Millisecond
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	events := make(chan ChainHeadEvent, len(blocks))
+	sub := chain.SubscribeChainHeadEvent(events)
+	defer sub.Unsubscribe()
+
+	for _, block := range blocks {
+		if _, err := chain.InsertChain(types.Blocks{block}); err != nil {
+			t.Fatalf("failed to insert block %d: %v", block.NumberU64(), err)
+		}
+	}
+	select {
+	case ev := <-events:
+		if ev.Block.Hash() != blocks[len(blocks)-1].Hash() {
+			t.Fatalf("head event mismatch: have #%d, want #%d", ev.Block.NumberU64(), len(blocks))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no head event received")
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected extra head event #%d", ev.Block.NumberU64())
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+// Tests that the head status summary reflects the current chain markers.
+func TestHeadStatus(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 8, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create pristine chain: %v", err)
+	}
+	defer chain.Stop()
+
+	status := chain.HeadStatus()
+	head := chain.CurrentBlock()
+	if status.Block.Number != 8 || status.Block.Hash != head.Hash() {
+		t.Fatalf("head block mismatch: have #%d [%x], want #8 [%x]", status.Block.Number, status.Block.Hash, head.Hash())
+	}
+	if status.Header.Hash != head.Hash() {
+		t.Fatalf("head header mismatch: have %x, want %x", status.Header.Hash, head.Hash())
+	}
+	if want := chain.GetTd(head.Hash(), 8); status.Block.Td == nil || status.Block.Td.Cmp(want) != 0 {
+		t.Fatalf("head block td mismatch: have %v, want %v", status.Block.Td, want)
+	}
+	if status.Pivot != nil {
+		t.Fatalf("unexpected pivot: %d", *status.Pivot)
+	}
+	if err := chain.SetHead(4); err != nil {
+		t.Fatalf("failed to rewind: %v", err)
+	}
+	if status = chain.HeadStatus(); status.Block.Number != 4 || status.Header.Number != 4 {
+		t.Fatalf("rewound status mismatch: block #%d, header #%d", status.Block.Number, status.Header.Number)
+	}
+}
+
+// Tests that SetHead reports requests which wouldn't rewind anything.
+func TestSetHeadNoRewind(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 8, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create pristine chain: %v", err)
+	}
+	defer chain.Stop()
+
+	head := chain.CurrentBlock().Hash()
+	for _, number := range []uint64{9, 8} {
+		if err := chain.SetHead(number); !errors.Is(err, ErrSetHeadNoRewind) {
+			t.Fatalf("SetHead(%d): error mismatch: have %v, want %v", number, err, ErrSetHeadNoRewind)
+		}
+		if have := chain.CurrentBlock().Hash(); have != head {
+			t.Fatalf("SetHead(%d): head changed: have %x, want %x", number, have, head)
+		}
+	}
+	if err := chain.SetHead(7); err != nil {
+		t.Fatalf("SetHead(7): failed to rewind: %v", err)
+	}
+	if have := chain.CurrentBlock().Number.Uint64(); have != 7 {
+		t.Fatalf("SetHead(7): head mismatch: have #%d, want #7", have)
+	}
+}
+
+// Tests that SetHeadWithResult reports the range the head was rewound over.
+func TestSetHeadWithResult(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 8, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create pristine chain: %v", err)
+	}
+	defer chain.Stop()
+
+	old := chain.CurrentBlock()
+	target := chain.GetHeaderByNumber(5)
+	result, err := chain.SetHeadWithResult(5)
+	if err != nil {
+		t.Fatalf("failed to rewind: %v", err)
+	}
+	want := SetHeadResult{
+		OldNumber: 8,
+		OldHash:   old.Hash(),
+		NewNumber: 5,
+		NewHash:   target.Hash(),
+		Removed:   3,
+	}
+	if result != want {
+		t.Fatalf("result mismatch: have %+v, want %+v", result, want)
+	}
+	if _, err := chain.SetHeadWithResult(5); !errors.Is(err, ErrSetHeadNoRewind) {
+		t.Fatalf("error mismatch: have %v, want %v", err, ErrSetHeadNoRewind)
+	}
+}
+
+// Tests that replaying a block reproduces its receipts without touching the chain.
+func TestReplayBlock(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(1000000000000000)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x01}, big.NewInt(1000), params.TxGas, block.header.BaseFee, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), DefaultCacheConfigWithScheme(rawdb.HashScheme), gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	head := chain.CurrentBlock().Hash()
+
+	block := blocks[2]
+	receipts, _, usedGas, err := chain.ReplayBlock(block, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	if usedGas != block.GasUsed() {
+		t.Fatalf("gas used mismatch: have %d, want %d", usedGas, block.GasUsed())
+	}
+	if hash := types.DeriveSha(receipts, trie.NewStackTrie(nil)); hash != block.ReceiptHash() {
+		t.Fatalf("receipt root mismatch: have %x, want %x", hash, block.ReceiptHash())
+	}
+	if have := chain.CurrentBlock().Hash(); have != head {
+		t.Fatalf("head changed by replay: have %x, want %x", have, head)
+	}
+	if _, _, _, err := chain.ReplayBlock(chain.Genesis(), vm.Config{}); err == nil {
+		t.Fatal("genesis replay accepted")
+	}
+}
+
+// Tests that replaying a block whose parent state has to be regenerated leaves
+// the chain database untouched.
+func TestReplayBlockRegenerate(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(1000000000000000)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	// Deploy a contract in every block, so committing the regenerated state
+	// would write the code to the database
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, block *BlockGen) {
+		code := []byte{byte(vm.PUSH1), byte(i), byte(vm.PUSH1), 0x0, byte(vm.MSTORE8), byte(vm.PUSH1), 0x1, byte(vm.PUSH1), 0x0, byte(vm.RETURN)}
+		initcode := append([]byte{byte(vm.PUSH1), byte(len(code)), byte(vm.DUP1), byte(vm.PUSH1), 0xb, byte(vm.PUSH1), 0x0, byte(vm.CODECOPY), byte(vm.PUSH1), 0x0, byte(vm.RETURN)}, code...)
+		tx, err := types.SignTx(types.NewContractCreation(block.TxNonce(address), new(big.Int), 100000, block.header.BaseFee, initcode), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.SnapshotLimit = 0
+	chain, err := NewBlockChain(db, config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	// Prune the parent state from memory, only the genesis is left on disk
+	chain.triedb.Dereference(blocks[1].Root())
+	if chain.HasState(blocks[1].Root()) {
+		t.Fatal("parent state not pruned")
+	}
+	dump := func() map[string][]byte {
+		entries := make(map[string][]byte)
+		it := db.NewIterator(nil, nil)
+		defer it.Release()
+		for it.Next() {
+			entries[string(it.Key())] = common.CopyBytes(it.Value())
+		}
+		return entries
+	}
+	before := dump()
+
+	block := blocks[2]
+	receipts, _, usedGas, err := chain.ReplayBlock(block, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	if usedGas != block.GasUsed() {
+		t.Fatalf("gas used mismatch: have %d, want %d", usedGas, block.GasUsed())
+	}
+	if hash := types.DeriveSha(receipts, trie.NewStackTrie(nil)); hash != block.ReceiptHash() {
+		t.Fatalf("receipt root mismatch: have %x, want %x", hash, block.ReceiptHash())
+	}
+	after := dump()
+	if len(after) != len(before) {
+		t.Fatalf("database changed by replay: have %d entries, want %d", len(after), len(before))
+	}
+	for key, want := range before {
+		if have, ok := after[key]; !ok || !bytes.Equal(have, want) {
+			t.Fatalf("database entry %x changed by replay", key)
+		}
+	}
+	if chain.HasState(blocks[1].Root()) {
+		t.Fatal("regenerated parent state leaked into the live database")
+	}
+}
+
+// Tests that StateAtBlock regenerates pruned state on top of the closest ancestor
+// with state on disk, without handing the rebuilt state to the live trie database.
+func TestStateAtBlockRegenerate(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(1000000000000000)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x01}, big.NewInt(1000), params.TxGas, block.header.BaseFee, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.SnapshotLimit = 0
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	// Prune the state of block #3, the ones of block #1 and #2 are only held
+	// in memory by the live database and the genesis one is on disk
+	chain.triedb.Dereference(blocks[2].Root())
+	if chain.HasState(blocks[2].Root()) {
+		t.Fatal("state of block #3 not pruned")
+	}
+	if _, err := chain.StateAtBlock(blocks[2], 2); err == nil {
+		t.Fatal("state regenerated beyond the reexec limit")
+	}
+	statedb, err := chain.StateAtBlock(blocks[2], 3)
+	if err != nil {
+		t.Fatalf("failed to regenerate state from the genesis: %v", err)
+	}
+	if root := statedb.IntermediateRoot(true); root != blocks[2].Root() {
+		t.Fatalf("regenerated state root mismatch: have %x, want %x", root, blocks[2].Root())
+	}
+	if balance := statedb.GetBalance(common.Address{0x01}); balance.Uint64() != 3000 {
+		t.Fatalf("regenerated balance mismatch: have %v, want %d", balance, 3000)
+	}
+	if chain.HasState(blocks[2].Root()) {
+		t.Fatal("regenerated state leaked into the live database")
+	}
+}
+
+// Tests that the snapshot and trie state sources are reported separately.
+func TestHasSnapshotAndTrieState(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, b *BlockGen) {})
+
+	for _, limit := range []int{0, 256} {
+		config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+		config.SnapshotLimit = limit
+		config.SnapshotWait = true
+		chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create chain: %v", err)
+		}
+		if n, err := chain.InsertChain(blocks); err != nil {
+			t.Fatalf("failed to insert block %d: %v", n, err)
+		}
+		root := chain.CurrentBlock().Root
+		if have, want := chain.HasSnapshotState(root), limit > 0; have != want {
+			t.Errorf("limit %d: snapshot state mismatch: have %v, want %v", limit, have, want)
+		}
+		if !chain.HasTrieState(root) || !chain.HasState(root) {
+			t.Errorf("limit %d: head state missing", limit)
+		}
+		if chain.HasSnapshotState(common.Hash{0x01}) || chain.HasTrieState(common.Hash{0x01}) {
+			t.Errorf("limit %d: unknown state reported", limit)
+		}
+		chain.Stop()
+	}
+}
+
+// Tests that pinned states survive the trie garbage collection until unpinned.
+func TestPinState(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), int(TriesInMemory)+16, func(i int, b *BlockGen) {})
+
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), DefaultCacheConfigWithScheme(rawdb.HashScheme), gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks[:8]); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	pinned, unpinned := blocks[4].Root(), blocks[3].Root()
+	chain.PinState(pinned)
+
+	if n, err := chain.InsertChain(blocks[8:]); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if chain.HasState(unpinned) {
+		t.Fatal("unpinned state not garbage collected")
+	}
+	if !chain.HasState(pinned) {
+		t.Fatal("pinned state garbage collected")
+	}
+	chain.UnpinState(pinned)
+	if chain.HasState(pinned) {
+		t.Fatal("state retained after unpinning")
+	}
+}
+
+// Tests that the head state is flushed to disk once the chain goes idle.
+func TestIdleFlush(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, b *BlockGen) {})
+
+	db := rawdb.NewMemoryDatabase()
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.IdleFlushDelay = 100 * time.Millisecond
+	chain, err := NewBlockChain(db, config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	root := blocks[len(blocks)-1].Root()
+	if rawdb.HasLegacyTrieNode(db, root) {
+		t.Fatal("head state flushed before going idle")
+	}
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(50 * time.Millisecond) {
+		if rawdb.HasLegacyTrieNode(db, root) {
+			break
+		}
+	}
+	if !rawdb.HasLegacyTrieNode(db, root) {
+		t.Fatal("head state not flushed after going idle")
+	}
+	if have := rawdb.ReadSafePointBlockNumber(db); have != uint64(len(blocks)) {
+		t.Fatalf("safe point mismatch: have %d, want %d", have, len(blocks))
+	}
+}
+
+// Tests that total difficulties can be retrieved in batches.
+func TestGetTds(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 4, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create pristine chain: %v", err)
+	}
+	defer chain.Stop()
+
+	var (
+		hashes  = []common.Hash{chain.GetHeaderByNumber(2).Hash(), {0x01}, chain.CurrentBlock().Hash()}
+		numbers = []uint64{2, 3, 4}
+	)
+	tds, err := chain.GetTds(hashes, numbers)
+	if err != nil {
+		t.Fatalf("failed to retrieve tds: %v", err)
+	}
+	for i, td := range tds {
+		want := chain.GetTd(hashes[i], numbers[i])
+		if (td == nil) != (want == nil) || (td != nil && td.Cmp(want) != 0) {
+			t.Errorf("td %d mismatch: have %v, want %v", i, td, want)
+		}
+	}
+	if tds[1] != nil {
+		t.Errorf("unknown block has td %v", tds[1])
+	}
+	if _, err := chain.GetTds(hashes, numbers[:2]); err == nil {
+		t.Error("mismatched lengths accepted")
+	}
+}
+
+// finalityEngine is a PoSA engine for testing, finalizing the blocks a fixed
+// distance behind the given header.
+type finalityEngine struct {
+	consensus.Engine
+	distance uint64
+}
+
+func (e *finalityEngine) IsSystemTransaction(tx *types.Transaction, header *types.Header) (bool, error) {
+	return false, nil
+}
+func (e *finalityEngine) IsSystemContract(to *common.Address) bool { return false }
+func (e *finalityEngine) EnoughDistance(chain consensus.ChainReader, header *types.Header) bool {
+	return true
+}
+func (e *finalityEngine) IsLocalBlock(header *types.Header) bool { return false }
+func (e *finalityEngine) GetJustifiedNumberAndHash(chain consensus.ChainHeaderReader, headers []*types.Header) (uint64, common.Hash, error) {
+	return 0, common.Hash{}, nil
+}
+func (e *finalityEngine) GetFinalizedHeader(chain consensus.ChainHeaderReader, header *types.Header) *types.Header {
+	if number := header.Number.Uint64(); number > e.distance {
+		return chain.GetHeaderByNumber(number - e.distance)
+	}
+	return nil
+}
+func (e *finalityEngine) VerifyVote(chain consensus.ChainHeaderReader, vote *types.VoteEnvelope) error {
+	return nil
+}
+func (e *finalityEngine) IsActiveValidatorAt(chain consensus.ChainHeaderReader, header *types.Header, checkVoteKeyFn func(bLSPublicKey *types.BLSPublicKey) bool) bool {
+	return false
+}
+
+// Tests that reorgs dropping finalized blocks are rejected if the protection is
+// enabled, and accepted otherwise.
+func TestFinalityReorgProtection(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, canon, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 8, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	// The fork shares the first two blocks and overtakes the canonical chain
+	_, fork, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 10, func(i int, b *BlockGen) {
+		if i < 2 {
+			b.SetCoinbase(common.Address{0x01})
+		} else {
+			b.SetCoinbase(common.Address{0x02})
+		}
+	})
+	for _, protect := range []bool{false, true} {
+		var options []BlockChainOption
+		if protect {
+			options = append(options, EnableFinalityReorgProtection)
+		}
+		engine := &finalityEngine{Engine: ethash.NewFaker(), distance: 3}
+		chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, engine, vm.Config{}, nil, nil, options...)
+		if err != nil {
+			t.Fatalf("failed to create chain: %v", err)
+		}
+		if n, err := chain.InsertChain(canon); err != nil {
+			t.Fatalf("failed to insert canonical block %d: %v", n, err)
+		}
+		_, err = chain.InsertChain(fork[2:])
+		if protect {
+			if !errors.Is(err, ErrFinalizedReorg) {
+				t.Errorf("finalized reorg not rejected: %v", err)
+			}
+			if head := chain.CurrentBlock().Hash(); head != canon[len(canon)-1].Hash() {
+				t.Errorf("head changed despite protection: have %x", head)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("unprotected reorg failed: %v", err)
+			}
+			if head := chain.CurrentBlock().Hash(); head != fork[len(fork)-1].Hash() {
+				t.Errorf("head mismatch after reorg: have %x, want %x", head, fork[len(fork)-1].Hash())
+			}
+		}
+		chain.Stop()
+	}
+}
+
+// Tests that the detailed chain insertion reports the outcome of every block.
+func TestInsertChainDetailed(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, canon, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	_, fork, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x02})
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	check := func(blocks types.Blocks, status WriteStatus, skipped bool) {
+		t.Helper()
+
+		results, err := chain.InsertChainDetailed(blocks)
+		if err != nil {
+			t.Fatalf("failed to insert chain: %v", err)
+		}
+		if len(results) != len(blocks) {
+			t.Fatalf("result count mismatch: have %d, want %d", len(results), len(blocks))
+		}
+		for i, result := range results {
+			if result.Hash != blocks[i].Hash() || result.Number != blocks[i].NumberU64() {
+				t.Errorf("result %d: block mismatch: have #%d [%x], want #%d [%x]", i, result.Number, result.Hash, blocks[i].NumberU64(), blocks[i].Hash())
+			}
+			if result.Status != status || result.Skipped != skipped || result.Queued {
+				t.Errorf("result %d: outcome mismatch: have %+v, want status %d skipped %v", i, result, status, skipped)
+			}
+		}
+	}
+	check(canon, CanonStatTy, false)
+	check(canon, NonStatTy, true)
+	check(fork, SideStatTy, false)
+}
+
+// Tests that blocks containing transactions from filtered senders are rejected
+// and reported, while the preceding blocks are imported.
+func TestSenderFilter(t *testing.T) {
+	var (
+		key1, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		key2, _ = crypto.HexToECDSA("8a1f9a8f95be41cd7ccb6168179afb4504aefe388d1e14474d32c45c72ce7b7a")
+		addr1   = crypto.PubkeyToAddress(key1.PublicKey)
+		addr2   = crypto.PubkeyToAddress(key2.PublicKey)
+		funds   = big.NewInt(params.Ether)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{addr1: {Balance: funds}, addr2: {Balance: funds}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, b *BlockGen) {
+		key, addr := key1, addr1
+		if i == 1 {
+			key, addr = key2, addr2
+		}
+		tx, err := types.SignTx(types.NewTransaction(b.TxNonce(addr), common.Address{0x01}, big.NewInt(1000), params.TxGas, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	filter := func(addr common.Address) bool { return addr == addr2 }
+
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnableSenderFilter(filter))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	n, err := chain.InsertChain(blocks)
+	if !errors.Is(err, ErrFilteredSender) {
+		t.Fatalf("insert error mismatch: have %v, want %v", err, ErrFilteredSender)
+	}
+	if n != 1 {
+		t.Fatalf("failed block index mismatch: have %d, want 1", n)
+	}
+	if head := chain.CurrentBlock().Number.Uint64(); head != 1 {
+		t.Fatalf("head mismatch: have %d, want 1", head)
+	}
+}
+
+// Tests that the canonical hash ranges follow reorgs and report the gaps beyond
+// the chain head as zero hashes.
+func TestGetCanonicalHashes(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	genDb, canon, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 5, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	fork, _ := GenerateChain(gspec.Config, canon[1], ethash.NewFaker(), genDb, 5, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x02})
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatalf("failed to insert canonical chain: %v", err)
+	}
+	if _, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert forked chain: %v", err)
+	}
+	hashes := chain.GetCanonicalHashes(1, 9)
+	if len(hashes) != 9 {
+		t.Fatalf("hash count mismatch: have %d, want 9", len(hashes))
+	}
+	want := append(types.Blocks{canon[0], canon[1]}, fork...)
+	for i, hash := range hashes {
+		number := uint64(i + 1)
+		switch {
+		case number <= 7 && hash != want[i].Hash():
+			t.Errorf("block #%d: hash mismatch: have %x, want %x", number, hash, want[i].Hash())
+		case number > 7 && hash != (common.Hash{}):
+			t.Errorf("block #%d: expected gap, have %x", number, hash)
+		}
+	}
+	if hashes := chain.GetCanonicalHashes(2, 1); hashes != nil {
+		t.Errorf("inverted range returned %d hashes", len(hashes))
+	}
+	if hashes := chain.GetCanonicalHashes(0, 2*maxCanonicalHashesRange); len(hashes) != maxCanonicalHashesRange {
+		t.Errorf("capped range mismatch: have %d, want %d", len(hashes), maxCanonicalHashesRange)
+	}
+}
+
+// Tests that missing canonical hashes and bodies are detected as chain gaps.
+func TestVerifyChainContiguity(t *testing.T) {
+	db, _, chain, err := newCanonical(ethash.NewFaker(), 10, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if gap, ok := chain.VerifyChainContiguity(0, 10); !ok {
+		t.Fatalf("unexpected gap at #%d", gap)
+	}
+	// Drop a body and a canonical hash, the first gap should be reported
+	rawdb.DeleteBody(db, chain.GetCanonicalHash(4), 4)
+	rawdb.DeleteCanonicalHash(db, 7)
+
+	if gap, ok := chain.VerifyChainContiguity(0, 10); ok || gap != 4 {
+		t.Errorf("gap mismatch: have #%d (ok %v), want #4", gap, ok)
+	}
+	if gap, ok := chain.VerifyChainContiguity(5, 10); ok || gap != 7 {
+		t.Errorf("gap mismatch: have #%d (ok %v), want #7", gap, ok)
+	}
+	if gap, ok := chain.VerifyChainContiguity(8, 10); !ok {
+		t.Errorf("unexpected gap at #%d", gap)
+	}
+}
+
+// Tests that conflicting headers signed by the same miner are detected by the
+// double sign monitor and posted as events.
+func TestDoubleSignEvent(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnableDoubleSignChecker(0))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	events := make(chan DoubleSignEvent, 1)
+	sub := chain.SubscribeDoubleSignEvent(events)
+	defer sub.Unsubscribe()
+
+	var (
+		signer = common.Address{0x01}
+		h1     = &types.Header{ParentHash: common.Hash{0x01}, Number: big.NewInt(1), Coinbase: signer, Difficulty: big.NewInt(2), Extra: []byte{0x01}}
+		h2     = &types.Header{ParentHash: common.Hash{0x01}, Number: big.NewInt(1), Coinbase: signer, Difficulty: big.NewInt(2), Extra: []byte{0x02}}
+	)
+	chain.chainHeadFeed.Send(ChainHeadEvent{Block: types.NewBlockWithHeader(h1)})
+	chain.chainHeadFeed.Send(ChainHeadEvent{Block: types.NewBlockWithHeader(h2)})
+
+	select {
+	case ev := <-events:
+		if ev.Signer != signer {
+			t.Errorf("signer mismatch: have %x, want %x", ev.Signer, signer)
+		}
+		if ev.Header1.Hash() != h2.Hash() || ev.Header2.Hash() != h1.Hash() {
+			t.Errorf("conflicting headers mismatch: have [%x, %x], want [%x, %x]", ev.Header1.Hash(), ev.Header2.Hash(), h2.Hash(), h1.Hash())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no double sign event")
+	}
+}
+
+// Tests that the double sign monitor cache size is validated and applied.
+func TestDoubleSignCheckerCacheSize(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	if _, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnableDoubleSignChecker(monitor.MinCacheHeader-1)); err == nil {
+		t.Fatal("expected error for a too small cache")
+	}
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil, EnableDoubleSignChecker(1000))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if size := chain.doubleSignMonitor.CacheSize(); size != 1000 {
+		t.Errorf("cache size mismatch: have %d, want 1000", size)
+	}
+}
+
+// Tests that blocks are retrieved in order for a mix of present and missing
+// numbers.
+func TestGetBlocksByNumbers(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 8, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	numbers := []uint64{5, 100, 0, 8, 5, 9, 2}
+	blocks := chain.GetBlocksByNumbers(numbers)
+	if len(blocks) != len(numbers) {
+		t.Fatalf("block count mismatch: have %d, want %d", len(blocks), len(numbers))
+	}
+	for i, number := range numbers {
+		want := chain.GetBlockByNumber(number)
+		switch {
+		case want == nil && blocks[i] != nil:
+			t.Errorf("block #%d: expected nil, have %x", number, blocks[i].Hash())
+		case want != nil && (blocks[i] == nil || blocks[i].Hash() != want.Hash()):
+			t.Errorf("block #%d: block mismatch: have %v, want %x", number, blocks[i], want.Hash())
+		}
+	}
+	if blocks := chain.GetBlocksByNumbers(nil); len(blocks) != 0 {
+		t.Errorf("expected no blocks, have %d", len(blocks))
+	}
+}
+
+// Tests that consecutive single block reorgs at the same height are tracked as
+// churn, while deeper reorgs reset the tracking.
+func TestReorgChurn(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	genDb, canon, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 2, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	side, _ := GenerateChain(gspec.Config, canon[0], ethash.NewFaker(), genDb, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x02})
+		b.OffsetTime(10)
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatalf("failed to insert canonical chain: %v", err)
+	}
+	if _, err := chain.InsertChain(side); err != nil {
+		t.Fatalf("failed to insert side chain: %v", err)
+	}
+	// Flip the head back and forth between the two blocks at height 2
+	for i, head := range []*types.Block{side[0], canon[1], side[0]} {
+		if err := chain.reorg(chain.CurrentBlock(), head); err != nil {
+			t.Fatalf("flip %d: failed to reorg: %v", i, err)
+		}
+		chain.writeHeadBlock(head)
+
+		if chain.reorgChurn != i+1 || chain.reorgChurnHeight != 2 {
+			t.Fatalf("flip %d: churn mismatch: have %d at #%d, want %d at #2", i, chain.reorgChurn, chain.reorgChurnHeight, i+1)
+		}
+	}
+	// A deeper reorg is not churn
+	fork, _ := GenerateChain(gspec.Config, chain.Genesis(), ethash.NewFaker(), genDb, 2, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x03})
+		b.OffsetTime(10)
+	})
+	if _, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	if err := chain.reorg(chain.CurrentBlock(), fork[1]); err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	if chain.reorgChurn != 0 {
+		t.Fatalf("churn not reset by deep reorg: %d", chain.reorgChurn)
+	}
+}
+
+// Tests that the bad block rewind interval defaults and is capped correctly.
+func TestRewindBadBlockInterval(t *testing.T) {
+	tests := []struct {
+		configured time.Duration
+		want       time.Duration
+	}{
+		{0, rewindBadBlockInterval},
+		{time.Millisecond, minRewindBadBlockInterval},
+		{minRewindBadBlockInterval, minRewindBadBlockInterval},
+		{5 * time.Second, 5 * time.Second},
+	}
+	for i, tt := range tests {
+		config := &CacheConfig{RewindBadBlockInterval: tt.configured}
+		if have := config.rewindBadBlockInterval(); have != tt.want {
+			t.Errorf("test %d: interval mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that the insertion state reflects interruptions and shutdowns.
+func TestInsertionEnabled(t *testing.T) {
+	for _, interrupt := range []bool{true, false} {
+		_, _, chain, err := newCanonical(ethash.NewFaker(), 0, true, rawdb.HashScheme, false)
+		if err != nil {
+			t.Fatalf("failed to create chain: %v", err)
+		}
+		if !chain.InsertionEnabled() {
+			t.Fatal("insertion disabled on a fresh chain")
+		}
+		if interrupt {
+			chain.StopInsert()
+		} else {
+			chain.Stop()
+		}
+		if chain.InsertionEnabled() {
+			t.Fatalf("insertion enabled after stop (interrupt %v)", interrupt)
+		}
+		chain.Stop()
+	}
+}
+
+// Tests that header segments honor the skip and direction, and stop at the ends
+// of the chain.
+func TestGetHeaderSegment(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 10, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	tests := []struct {
+		from    uint64
+		amount  int
+		skip    int
+		reverse bool
+		want    []uint64
+	}{
+		{2, 3, 0, false, []uint64{2, 3, 4}},
+		{1, 5, 2, false, []uint64{1, 4, 7, 10}},
+		{10, 3, 0, false, []uint64{10}},
+		{9, 10, 1, true, []uint64{9, 7, 5, 3, 1}},
+		{1, 3, 0, true, []uint64{1, 0}},
+		{5, 3, 10, true, []uint64{5}},
+		{5, 0, 0, false, nil},
+		{5, 3, -1, false, nil},
+	}
+	for i, tt := range tests {
+		headers := chain.GetHeaderSegment(chain.GetCanonicalHash(tt.from), tt.amount, tt.skip, tt.reverse)
+		var have []uint64
+		for _, header := range headers {
+			have = append(have, header.Number.Uint64())
+		}
+		if !slices.Equal(have, tt.want) {
+			t.Errorf("test %d: segment mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+	if headers := chain.GetHeaderSegment(common.Hash{0x01}, 3, 0, false); headers != nil {
+		t.Errorf("unknown origin returned %d headers", len(headers))
+	}
+}
+
+// Tests that missing canonical and stale side chain transaction lookup entries
+// are repaired.
+func TestRepairTxIndex(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	transfer := func(b *BlockGen, to common.Address) {
+		tx, err := types.SignTx(types.NewTransaction(b.TxNonce(address), to, big.NewInt(1000), params.TxGas, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+	}
+	genDb, canon, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, b *BlockGen) {
+		transfer(b, common.Address{0x01})
+	})
+	side, _ := GenerateChain(gspec.Config, canon[1], ethash.NewFaker(), genDb, 1, func(i int, b *BlockGen) {
+		b.OffsetTime(10)
+		transfer(b, common.Address{0x02})
+	})
+	db := rawdb.NewMemoryDatabase()
+	chain, err := NewBlockChain(db, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatalf("failed to insert canonical chain: %v", err)
+	}
+	if _, err := chain.InsertChain(side); err != nil {
+		t.Fatalf("failed to insert side chain: %v", err)
+	}
+	// Corrupt the index: drop a canonical entry and add a side chain one
+	dropped, stale := canon[0].Transactions()[0].Hash(), side[0].Transactions()[0].Hash()
+	rawdb.DeleteTxLookupEntry(db, dropped)
+	rawdb.WriteTxLookupEntries(db, 3, []common.Hash{stale})
+
+	fixed, err := chain.RepairTxIndex(0, 3)
+	if err != nil {
+		t.Fatalf("failed to repair tx index: %v", err)
+	}
+	if fixed != 2 {
+		t.Fatalf("fixed entries mismatch: have %d, want 2", fixed)
+	}
+	if entry := rawdb.ReadTxLookupEntry(db, dropped); entry == nil || *entry != 1 {
+		t.Fatalf("canonical entry not restored: %v", entry)
+	}
+	if entry := rawdb.ReadTxLookupEntry(db, stale); entry != nil {
+		t.Fatalf("stale entry not deleted: %d", *entry)
+	}
+	if fixed, err := chain.RepairTxIndex(0, 3); err != nil || fixed != 0 {
+		t.Fatalf("repaired index not clean: fixed %d, err %v", fixed, err)
+	}
+	if _, err := chain.RepairTxIndex(0, 4); err == nil {
+		t.Fatal("range beyond head accepted")
+	}
+}
+
+// Tests that the transaction lookup cache honors the configured size and is
+// purged on SetHead.
+func TestTxLookupCacheLimit(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, b *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{0x01}, big.NewInt(1000), params.TxGas, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.TxLookupCacheLimit = 2
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, block := range blocks {
+		if lookup, _, err := chain.GetTransactionLookup(block.Transactions()[0].Hash()); lookup == nil || err != nil {
+			t.Fatalf("block #%d: failed to look up tx: %v", block.NumberU64(), err)
+		}
+	}
+	if have := chain.txLookupCache.Len(); have != config.TxLookupCacheLimit {
+		t.Fatalf("cache size mismatch: have %d, want %d", have, config.TxLookupCacheLimit)
+	}
+	if err := chain.SetHead(1); err != nil {
+		t.Fatalf("failed to set head: %v", err)
+	}
+	if have := chain.txLookupCache.Len(); have != 0 {
+		t.Fatalf("cache not purged on SetHead: %d entries", have)
+	}
+}
+
+func TestInsertReceiptChainWithContext(t *testing.T) {
+	var (
+		gspec   = &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+		engine  = ethash.NewFaker()
+		genesis = gspec.ToBlock()
+	)
+	_, blocks, receipts := GenerateChainWithGenesis(gspec, engine, 32, func(i int, b *BlockGen) {})
+
+	db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), t.TempDir(), "", false, false, false, false)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	chain, err := NewBlockChain(db, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(headers); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	// A cancelled insertion should leave neither ancient nor live data behind
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := chain.InsertReceiptChainWithContext(ctx, blocks, receipts, uint64(len(blocks)/2)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error, want %v, have %v", context.Canceled, err)
+	}
+	if frozen, _ := db.Ancients(); frozen != 0 {
+		t.Fatalf("unexpected ancients after cancelled insert, have %d", frozen)
+	}
+	if head := chain.CurrentSnapBlock(); head.Hash() != genesis.Hash() {
+		t.Fatalf("snap block moved by cancelled insert, have #%d", head.Number)
+	}
+	// The legacy entrypoint should complete the same insertion
+	if n, err := chain.InsertReceiptChain(blocks, receipts, uint64(len(blocks)/2)); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
+	}
+	if head := chain.CurrentSnapBlock(); head.Hash() != blocks[len(blocks)-1].Hash() {
+		t.Fatalf("snap block mismatch, want #%d, have #%d", len(blocks), head.Number)
+	}
+}
+
+func TestExportHeaders(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 16, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if err := chain.ExportHeaders(new(bytes.Buffer), 5, 4); err == nil {
+		t.Fatal("expected error for inverted range")
+	}
+	if err := chain.ExportHeaders(new(bytes.Buffer), 10, 20); err == nil {
+		t.Fatal("expected error for missing headers")
+	}
+	var buf bytes.Buffer
+	if err := chain.ExportHeaders(&buf, 1, 16); err != nil {
+		t.Fatalf("failed to export headers: %v", err)
+	}
+	stream := rlp.NewStream(&buf, 0)
+	for nr := uint64(1); nr <= 16; nr++ {
+		var header types.Header
+		if err := stream.Decode(&header); err != nil {
+			t.Fatalf("failed to decode header #%d: %v", nr, err)
+		}
+		if header.Hash() != chain.GetCanonicalHash(nr) {
+			t.Fatalf("header #%d mismatch", nr)
+		}
+	}
+	if err := stream.Decode(new(types.Header)); err != io.EOF {
+		t.Fatalf("unexpected trailing data: %v", err)
+	}
+}
+
+func TestSnapshotVerifyStatus(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 4, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	verified, result, exists := chain.SnapshotVerifyStatus(chain.CurrentBlock().Root)
+	if !exists || !verified || !result {
+		t.Fatalf("unexpected head status: verified %v, result %v, exists %v", verified, result, exists)
+	}
+	if _, _, exists := chain.SnapshotVerifyStatus(common.Hash{0x1}); exists {
+		t.Fatal("unexpected snapshot for unknown root")
+	}
+	snaps := chain.snaps.Swap(nil)
+	if _, _, exists := chain.SnapshotVerifyStatus(chain.CurrentBlock().Root); exists {
+		t.Fatal("unexpected snapshot with snapshots disabled")
+	}
+	chain.snaps.Store(snaps)
+}
+
+func TestInsertStats(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 8, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{0x1}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if stats := chain.InsertStats(); stats != (InsertStatsSnapshot{}) {
+		t.Fatalf("unexpected stats before import: %+v", stats)
+	}
+	if _, err := chain.InsertChain(blocks[:4]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	stats := chain.InsertStats()
+	if stats.Processed != 8 {
+		t.Errorf("processed mismatch: have %d, want %d", stats.Processed, 8)
+	}
+	if stats.Ignored != 4 {
+		t.Errorf("ignored mismatch: have %d, want %d", stats.Ignored, 4)
+	}
+	if stats.UsedGas != 8*params.TxGas {
+		t.Errorf("used gas mismatch: have %d, want %d", stats.UsedGas, 8*params.TxGas)
+	}
+	if stats.InsertTime <= 0 || stats.AvgInsertTime != stats.InsertTime/8 {
+		t.Errorf("unexpected insert time: total %v, average %v", stats.InsertTime, stats.AvgInsertTime)
+	}
+}
+
+// bodySkippingValidator is a Validator accepting any block body.
+type bodySkippingValidator struct {
+	Validator
+}
+
+func (v bodySkippingValidator) ValidateBody(block *types.Block) error { return nil }
+
+func TestStrictBodyValidation(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 2, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{0x1}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	// Pair the header of the second block with the body of the first one
+	tampered := types.NewBlockWithHeader(blocks[1].Header()).WithBody(blocks[0].Transactions(), nil)
+	if err := checkBodyRoots(blocks[1]); err != nil {
+		t.Fatalf("unexpected error for valid body: %v", err)
+	}
+	if err := checkBodyRoots(tampered); err == nil {
+		t.Fatal("expected error for tampered body")
+	}
+	config := *defaultCacheConfig
+	config.StrictBodyValidation = true
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Skip the body validation of the validator to check the strict one alone
+	chain.SetBlockValidatorAndProcessorForTesting(bodySkippingValidator{chain.Validator()}, chain.Processor())
+	if n, err := chain.InsertChain(types.Blocks{blocks[0], tampered}); err == nil || n != 1 {
+		t.Fatalf("expected tampered block to be rejected, index %d, err %v", n, err)
+	}
+	if head := chain.CurrentBlock().Number.Uint64(); head != 1 {
+		t.Fatalf("unexpected head: have %d, want 1", head)
+	}
+}
+
+func TestGetTransactionLogs(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		emitter = common.HexToAddress("0xe1")
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: types.GenesisAlloc{
+				address: {Balance: big.NewInt(params.Ether)},
+				// PUSH1 0 PUSH1 0 LOG0
+				emitter: {Balance: common.Big0, Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0)}},
+			},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+		txs    []common.Hash
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 2, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), emitter, common.Big0, 50000, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+		txs = append(txs, tx.Hash())
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for i, hash := range txs {
+		logs, err := chain.GetTransactionLogs(hash)
+		if err != nil {
+			t.Fatalf("tx %d: failed to retrieve logs: %v", i, err)
+		}
+		if len(logs) != 1 {
+			t.Fatalf("tx %d: log count mismatch: have %d, want 1", i, len(logs))
+		}
+		if logs[0].Address != emitter || logs[0].TxHash != hash || logs[0].BlockHash != blocks[i].Hash() {
+			t.Fatalf("tx %d: unexpected log %+v", i, logs[0])
+		}
+	}
+	if _, err := chain.GetTransactionLogs(common.Hash{0x1}); !errors.Is(err, ErrTxNotFound) {
+		t.Fatalf("unexpected error for unknown tx: %v", err)
+	}
+}
+
+func TestJournalSnapshot(t *testing.T) {
+	db, _, chain, err := newCanonical(ethash.NewFaker(), 4, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.JournalSnapshot(); err != nil {
+		t.Fatalf("failed to journal snapshot: %v", err)
+	}
+	if len(rawdb.ReadSnapshotJournal(db)) == 0 {
+		t.Fatal("snapshot journal not written")
+	}
+	// Load the journal into a fresh snapshot tree
+	head := chain.CurrentBlock().Root
+	snaps, err := snapshot.New(snapshot.Config{CacheSize: 16, NoBuild: true}, db, chain.triedb, head, 128, false)
+	if err != nil {
+		t.Fatalf("failed to load snapshot journal: %v", err)
+	}
+	defer snaps.Release()
+	if snaps.Snapshot(head) == nil {
+		t.Fatal("head snapshot missing from the journal")
+	}
+
+	snapsBackup := chain.snaps.Swap(nil)
+	if _, err := chain.JournalSnapshot(); err == nil {
+		t.Fatal("expected error with snapshots disabled")
+	}
+	chain.snaps.Store(snapsBackup)
+}
+
+func TestRecentGasThroughput(t *testing.T) {
+	// Check the window arithmetic, including the wrap around
+	window := newGasWindow(2)
+	if perBlock, perSecond := window.throughput(); perBlock != 0 || perSecond != 0 {
+		t.Fatalf("unexpected throughput of empty window: %v, %v", perBlock, perSecond)
+	}
+	window.add(100, time.Second)
+	window.add(300, time.Second)
+	window.add(500, time.Second)
+	if perBlock, perSecond := window.throughput(); perBlock != 400 || perSecond != 400 {
+		t.Fatalf("throughput mismatch: have %v, %v, want 400, 400", perBlock, perSecond)
+	}
+	// Check the throughput measured on the imported blocks
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 8, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{0x1}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	config := *defaultCacheConfig
+	config.GasThroughputWindow = 4
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	perBlock, perSecond := chain.RecentGasThroughput()
+	if perBlock != float64(params.TxGas) {
+		t.Errorf("gas per block mismatch: have %v, want %v", perBlock, params.TxGas)
+	}
+	if perSecond <= 0 {
+		t.Errorf("unexpected gas per second: %v", perSecond)
+	}
+}
+
+// countingProcessor is a Processor counting the blocks processed by the
+// wrapped one.
+type countingProcessor struct {
+	Processor
+	count int
+}
+
+func (p *countingProcessor) Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	p.count++
+	return p.Processor.Process(block, statedb, cfg)
+}
+
+func TestSetProcessor(t *testing.T) {
+	genDb, _, chain, err := newCanonical(ethash.NewFaker(), 0, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	blocks := makeBlockChain(chain.chainConfig, chain.Genesis(), 8, ethash.NewFaker(), genDb, 0)
+
+	// Import half of the blocks with the swapped in processor
+	counter := &countingProcessor{Processor: chain.Processor()}
+	prev := chain.SetProcessor(counter)
+	if prev != counter.Processor {
+		t.Fatal("previous processor mismatch")
+	}
+	if _, err := chain.InsertChain(blocks[:4]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if counter.count != 4 {
+		t.Fatalf("processed block count mismatch: have %d, want 4", counter.count)
+	}
+	// Swap back and import the rest with the default processor
+	if chain.SetProcessor(prev) != counter {
+		t.Fatal("previous processor mismatch")
+	}
+	if _, err := chain.InsertChain(blocks[4:]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if counter.count != 4 {
+		t.Fatalf("swapped out processor still used, count %d", counter.count)
+	}
+	if head := chain.CurrentBlock().Number.Uint64(); head != 8 {
+		t.Fatalf("head mismatch: have %d, want 8", head)
+	}
+}
+
+// countingValidator is a Validator counting the block bodies validated by the
+// wrapped one, without a remote verify manager of its own.
+type countingValidator struct {
+	Validator
+	count int
+}
+
+func (v *countingValidator) ValidateBody(block *types.Block) error {
+	v.count++
+	return v.Validator.ValidateBody(block)
+}
+
+func (v *countingValidator) RemoteVerifyManager() *remoteVerifyManager { return nil }
+
+func TestSetValidator(t *testing.T) {
+	genDb, _, chain, err := newCanonical(ethash.NewFaker(), 0, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	blocks := makeBlockChain(chain.chainConfig, chain.Genesis(), 4, ethash.NewFaker(), genDb, 0)
+
+	// Simulate a validator set up by EnableBlockValidator
+	manager := new(remoteVerifyManager)
+	original := NewBlockValidator(chain.chainConfig, chain, chain.engine, EnableRemoteVerifyManager(manager))
+	chain.SetBlockValidatorAndProcessorForTesting(original, chain.Processor())
+
+	counter := &countingValidator{Validator: NewBlockValidator(chain.chainConfig, chain, chain.engine)}
+	if prev := chain.SetValidator(counter); prev != original {
+		t.Fatal("previous validator mismatch")
+	}
+	if chain.Validator().RemoteVerifyManager() != manager {
+		t.Fatal("remote verify manager lost after swapping the validator")
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if counter.count != len(blocks) {
+		t.Fatalf("validated block count mismatch: have %d, want %d", counter.count, len(blocks))
+	}
+	// Swap the original validator back
+	chain.SetValidator(original)
+	if chain.Validator() != original {
+		t.Fatal("original validator not restored")
+	}
+}
+
+func TestDereferenceRoots(t *testing.T) {
+	tdb := triedb.NewDatabase(rawdb.NewMemoryDatabase(), triedb.HashDefaults)
+	defer tdb.Close()
+
+	roots := make([]common.Hash, 0, 1024)
+	for i := 0; i < cap(roots); i++ {
+		tr := trie.NewEmpty(tdb)
+		tr.MustUpdate(common.Hash{byte(i), byte(i >> 8)}.Bytes(), []byte{0x1, byte(i)})
+		root, nodes, err := tr.Commit(false)
+		if err != nil {
+			t.Fatalf("failed to commit trie: %v", err)
+		}
+		if err := tdb.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("failed to update trie database: %v", err)
+		}
+		tdb.Reference(root, common.Hash{})
+		roots = append(roots, root)
+	}
+	if _, size, _, _ := tdb.Size(); size == 0 {
+		t.Fatal("no dirty trie nodes referenced")
+	}
+	dereferenceRoots(tdb, roots)
+	if _, size, _, _ := tdb.Size(); size != 0 {
+		t.Fatalf("dangling trie nodes after dereferencing all roots: %v", size)
+	}
+}
+
+// Tests that the configured shutdown commit offsets are committed regardless of
+// their order and the head marker is moved to the closest committed block.
+func TestShutdownCommitOffsets(t *testing.T) {
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		gspec = &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 10, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{byte(i + 1)})
+	})
+	config := *defaultCacheConfig
+	config.SnapshotLimit = 0
+	config.ShutdownCommitOffsets = []uint64{5, 100, 2, 5}
+	chain, err := NewBlockChain(db, &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	chain.Stop()
+
+	// Only the states at the configured offsets from the head are persisted
+	for i, block := range blocks {
+		want := block.NumberU64() == 8 || block.NumberU64() == 5
+		if have := rawdb.HasLegacyTrieNode(db, block.Root()); have != want {
+			t.Errorf("block %d: state persisted mismatch: have %v, want %v", i+1, have, want)
+		}
+	}
+	if head := rawdb.ReadHeadBlockHash(db); head != blocks[7].Hash() {
+		t.Errorf("head block mismatch: have %x, want %x", head, blocks[7].Hash())
+	}
+}
+
+func TestGetCommonAncestor(t *testing.T) {
+	var (
+		gspec  = &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+		engine = ethash.NewFaker()
+	)
+	genDb, blocks, _ := GenerateChainWithGenesis(gspec, engine, maxCommonAncestorDepth+8, func(i int, b *BlockGen) {})
+	forks, _ := GenerateChain(gspec.Config, blocks[4], engine, genDb, 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x1})
+		b.OffsetTime(10)
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := chain.InsertChain(forks); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	head := chain.CurrentBlock()
+
+	tests := []struct {
+		a, b common.Hash
+		want common.Hash // zero if an error is expected
+	}{
+		// Siblings on the two sides of the fork, in both orders
+		{blocks[9].Hash(), forks[2].Hash(), blocks[4].Hash()},
+		{forks[0].Hash(), blocks[5].Hash(), blocks[4].Hash()},
+		// Block and its ancestor, and the very same block
+		{blocks[9].Hash(), blocks[2].Hash(), blocks[2].Hash()},
+		{forks[1].Hash(), forks[1].Hash(), forks[1].Hash()},
+		// Chains not converging within the depth limit, or unknown blocks
+		{head.Hash(), chain.Genesis().Hash(), common.Hash{}},
+		{blocks[9].Hash(), common.Hash{0x1}, common.Hash{}},
+	}
+	for i, tt := range tests {
+		block, err := chain.GetCommonAncestor(tt.a, tt.b)
+		if tt.want == (common.Hash{}) {
+			if err == nil {
+				t.Errorf("test %d: expected error, got block #%d", i, block.NumberU64())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if block.Hash() != tt.want {
+			t.Errorf("test %d: ancestor mismatch: have #%d [%x], want %x", i, block.NumberU64(), block.Hash(), tt.want)
+		}
+	}
+	if chain.CurrentBlock().Hash() != head.Hash() {
+		t.Fatal("chain head changed")
+	}
+}
+
+func TestChainSideBatchEvent(t *testing.T) {
+	var (
+		gspec  = &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+		engine = ethash.NewFaker()
+	)
+	genDb, blocks, _ := GenerateChainWithGenesis(gspec, engine, 100, func(i int, b *BlockGen) {})
+	forks, _ := GenerateChain(gspec.Config, gspec.ToBlock(), engine, genDb, 100, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x1})
+		b.OffsetTime(10)
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := chain.InsertChain(forks); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	var (
+		sideCh  = make(chan ChainSideEvent, 2*len(blocks))
+		batchCh = make(chan ChainSideBatchEvent, 4)
+	)
+	sideSub := chain.SubscribeChainSideEvent(sideCh)
+	defer sideSub.Unsubscribe()
+	batchSub := chain.SubscribeChainSideBatchEvent(batchCh)
+	defer batchSub.Unsubscribe()
+
+	// Reorg out the whole canonical chain
+	if err := chain.reorg(chain.CurrentBlock(), forks[len(forks)-1]); err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	if len(sideCh) != len(blocks) {
+		t.Errorf("side event count mismatch: have %d, want %d", len(sideCh), len(blocks))
+	}
+	if len(batchCh) != 1 {
+		t.Fatalf("batch event count mismatch: have %d, want 1", len(batchCh))
+	}
+	batch := <-batchCh
+	if len(batch.Blocks) != len(blocks) {
+		t.Fatalf("batched block count mismatch: have %d, want %d", len(batch.Blocks), len(blocks))
+	}
+	for i, block := range batch.Blocks {
+		if block.Hash() != blocks[i].Hash() {
+			t.Fatalf("batched block %d mismatch", i)
+		}
+	}
+}
+
+func TestGetAllBlockHashesAtNumber(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	genDb, canon, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, b *BlockGen) {})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// Add two side blocks at height 2
+	for i := 0; i < 2; i++ {
+		side, _ := GenerateChain(gspec.Config, canon[0], ethash.NewFaker(), genDb, 1, func(j int, b *BlockGen) {
+			b.SetCoinbase(common.Address{byte(i + 1)})
+			b.OffsetTime(10)
+		})
+		if _, err := chain.InsertChain(side); err != nil {
+			t.Fatalf("failed to insert side block: %v", err)
+		}
+	}
+	hashes, canonical := chain.GetAllBlockHashesAtNumber(2)
+	if len(hashes) != 3 {
+		t.Fatalf("hash count mismatch: have %d, want 3", len(hashes))
+	}
+	if canonical < 0 || hashes[canonical] != canon[1].Hash() {
+		t.Fatalf("canonical hash mismatch: index %d, hashes %v, want %x", canonical, hashes, canon[1].Hash())
+	}
+	if hashes, canonical := chain.GetAllBlockHashesAtNumber(3); len(hashes) != 1 || canonical != 0 || hashes[0] != canon[2].Hash() {
+		t.Fatalf("unexpected hashes at head: %v, canonical %d", hashes, canonical)
+	}
+	if hashes, canonical := chain.GetAllBlockHashesAtNumber(4); hashes == nil || len(hashes) != 0 || canonical != -1 {
+		t.Fatalf("expected empty slice beyond head, have %v, canonical %d", hashes, canonical)
+	}
+}
+
+// Tests that the receipts cache honors the configured size and is purged on
+// SetHead.
+func TestReceiptsCacheLimit(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, b *BlockGen) {})
+
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.ReceiptsCacheLimit = 2
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, block := range blocks {
+		chain.GetReceiptsByHash(block.Hash())
+	}
+	if have := chain.receiptsCache.Len(); have != config.ReceiptsCacheLimit {
+		t.Fatalf("cache size mismatch: have %d, want %d", have, config.ReceiptsCacheLimit)
+	}
+	if err := chain.SetHead(1); err != nil {
+		t.Fatalf("failed to set head: %v", err)
+	}
+	if have := chain.receiptsCache.Len(); have != 0 {
+		t.Fatalf("cache not purged on SetHead: %d entries", have)
+	}
+}
+
+// Tests that on a reorg the removed logs are delivered before the logs of the
+// new canonical chain.
+func TestRemovedLogsOrdering(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		emitter = common.HexToAddress("0xe1")
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: types.GenesisAlloc{
+				address: {Balance: big.NewInt(params.Ether)},
+				// PUSH1 0 PUSH1 0 LOG0
+				emitter: {Balance: common.Big0, Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0)}},
+			},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	emit := func(b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), emitter, common.Big0, 50000, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	}
+	genDb, canon, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 1, func(i int, b *BlockGen) {
+		b.OffsetTime(10)
+		emit(b)
+	})
+	fork, _ := GenerateChain(gspec.Config, gspec.ToBlock(), ethash.NewFaker(), genDb, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x1})
+		emit(b)
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// Funnel both feeds into a single ordered stream, the unbuffered channels
+	// make the feeds wait for the events to be taken in order.
+	var (
+		rmLogsCh = make(chan RemovedLogsEvent)
+		logsCh   = make(chan []*types.Log)
+		events   = make(chan interface{}, 16)
+		quit     = make(chan struct{})
+	)
+	rmSub := chain.SubscribeRemovedLogsEvent(rmLogsCh)
+	defer rmSub.Unsubscribe()
+	logsSub := chain.SubscribeLogsEvent(logsCh)
+	defer logsSub.Unsubscribe()
+	go func() {
+		for {
+			select {
+			case ev := <-rmLogsCh:
+				events <- ev
+			case logs := <-logsCh:
+				events <- logs
+			case <-quit:
+				return
+			}
+		}
+	}()
+	if _, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	defer close(quit)
+	if chain.CurrentBlock().Hash() != fork[0].Hash() {
+		t.Fatal("fork not canonical")
+	}
+	next := func() interface{} {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for log event")
+			return nil
+		}
+	}
+	removed, ok := next().(RemovedLogsEvent)
+	if !ok {
+		t.Fatal("removed logs not delivered first")
+	}
+	if len(removed.Logs) != 1 || !removed.Logs[0].Removed || removed.Logs[0].BlockHash != canon[0].Hash() {
+		t.Fatalf("unexpected removed logs: %v", removed.Logs)
+	}
+	logs, ok := next().([]*types.Log)
+	if !ok {
+		t.Fatal("new logs not delivered after the removed ones")
+	}
+	if len(logs) != 1 || logs[0].Removed || logs[0].BlockHash != fork[0].Hash() {
+		t.Fatalf("unexpected new logs: %v", logs)
+	}
+}
+
+func TestGetBlockByTimestamp(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee), Timestamp: 1000}
+	// Blocks #2, #3 and #4 share the same timestamp
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFullFaker(), 6, func(i int, b *BlockGen) {
+		if i == 2 || i == 3 {
+			b.header.Time = b.parent.Time()
+		}
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFullFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	tests := []struct {
+		timestamp uint64
+		want      uint64
+	}{
+		{0, 0},                       // before genesis
+		{1000, 0},                    // exactly genesis
+		{blocks[0].Time() - 1, 0},    // between genesis and #1
+		{blocks[0].Time(), 1},        // exactly #1
+		{blocks[1].Time(), 4},        // duplicate timestamps, highest wins
+		{blocks[4].Time() - 1, 4},    // between #4 and #5
+		{blocks[5].Time(), 6},        // exactly head
+		{blocks[5].Time() + 1000, 6}, // after head
+	}
+	for i, tt := range tests {
+		block, err := chain.GetBlockByTimestamp(tt.timestamp)
+		if err != nil {
+			t.Fatalf("test %d: failed to get block: %v", i, err)
+		}
+		if block.NumberU64() != tt.want {
+			t.Errorf("test %d: block mismatch for timestamp %d: have #%d, want #%d", i, tt.timestamp, block.NumberU64(), tt.want)
+		}
+	}
+}
+
+func TestToggleSnapshot(t *testing.T) {
+	genDb, _, chain, err := newCanonical(ethash.NewFaker(), 4, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if err := chain.DisableSnapshot(); err != nil {
+		t.Fatalf("failed to disable snapshot: %v", err)
+	}
+	if chain.snaps.Load() != nil {
+		t.Fatal("snapshot still enabled")
+	}
+	if err := chain.DisableSnapshot(); err != nil {
+		t.Fatalf("failed to disable snapshot twice: %v", err)
+	}
+	// Blocks must be importable trie-only
+	blocks := makeBlockChain(chain.chainConfig, chain.GetBlockByHash(chain.CurrentBlock().Hash()), 2, ethash.NewFaker(), genDb, forkSeed1)
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert blocks without snapshot: %v", err)
+	}
+	if _, err := chain.State(); err != nil {
+		t.Fatalf("failed to open head state without snapshot: %v", err)
+	}
+	// Re-enable the snapshot and wait for it to be rebuilt against the new head
+	chain.cacheConfig.SnapshotWait = true
+	if err := chain.EnableSnapshot(); err != nil {
+		t.Fatalf("failed to enable snapshot: %v", err)
+	}
+	head := chain.CurrentBlock().Root
+	if chain.Snapshots() == nil || chain.Snapshots().Snapshot(head) == nil {
+		t.Fatal("head snapshot missing after enabling")
+	}
+	if err := chain.EnableSnapshot(); err != nil {
+		t.Fatalf("failed to enable snapshot twice: %v", err)
+	}
+	blocks = makeBlockChain(chain.chainConfig, chain.GetBlockByHash(chain.CurrentBlock().Hash()), 2, ethash.NewFaker(), genDb, forkSeed1)
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert blocks with snapshot: %v", err)
+	}
+	if chain.Snapshots().Snapshot(chain.CurrentBlock().Root) == nil {
+		t.Fatal("snapshot not maintained after enabling")
+	}
+}
+
+func TestResetToBlock(t *testing.T) {
+	genDb, _, chain, err := newCanonical(ethash.NewFaker(), 8, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Side blocks are refused
+	fork := makeBlockChain(chain.chainConfig, chain.Genesis(), 2, ethash.NewFaker(), genDb, forkSeed1)
+	if _, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	if err := chain.ResetToBlock(fork[1].Hash()); !errors.Is(err, ErrResetNotCanonical) {
+		t.Fatalf("side block reset error mismatch: have %v, want %v", err, ErrResetNotCanonical)
+	}
+	// Blocks without state are refused
+	stateless := chain.GetBlockByNumber(2)
+	chain.triedb.Dereference(stateless.Root())
+	if err := chain.ResetToBlock(stateless.Hash()); !errors.Is(err, ErrResetNoState) {
+		t.Fatalf("stateless block reset error mismatch: have %v, want %v", err, ErrResetNoState)
+	}
+	if err := chain.ResetToBlock(common.Hash{0x1}); err == nil {
+		t.Fatal("expected error resetting to an unknown block")
+	}
+	if head := chain.CurrentBlock().Number.Uint64(); head != 8 {
+		t.Fatalf("head moved by refused resets: have %d, want 8", head)
+	}
+	// Canonical blocks with state are accepted
+	target := chain.GetBlockByNumber(5)
+	if err := chain.ResetToBlock(target.Hash()); err != nil {
+		t.Fatalf("failed to reset to canonical block: %v", err)
+	}
+	if head := chain.CurrentBlock(); head.Hash() != target.Hash() {
+		t.Fatalf("head mismatch: have #%d, want #%d", head.Number, target.Number())
+	}
+	if chain.GetBlockByNumber(6) != nil {
+		t.Fatal("blocks above the reset target still canonical")
+	}
+	if err := chain.ResetToBlock(target.Hash()); !errors.Is(err, ErrSetHeadNoRewind) {
+		t.Fatalf("head reset error mismatch: have %v, want %v", err, ErrSetHeadNoRewind)
+	}
+}
+
+func TestHeadHooks(t *testing.T) {
+	genDb, _, chain, err := newCanonical(ethash.NewFaker(), 0, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	var calls []string
+	unregisterA := chain.RegisterHeadHook(func(block *types.Block) {
+		calls = append(calls, fmt.Sprintf("a%d", block.NumberU64()))
+	})
+	unregisterB := chain.RegisterHeadHook(func(block *types.Block) {
+		// The head must already be updated when the hooks run
+		if head := chain.CurrentBlock().Hash(); head != block.Hash() {
+			t.Errorf("hook invoked before head update: head %x, block %x", head, block.Hash())
+		}
+		calls = append(calls, fmt.Sprintf("b%d", block.NumberU64()))
+	})
+	defer unregisterB()
+
+	blocks := makeBlockChain(chain.chainConfig, chain.Genesis(), 4, ethash.NewFaker(), genDb, canonicalSeed)
+	if _, err := chain.InsertChain(blocks[:2]); err != nil {
+		t.Fatalf("failed to insert blocks: %v", err)
+	}
+	unregisterA()
+	unregisterA() // must be idempotent
+	if _, err := chain.InsertChain(blocks[2:]); err != nil {
+		t.Fatalf("failed to insert blocks: %v", err)
+	}
+	want := []string{"a1", "b1", "a2", "b2", "b3", "b4"}
+	if !slices.Equal(calls, want) {
+		t.Fatalf("hook calls mismatch: have %v, want %v", calls, want)
+	}
+}
+
+func TestPreimageFilter(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		hasher  = common.HexToAddress("0xaa")
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: types.GenesisAlloc{
+				address: {Balance: big.NewInt(params.Ether)},
+				// Hash the single byte preimages 0x01 and 0x02
+				hasher: {Balance: common.Big0, Code: []byte{
+					byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.MSTORE8),
+					byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.KECCAK256), byte(vm.POP),
+					byte(vm.PUSH1), 2, byte(vm.PUSH1), 0, byte(vm.MSTORE8),
+					byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.KECCAK256), byte(vm.POP),
+				}},
+			},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 1, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), hasher, common.Big0, 50000, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.PreimageFilter = func(preimage []byte) bool {
+		return bytes.Equal(preimage, []byte{0x01})
+	}
+	chain, err := NewBlockChain(db, config, gspec, nil, ethash.NewFaker(), vm.Config{EnablePreimageRecording: true}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if preimage := rawdb.ReadPreimage(db, crypto.Keccak256Hash([]byte{0x01})); !bytes.Equal(preimage, []byte{0x01}) {
+		t.Fatalf("accepted preimage mismatch: have %x, want 01", preimage)
+	}
+	if preimage := rawdb.ReadPreimage(db, crypto.Keccak256Hash([]byte{0x02})); preimage != nil {
+		t.Fatalf("rejected preimage stored: %x", preimage)
+	}
+}
+
+func TestReorgReexecStats(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := &Genesis{
+		Config:  params.TestChainConfig,
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	genDb, shared, _ := GenerateChainWithGenesis(genesis, engine, 1, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{1}) })
+	original, _ := GenerateChain(genesis.Config, shared[0], engine, genDb, 2*TriesInMemory, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{2}) })
+	competitor, _ := GenerateChain(genesis.Config, shared[0], engine, genDb, 2*TriesInMemory+1, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{3}) })
+
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), DefaultCacheConfigWithScheme(rawdb.HashScheme), genesis, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(append(shared, original...)); err != nil {
+		t.Fatalf("failed to insert original chain: %v", err)
+	}
+	if _, err := chain.InsertChain(competitor[:len(competitor)-2]); err != nil {
+		t.Fatalf("failed to insert competitor chain: %v", err)
+	}
+	if stats := chain.LastReorgReexecStats(); stats != (ReorgReexecStats{}) {
+		t.Fatalf("unexpected re-execution without reorg: %+v", stats)
+	}
+	// Reorg onto the competitor, re-executing it all with the pruned shared block
+	if _, err := chain.InsertChain(competitor[len(competitor)-2:]); err != nil {
+		t.Fatalf("failed to finalize competitor chain: %v", err)
+	}
+	stats := chain.LastReorgReexecStats()
+	if want := len(competitor) + 1; stats.Blocks != want {
+		t.Fatalf("re-executed blocks mismatch: have %d, want %d", stats.Blocks, want)
+	}
+	if stats.Time <= 0 {
+		t.Fatalf("re-execution time not measured: %v", stats.Time)
+	}
+}
+
+func TestGetReceiptsByNumber(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+		engine = ethash.NewFaker()
+	)
+	_, blocks, receipts := GenerateChainWithGenesis(gspec, engine, 8, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{0xaa}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), t.TempDir(), "", false, false, false, false)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	chain, err := NewBlockChain(db, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Import the first half of the blocks into the freezer, the rest into the live db
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(headers); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if n, err := chain.InsertReceiptChain(blocks, receipts, uint64(len(blocks)/2)); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
+	}
+	if frozen, _ := db.Ancients(); frozen == 0 || frozen > uint64(len(blocks)) {
+		t.Fatalf("unexpected number of ancients: %d", frozen)
+	}
+	for i, block := range blocks {
+		have, err := chain.GetReceiptsByNumber(block.NumberU64())
+		if err != nil {
+			t.Fatalf("block #%d: failed to get receipts: %v", block.NumberU64(), err)
+		}
+		if len(have) != len(receipts[i]) {
+			t.Fatalf("block #%d: receipt count mismatch: have %d, want %d", block.NumberU64(), len(have), len(receipts[i]))
+		}
+		for j, receipt := range have {
+			if receipt.TxHash != receipts[i][j].TxHash || receipt.BlockHash != block.Hash() {
+				t.Fatalf("block #%d: receipt %d mismatch", block.NumberU64(), j)
+			}
+		}
+		// The by-hash accessor must agree
+		if byHash := chain.GetReceiptsByHash(block.Hash()); len(byHash) != len(have) || byHash[0].TxHash != have[0].TxHash {
+			t.Fatalf("block #%d: by-hash receipts mismatch", block.NumberU64())
+		}
+	}
+	if _, err := chain.GetReceiptsByNumber(uint64(len(blocks) + 1)); err == nil {
+		t.Fatal("expected error for block above the head")
+	}
+}
+
+func TestVerifyStateRoots(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 8, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Drop the state of a block from the trie cache
+	chain.triedb.Dereference(chain.GetBlockByNumber(2).Root())
+
+	results, err := chain.VerifyStateRoots([]uint64{0, 2, 5, 8})
+	if err != nil {
+		t.Fatalf("failed to verify state roots: %v", err)
+	}
+	want := map[uint64]bool{0: true, 2: false, 5: true, 8: true}
+	for number, ok := range want {
+		if results[number] != ok {
+			t.Errorf("block #%d: verification mismatch: have %v, want %v", number, results[number], ok)
+		}
+	}
+	if _, err := chain.VerifyStateRoots([]uint64{9}); err == nil {
+		t.Fatal("expected error for block above the head")
+	}
+}
+
+func TestGetBlockNumber(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 4, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	for i := uint64(0); i <= 4; i++ {
+		hash := chain.GetCanonicalHash(i)
+		if number := chain.GetBlockNumber(hash); number == nil || *number != i {
+			t.Fatalf("block #%d: number mismatch: have %v", i, number)
+		}
+	}
+	if number := chain.GetBlockNumber(common.Hash{0x1}); number != nil {
+		t.Fatalf("unexpected number for unknown hash: %d", *number)
+	}
+}
+
+// gasUnderreportingProcessor reports one gas less than used by the blocks.
+type gasUnderreportingProcessor struct {
+	Processor
+}
+
+func (p gasUnderreportingProcessor) Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (*state.StateDB, types.Receipts, []*types.Log, uint64, error) {
+	statedb, receipts, logs, usedGas, err := p.Processor.Process(block, statedb, cfg)
+	return statedb, receipts, logs, usedGas - 1, err
+}
+
+// stateSkippingValidator accepts the state of every block.
+type stateSkippingValidator struct {
+	Validator
+}
+
+func (v stateSkippingValidator) ValidateState(block *types.Block, state *state.StateDB, receipts types.Receipts, usedGas uint64) error {
+	return nil
+}
+
+func TestStrictGasValidation(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 2, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{0x1}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	for _, strict := range []bool{false, true} {
+		config := *defaultCacheConfig
+		config.StrictGasValidation = strict
+		chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create chain: %v", err)
+		}
+		// Skip the state validation of the validator to check the strict one alone
+		chain.SetProcessor(gasUnderreportingProcessor{chain.Processor()})
+		chain.SetValidator(stateSkippingValidator{chain.Validator()})
+
+		n, err := chain.InsertChain(blocks)
+		switch {
+		case strict && (err == nil || n != 0):
+			t.Errorf("expected gas mismatch to be rejected, index %d, err %v", n, err)
+		case !strict && err != nil:
+			t.Errorf("unexpected error without strict validation: %v", err)
+		}
+		chain.Stop()
+	}
+}
+
+func TestFeedStats(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 0, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Compare against the subscriptions of the chain internals
+	base := chain.FeedStats()
+
+	headSub1 := chain.SubscribeChainHeadEvent(make(chan ChainHeadEvent))
+	headSub2 := chain.SubscribeChainHeadEvent(make(chan ChainHeadEvent))
+	logsSub := chain.SubscribeLogsEvent(make(chan []*types.Log))
+
+	if stats := chain.FeedStats(); stats["chainHead"] != base["chainHead"]+2 || stats["logs"] != base["logs"]+1 {
+		t.Fatalf("unexpected feed stats: %v", stats)
+	}
+	headSub1.Unsubscribe()
+	headSub1.Unsubscribe() // must not be counted twice
+	if stats := chain.FeedStats(); stats["chainHead"] != base["chainHead"]+1 || stats["logs"] != base["logs"]+1 {
+		t.Fatalf("unexpected feed stats after unsubscribe: %v", stats)
+	}
+	headSub2.Unsubscribe()
+	logsSub.Unsubscribe()
+	if stats := chain.FeedStats(); stats["chainHead"] != base["chainHead"] || stats["logs"] != base["logs"] {
+		t.Fatalf("unexpected feed stats after unsubscribing all: %v", stats)
+	}
+}
+
+func TestBlockAndBodyCacheLimits(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 6, func(i int, b *BlockGen) {})
+
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.BlockCacheLimit = 2
+	config.BodyCacheLimit = 3
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, block := range blocks {
+		chain.GetBlockByHash(block.Hash())
+		chain.GetBody(block.Hash())
+	}
+	if have := chain.blockCache.Len(); have != config.BlockCacheLimit {
+		t.Fatalf("block cache size mismatch: have %d, want %d", have, config.BlockCacheLimit)
+	}
+	if have := chain.bodyCache.Len(); have != config.BodyCacheLimit {
+		t.Fatalf("body cache size mismatch: have %d, want %d", have, config.BodyCacheLimit)
+	}
+	if err := chain.SetHead(1); err != nil {
+		t.Fatalf("failed to set head: %v", err)
+	}
+	if blocks, bodies := chain.blockCache.Len(), chain.bodyCache.Len(); blocks != 0 || bodies != 0 {
+		t.Fatalf("caches not purged on SetHead: %d blocks, %d bodies", blocks, bodies)
+	}
+}
+
+func TestChainMuHeldDuration(t *testing.T) {
+	genDb, _, chain, err := newCanonical(ethash.NewFaker(), 0, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if held := chain.ChainMuHeldDuration(); held != 0 {
+		t.Fatalf("unexpected hold time of idle chain: %v", held)
+	}
+	// Head hooks run while the chain mutex is held
+	var held time.Duration
+	unregister := chain.RegisterHeadHook(func(block *types.Block) {
+		time.Sleep(time.Millisecond)
+		held = chain.ChainMuHeldDuration()
+	})
+	blocks := makeBlockChain(chain.chainConfig, chain.Genesis(), 1, ethash.NewFaker(), genDb, canonicalSeed)
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	unregister()
+	if held < time.Millisecond {
+		t.Fatalf("hold time during insertion too low: %v", held)
+	}
+	if held := chain.ChainMuHeldDuration(); held != 0 {
+		t.Fatalf("unexpected hold time after insertion: %v", held)
+	}
+	chain.Stop()
+	if err := chain.SetHead(0); !errors.Is(err, errChainStopped) {
+		t.Fatalf("unexpected error on stopped chain: have %v, want %v", err, errChainStopped)
+	}
+}
+
+func TestGetBlockWithReceipts(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		emitter = common.HexToAddress("0xe1")
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: types.GenesisAlloc{
+				address: {Balance: big.NewInt(params.Ether)},
+				// PUSH1 0 PUSH1 0 LOG0
+				emitter: {Balance: common.Big0, Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0)}},
+			},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), emitter, common.Big0, 50000, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, want := range blocks {
+		block, receipts, err := chain.GetBlockWithReceipts(want.Hash())
+		if err != nil {
+			t.Fatalf("block #%d: failed to get block with receipts: %v", want.NumberU64(), err)
+		}
+		if block.Hash() != chain.GetBlockByHash(want.Hash()).Hash() {
+			t.Fatalf("block #%d: block mismatch", want.NumberU64())
+		}
+		separate := chain.GetReceiptsByHash(want.Hash())
+		if len(receipts) != len(separate) || len(receipts) != 1 {
+			t.Fatalf("block #%d: receipt count mismatch: have %d, want %d", want.NumberU64(), len(receipts), len(separate))
+		}
+		if receipts[0].TxHash != separate[0].TxHash || len(receipts[0].Logs) != 1 || receipts[0].Logs[0].BlockHash != want.Hash() {
+			t.Fatalf("block #%d: receipt mismatch", want.NumberU64())
+		}
+	}
+	if _, _, err := chain.GetBlockWithReceipts(common.Hash{0x1}); err == nil {
+		t.Fatal("expected error for unknown block")
+	}
+	// System transaction logs missing the block hash are fixed on a copy
+	hash := common.Hash{0x2}
+	broken := types.Receipts{{Logs: []*types.Log{{}}}}
+	fixed := withSystemLogsBlockHash(broken, hash)
+	if fixed[0].Logs[0].BlockHash != hash {
+		t.Fatal("system log block hash not fixed")
+	}
+	if broken[0].Logs[0].BlockHash != (common.Hash{}) {
+		t.Fatal("original receipts modified")
+	}
+}
+
+func TestSnapSyncCommitHeadVerified(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x1})
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{byte(0x10 + i)}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	// Keep all the tries on disk and none in the clean cache, so they can be tampered with
+	db := rawdb.NewMemoryDatabase()
+	config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+	config.TrieCleanLimit = 0
+	config.TrieDirtyDisabled = true
+	chain, err := NewBlockChain(db, config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// Committing an intact state succeeds
+	if err := chain.SnapSyncCommitHeadVerified(blocks[2].Hash(), 10*time.Second); err != nil {
+		t.Fatalf("failed to commit verified head: %v", err)
+	}
+	if head := chain.CurrentBlock().Hash(); head != blocks[2].Hash() {
+		t.Fatalf("head mismatch: have %x, want %x", head, blocks[2].Hash())
+	}
+	// Drop a trie node only referenced by the state of the last block
+	nodes := func(root common.Hash) map[common.Hash]struct{} {
+		tr, err := chain.stateCache.OpenTrie(root)
+		if err != nil {
+			t.Fatalf("failed to open trie: %v", err)
+		}
+		it, err := tr.NodeIterator(nil)
+		if err != nil {
+			t.Fatalf("failed to iterate trie: %v", err)
+		}
+		hashes := make(map[common.Hash]struct{})
+		for it.Next(true) {
+			if hash := it.Hash(); hash != (common.Hash{}) && hash != root {
+				hashes[hash] = struct{}{}
+			}
+		}
+		return hashes
+	}
+	shared := nodes(blocks[2].Root())
+	var dropped bool
+	for hash := range nodes(blocks[3].Root()) {
+		if _, ok := shared[hash]; !ok {
+			rawdb.DeleteLegacyTrieNode(db, hash)
+			dropped = true
+			break
+		}
+	}
+	if !dropped {
+		t.Fatal("no trie node unique to the last block")
+	}
+	// Committing the tampered state fails and restores the previous head
+	if err := chain.SnapSyncCommitHeadVerified(blocks[3].Hash(), 2*time.Second); err == nil {
+		t.Fatal("expected verification failure for tampered state")
+	}
+	if head := chain.CurrentBlock().Hash(); head != blocks[2].Hash() {
+		t.Fatalf("head not restored: have %x, want %x", head, blocks[2].Hash())
+	}
+}
+
+func TestSeedHighestVerifiedHeader(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 4, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Start from a clean slate, as the import tracks the verified headers too
+	chain.highestVerifiedHeader.Store(nil)
+
+	high, low := chain.GetHeaderByNumber(3), chain.GetHeaderByNumber(2)
+	if err := chain.SeedHighestVerifiedHeader(high); err != nil {
+		t.Fatalf("failed to seed header: %v", err)
+	}
+	if err := chain.SeedHighestVerifiedHeader(low); err != nil {
+		t.Fatalf("failed to seed header: %v", err)
+	}
+	if have := chain.GetHighestVerifiedHeader(); have.Hash() != high.Hash() {
+		t.Fatalf("lower header overrode the higher one: have #%d, want #%d", have.Number, high.Number)
+	}
+	if err := chain.SeedHighestVerifiedHeader(chain.GetHeaderByNumber(4)); err != nil {
+		t.Fatalf("failed to seed header: %v", err)
+	}
+	if have := chain.GetHighestVerifiedHeader(); have.Number.Uint64() != 4 {
+		t.Fatalf("higher header not taken: have #%d, want #4", have.Number)
+	}
+	unknown := types.CopyHeader(high)
+	unknown.Extra = []byte("unknown")
+	if err := chain.SeedHighestVerifiedHeader(unknown); err == nil {
+		t.Fatal("expected error for unknown header")
+	}
+}
+
+func TestSafePointBlockNumber(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 4, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if number := chain.SafePointBlockNumber(); number != 0 {
+		t.Fatalf("safe point mismatch: have %d, want %d", number, 0)
+	}
+	rawdb.WriteSafePointBlockNumber(chain.db, 3)
+	if number := chain.SafePointBlockNumber(); number != 3 {
+		t.Fatalf("safe point mismatch: have %d, want %d", number, 3)
+	}
+}
+
+func TestInsertChainNoReorg(t *testing.T) {
+	genDb, _, chain, err := newCanonical(ethash.NewFaker(), 5, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Batches extending the head are imported
+	extend := makeBlockChain(chain.chainConfig, chain.GetBlockByHash(chain.CurrentBlock().Hash()), 3, ethash.NewFaker(), genDb, canonicalSeed)
+	if n, err := chain.InsertChainNoReorg(extend); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if head := chain.CurrentBlock().Hash(); head != extend[len(extend)-1].Hash() {
+		t.Fatalf("head mismatch: have %x, want %x", head, extend[len(extend)-1].Hash())
+	}
+	// Lighter side chains are imported without becoming canonical
+	side := makeBlockChain(chain.chainConfig, chain.GetBlockByNumber(5), 1, ethash.NewFaker(), genDb, forkSeed1)
+	if n, err := chain.InsertChainNoReorg(side); err != nil {
+		t.Fatalf("failed to insert side block %d: %v", n, err)
+	}
+	if !chain.HasBlock(side[0].Hash(), side[0].NumberU64()) {
+		t.Fatal("side block not imported")
+	}
+	if head := chain.CurrentBlock().Hash(); head != extend[len(extend)-1].Hash() {
+		t.Fatalf("head changed by side chain: have %x, want %x", head, extend[len(extend)-1].Hash())
+	}
+	// Heavier forks are rejected as a whole
+	head := chain.CurrentBlock()
+	fork := makeBlockChain(chain.chainConfig, chain.GetBlockByNumber(3), 10, ethash.NewFaker(), genDb, forkSeed1)
+	if _, err := chain.InsertChainNoReorg(fork); !errors.Is(err, ErrReorgRejected) {
+		t.Fatalf("error mismatch: have %v, want %v", err, ErrReorgRejected)
+	}
+	if chain.CurrentBlock().Hash() != head.Hash() {
+		t.Fatal("head changed by rejected fork")
+	}
+	for _, block := range fork {
+		if chain.HasBlock(block.Hash(), block.NumberU64()) {
+			t.Fatalf("block #%d of rejected fork written", block.NumberU64())
+		}
+	}
+	// The same fork is still accepted by a regular import
+	if n, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork block %d: %v", n, err)
+	}
+	if head := chain.CurrentBlock().Hash(); head != fork[len(fork)-1].Hash() {
+		t.Fatalf("head mismatch: have %x, want %x", head, fork[len(fork)-1].Hash())
+	}
+}
+
+func TestRetainOrphanReceipts(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr   = crypto.PubkeyToAddress(key.PublicKey)
+		gspec  = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   GenesisAlloc{addr: {Balance: big.NewInt(params.Ether)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	makeChain := func(n int, recipient common.Address) []*types.Block {
+		_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), n, func(i int, gen *BlockGen) {
+			tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(addr), recipient, big.NewInt(1), params.TxGas, gen.BaseFee(), nil), signer, key)
+			gen.AddTx(tx)
+		})
+		return blocks
+	}
+	orphans, canon := makeChain(3, common.Address{0x1}), makeChain(4, common.Address{0x2})
+
+	for _, retain := range []bool{false, true} {
+		config := DefaultCacheConfigWithScheme(rawdb.HashScheme)
+		config.RetainOrphanReceipts = retain
+		chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create chain: %v", err)
+		}
+		if _, err := chain.InsertChain(orphans); err != nil {
+			t.Fatalf("failed to insert orphaned chain: %v", err)
+		}
+		if _, err := chain.InsertChain(canon); err != nil {
+			t.Fatalf("failed to insert canonical chain: %v", err)
+		}
+		if head := chain.CurrentBlock().Hash(); head != canon[len(canon)-1].Hash() {
+			t.Fatalf("retain %v: head mismatch: have %x, want %x", retain, head, canon[len(canon)-1].Hash())
+		}
+		for _, block := range orphans {
+			receipts := chain.GetOrphanReceipts(block.Hash())
+			if !retain {
+				if receipts != nil {
+					t.Fatalf("block #%d: orphan receipts retained when disabled", block.NumberU64())
+				}
+				continue
+			}
+			if len(receipts) != 1 {
+				t.Fatalf("block #%d: orphan receipt count mismatch: have %d, want 1", block.NumberU64(), len(receipts))
+			}
+			if receipts[0].Status != types.ReceiptStatusSuccessful || receipts[0].CumulativeGasUsed != params.TxGas {
+				t.Fatalf("block #%d: orphan receipt mismatch: %+v", block.NumberU64(), receipts[0])
+			}
+		}
+		for _, block := range canon {
+			if receipts := chain.GetOrphanReceipts(block.Hash()); receipts != nil {
+				t.Fatalf("block #%d: canonical block receipts retained as orphans", block.NumberU64())
+			}
+		}
+		chain.Stop()
+	}
+}
+
+func TestGetHeadersByHashes(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 4, true, rawdb.HashScheme, false)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	hashes := []common.Hash{
+		chain.GetCanonicalHash(3),
+		{0x1},
+		chain.GetCanonicalHash(0),
+		chain.GetCanonicalHash(3),
+		{0x2},
+	}
+	headers := chain.GetHeadersByHashes(hashes)
+	if len(headers) != len(hashes) {
+		t.Fatalf("header count mismatch: have %d, want %d", len(headers), len(hashes))
+	}
+	for i, hash := range hashes {
+		want := chain.GetHeaderByHash(hash)
+		switch {
+		case want == nil && headers[i] != nil:
+			t.Fatalf("header %d: unexpected header for unknown hash %x", i, hash)
+		case want != nil && (headers[i] == nil || headers[i].Hash() != hash):
+			t.Fatalf("header %d: header mismatch: have %v, want %x", i, headers[i], hash)
+		}
+	}
+	if headers[1] != nil || headers[4] != nil {
+		t.Fatal("unknown hashes resolved")
+	}
+	if len(chain.GetHeadersByHashes(nil)) != 0 {
+		t.Fatal("headers returned for no hashes")
+	}
+}
@@ -42,6 +42,42 @@ var (
 
 	// ErrKnownBadBlock is return when the block is a known bad block
 	ErrKnownBadBlock = errors.New("already known bad block")
+
+	// ErrTxNotFound is returned when the transaction is not found in the local
+	// transaction index.
+	ErrTxNotFound = errors.New("transaction not found")
+
+	// ErrSetHeadNoRewind is returned when the chain is asked to rewind to a head
+	// which is not below the current head header, so nothing would be rewound.
+	ErrSetHeadNoRewind = errors.New("requested head is not below the current head")
+
+	// ErrResetNotCanonical is returned when the chain is asked to reset to a block
+	// which is not part of the canonical chain.
+	ErrResetNotCanonical = errors.New("reset target is not canonical")
+
+	// ErrResetNoState is returned when the chain is asked to reset to a block whose
+	// state is not available.
+	ErrResetNoState = errors.New("reset target state is not available")
+
+	// ErrReorgRejected is returned by InsertChainNoReorg when importing the batch
+	// would reorganise the canonical chain.
+	ErrReorgRejected = errors.New("batch would reorg the canonical chain")
+
+	// ErrDiffLayerNotFound is returned when the diff layer of a block is neither
+	// cached nor available in the diff store.
+	ErrDiffLayerNotFound = errors.New("diff layer not found")
+
+	// ErrDiffLayerWaitTimeout is returned when the diff layer of a block is not
+	// cached within the allowed time.
+	ErrDiffLayerWaitTimeout = errors.New("timeout waiting for diff layer")
+
+	// ErrFinalizedReorg is returned when a reorg would drop a finalized block from
+	// the canonical chain.
+	ErrFinalizedReorg = errors.New("reorg below finalized block")
+
+	// ErrFilteredSender is returned when a block to import contains a transaction
+	// from a sender rejected by the configured sender filter.
+	ErrFilteredSender = errors.New("transaction from filtered sender")
 )
 
 // List of evm-call-message pre-checking errors. All state transition messages will
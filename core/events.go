@@ -49,4 +49,29 @@ type ChainSideEvent struct {
 	Block *types.Block
 }
 
+// ChainSideBatchEvent is posted once per reorg with all the blocks removed from
+// the canonical chain, oldest first, as an alternative to the ChainSideEvent
+// posted for each of them.
+type ChainSideBatchEvent struct {
+	Blocks []*types.Block
+}
+
 type ChainHeadEvent struct{ Block *types.Block }
+
+// DoubleSignEvent is posted when the double sign monitor detects two different
+// headers signed by the same validator for the same height and parent.
+type DoubleSignEvent struct {
+	Header1 *types.Header
+	Header2 *types.Header
+	Signer  common.Address
+}
+
+// SnapGenEvent is posted periodically while the state snapshot is generated,
+// and once more when the generation completes.
+type SnapGenEvent struct {
+	Root     common.Hash        // Root of the snapshot disk layer
+	Accounts uint64             // Number of accounts generated so far
+	Slots    uint64             // Number of storage slots generated so far
+	Storage  common.StorageSize // Total size of the generated accounts and slots
+	Done     bool               // Whether the generation has completed
+}
@@ -521,6 +521,23 @@ func (hc *HeaderChain) GetHeaderByHash(hash common.Hash) *types.Header {
 	return hc.GetHeader(hash, *number)
 }
 
+// GetHeadersByHashes retrieves the block headers with the given hashes, in the
+// same order, with nil entries for the unknown ones. Cached headers are served
+// without resolving their numbers first.
+func (hc *HeaderChain) GetHeadersByHashes(hashes []common.Hash) []*types.Header {
+	headers := make([]*types.Header, len(hashes))
+	for i, hash := range hashes {
+		if header, ok := hc.headerCache.Get(hash); ok {
+			headers[i] = header
+			continue
+		}
+		if number := hc.GetBlockNumber(hash); number != nil {
+			headers[i] = hc.GetHeader(hash, *number)
+		}
+	}
+	return headers
+}
+
 // HasHeader checks if a block header is present in the database or not.
 // In theory, if header is present in the database, all relative components
 // like td and hash->number should be present too.
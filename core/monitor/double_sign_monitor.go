@@ -2,6 +2,7 @@ package monitor
 
 import (
 	"bytes"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/prque"
@@ -11,19 +12,39 @@ import (
 )
 
 const (
-	MaxCacheHeader = 100
+	MaxCacheHeader = 100 // Default number of recent headers checked for double signs
+	MinCacheHeader = 16  // Minimum number of recent headers checked for double signs
+	MaxCacheReport = 100
 )
 
-func NewDoubleSignMonitor() *DoubleSignMonitor {
+// DoubleSignReport is a detected pair of headers signed by the same miner for
+// the same height and parent.
+type DoubleSignReport struct {
+	Number  uint64
+	Header1 *types.Header
+	Header2 *types.Header
+}
+
+// NewDoubleSignMonitor creates a double sign monitor tracking the last cacheSize
+// headers. The optional onDoubleSign callback is invoked with both conflicting
+// headers on every detection.
+func NewDoubleSignMonitor(cacheSize int, onDoubleSign func(h1, h2 *types.Header)) *DoubleSignMonitor {
 	return &DoubleSignMonitor{
+		cacheSize:     cacheSize,
 		headerNumbers: prque.New[int64, *types.Header](nil),
-		headers:       make(map[uint64]*types.Header, MaxCacheHeader),
+		headers:       make(map[uint64]*types.Header, cacheSize),
+		onDoubleSign:  onDoubleSign,
 	}
 }
 
 type DoubleSignMonitor struct {
+	cacheSize     int
 	headerNumbers *prque.Prque[int64, *types.Header]
 	headers       map[uint64]*types.Header
+	onDoubleSign  func(h1, h2 *types.Header)
+
+	reports     []DoubleSignReport // Most recent detected violations, capped to MaxCacheReport
+	reportsLock sync.RWMutex
 }
 
 func (m *DoubleSignMonitor) isDoubleSignHeaders(h1, h2 *types.Header) (bool, error) {
@@ -57,7 +78,7 @@ func (m *DoubleSignMonitor) deleteOldHeader() {
 func (m *DoubleSignMonitor) checkHeader(h *types.Header) (bool, *types.Header, error) {
 	h2, exist := m.headers[h.Number.Uint64()]
 	if !exist {
-		if m.headerNumbers.Size() > MaxCacheHeader {
+		if m.headerNumbers.Size() > m.cacheSize {
 			m.deleteOldHeader()
 		}
 		m.headers[h.Number.Uint64()] = h
@@ -98,5 +119,35 @@ func (m *DoubleSignMonitor) Verify(h *types.Header) {
 		log.Warn("double sign header content",
 			"header1", hexutil.Encode(h1Bytes),
 			"header2", hexutil.Encode(h2Bytes))
+
+		m.addReport(DoubleSignReport{Number: h.Number.Uint64(), Header1: h, Header2: h2})
+		if m.onDoubleSign != nil {
+			m.onDoubleSign(h, h2)
+		}
+	}
+}
+
+func (m *DoubleSignMonitor) addReport(report DoubleSignReport) {
+	m.reportsLock.Lock()
+	defer m.reportsLock.Unlock()
+
+	if len(m.reports) >= MaxCacheReport {
+		m.reports = m.reports[1:]
 	}
+	m.reports = append(m.reports, report)
+}
+
+// CacheSize returns the number of recent headers checked for double signs.
+func (m *DoubleSignMonitor) CacheSize() int {
+	return m.cacheSize
+}
+
+// Reports returns the most recent detected double sign violations, oldest first.
+func (m *DoubleSignMonitor) Reports() []DoubleSignReport {
+	m.reportsLock.RLock()
+	defer m.reportsLock.RUnlock()
+
+	reports := make([]DoubleSignReport, len(m.reports))
+	copy(reports, m.reports)
+	return reports
 }
@@ -0,0 +1,42 @@
+package monitor
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoubleSignMonitorReports(t *testing.T) {
+	doubleSignMonitor := NewDoubleSignMonitor(MaxCacheHeader, nil)
+	header := func(number int64, coinbase byte, extra byte) *types.Header {
+		return &types.Header{
+			ParentHash: common.Hash{0x01},
+			Number:     big.NewInt(number),
+			Coinbase:   common.Address{coinbase},
+			Difficulty: big.NewInt(2),
+			Extra:      []byte{extra},
+		}
+	}
+	// case 1, different miners at the same height are not reported
+	doubleSignMonitor.Verify(header(10, 0x01, 0x01))
+	doubleSignMonitor.Verify(header(10, 0x02, 0x02))
+	assert.Equal(t, 0, len(doubleSignMonitor.Reports()))
+
+	// case 2, the same header seen twice is not reported
+	doubleSignMonitor.Verify(header(10, 0x01, 0x01))
+	assert.Equal(t, 0, len(doubleSignMonitor.Reports()))
+
+	// case 3, the same miner signing two headers is reported
+	h1, h2 := header(11, 0x01, 0x01), header(11, 0x01, 0x02)
+	doubleSignMonitor.Verify(h1)
+	doubleSignMonitor.Verify(h2)
+
+	reports := doubleSignMonitor.Reports()
+	assert.Equal(t, 1, len(reports))
+	assert.Equal(t, uint64(11), reports[0].Number)
+	assert.Equal(t, h2.Hash(), reports[0].Header1.Hash())
+	assert.Equal(t, h1.Hash(), reports[0].Header2.Hash())
+}
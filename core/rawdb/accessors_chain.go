@@ -721,6 +721,49 @@ func DeleteReceipts(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
 	}
 }
 
+// ReadOrphanReceiptsRLP retrieves the retained receipts of a block reorged out
+// of the canonical chain in RLP encoding.
+func ReadOrphanReceiptsRLP(db ethdb.KeyValueReader, hash common.Hash) rlp.RawValue {
+	data, _ := db.Get(orphanReceiptsKey(hash))
+	return data
+}
+
+// ReadOrphanReceipts retrieves the retained receipts of a block reorged out of
+// the canonical chain. Like with ReadRawReceipts, the receipt metadata fields
+// are not populated.
+func ReadOrphanReceipts(db ethdb.KeyValueReader, hash common.Hash) types.Receipts {
+	data := ReadOrphanReceiptsRLP(db, hash)
+	if len(data) == 0 {
+		return nil
+	}
+	storageReceipts := []*types.ReceiptForStorage{}
+	if err := rlp.DecodeBytes(data, &storageReceipts); err != nil {
+		log.Error("Invalid orphan receipt array RLP", "hash", hash, "err", err)
+		return nil
+	}
+	receipts := make(types.Receipts, len(storageReceipts))
+	for i, storageReceipt := range storageReceipts {
+		receipts[i] = (*types.Receipt)(storageReceipt)
+	}
+	return receipts
+}
+
+// WriteOrphanReceiptsRLP stores the receipts of a block reorged out of the
+// canonical chain, in the storage RLP encoding of the block receipts.
+func WriteOrphanReceiptsRLP(db ethdb.KeyValueWriter, hash common.Hash, receipts rlp.RawValue) {
+	if err := db.Put(orphanReceiptsKey(hash), receipts); err != nil {
+		log.Crit("Failed to store orphan receipts", "err", err)
+	}
+}
+
+// DeleteOrphanReceipts removes the retained receipts of a block reorged out of
+// the canonical chain.
+func DeleteOrphanReceipts(db ethdb.KeyValueWriter, hash common.Hash) {
+	if err := db.Delete(orphanReceiptsKey(hash)); err != nil {
+		log.Crit("Failed to delete orphan receipts", "err", err)
+	}
+}
+
 // storedReceiptRLP is the storage encoding of a receipt.
 // Re-definition in core/types/receipt.go.
 // TODO: Re-use the existing definition.
@@ -10,6 +10,7 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
@@ -41,6 +42,8 @@ var (
 	verifyTaskFailedMeter  = metrics.NewRegisteredMeter("verifymanager/task/result/failed", nil)
 
 	verifyTaskExecutionTimer = metrics.NewRegisteredTimer("verifymanager/task/execution", nil)
+
+	verifySkippedMeter = metrics.NewRegisteredMeter("verifymanager/task/skipped", nil)
 )
 
 type remoteVerifyManager struct {
@@ -175,6 +178,13 @@ func (vm *remoteVerifyManager) NewBlockVerifyTask(header *types.Header) {
 				vm.cacheBlockVerified(hash)
 				return
 			}
+			// if the block is not sampled for remote verification, trust the local execution.
+			if !vm.sampled() && !vm.suspicious(header) {
+				log.Debug("block is not sampled for verification", "block", hash, "number", header.Number)
+				vm.cacheBlockVerified(hash)
+				verifySkippedMeter.Mark(1)
+				return
+			}
 
 			var diffLayer *types.DiffLayer
 			if cached, ok := vm.bc.diffLayerChanCache.Get(hash); ok {
@@ -202,6 +212,20 @@ func (vm *remoteVerifyManager) NewBlockVerifyTask(header *types.Header) {
 	}
 }
 
+// sampled reports whether a block should be verified remotely, which is the
+// case for a random fraction of the blocks if sampled remote verify is enabled,
+// and for all of them otherwise.
+func (vm *remoteVerifyManager) sampled() bool {
+	fraction := vm.bc.remoteVerifyFraction
+	return fraction == 0 || fraction >= 1 || rand.Float64() < fraction
+}
+
+// suspicious reports whether a competing block is known at the height of the
+// given one, which makes it a reorg candidate.
+func (vm *remoteVerifyManager) suspicious(header *types.Header) bool {
+	return len(rawdb.ReadAllHashes(vm.bc.db.BlockStore(), header.Number.Uint64())) > 1
+}
+
 func (vm *remoteVerifyManager) cacheBlockVerified(hash common.Hash) {
 	if vm.verifiedCache.Len() >= verifiedCacheSize {
 		vm.verifiedCache.RemoveOldest()
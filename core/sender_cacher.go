@@ -42,6 +42,7 @@ type txSenderCacherRequest struct {
 type txSenderCacher struct {
 	threads int
 	tasks   chan *txSenderCacherRequest
+	quit    chan struct{}
 }
 
 // newTxSenderCacher creates a new transaction sender background cacher and starts
@@ -50,6 +51,7 @@ func newTxSenderCacher(threads int) *txSenderCacher {
 	cacher := &txSenderCacher{
 		tasks:   make(chan *txSenderCacherRequest, threads),
 		threads: threads,
+		quit:    make(chan struct{}),
 	}
 	for i := 0; i < threads; i++ {
 		go cacher.cache()
@@ -60,13 +62,24 @@ func newTxSenderCacher(threads int) *txSenderCacher {
 // cache is an infinite loop, caching transaction senders from various forms of
 // data structures.
 func (cacher *txSenderCacher) cache() {
-	for task := range cacher.tasks {
-		for i := 0; i < len(task.txs); i += task.inc {
-			types.Sender(task.signer, task.txs[i])
+	for {
+		select {
+		case task := <-cacher.tasks:
+			for i := 0; i < len(task.txs); i += task.inc {
+				types.Sender(task.signer, task.txs[i])
+			}
+		case <-cacher.quit:
+			return
 		}
 	}
 }
 
+// close terminates the background goroutines of the cacher. Any recoveries not
+// yet scheduled are dropped, the senders are recovered on demand instead.
+func (cacher *txSenderCacher) close() {
+	close(cacher.quit)
+}
+
 // Recover recovers the senders from a batch of transactions and caches them
 // back into the same data structures. There is no validation being done, nor
 // any reaction to invalid signatures. That is up to calling code later.
@@ -81,10 +94,14 @@ func (cacher *txSenderCacher) Recover(signer types.Signer, txs []*types.Transact
 		tasks = (len(txs) + 3) / 4
 	}
 	for i := 0; i < tasks; i++ {
-		cacher.tasks <- &txSenderCacherRequest{
+		select {
+		case cacher.tasks <- &txSenderCacherRequest{
 			signer: signer,
 			txs:    txs[i:],
 			inc:    tasks,
+		}:
+		case <-cacher.quit:
+			return
 		}
 	}
 }
@@ -498,6 +498,7 @@ func (dl *diskLayer) checkAndFlush(ctx *generatorContext, current []byte) error
 
 		dl.lock.Lock()
 		dl.genMarker = current
+		dl.genStats = *ctx.stats
 		dl.lock.Unlock()
 
 		if abort != nil {
@@ -715,6 +716,7 @@ func (dl *diskLayer) generate(stats *generatorStats) {
 
 	dl.lock.Lock()
 	dl.genMarker = nil
+	dl.genStats = *stats
 	close(dl.genPending)
 	dl.lock.Unlock()
 
@@ -85,6 +85,42 @@ func testGeneration(t *testing.T, scheme string) {
 	<-stop
 }
 
+// Tests that the generation progress is reported through the snapshot tree.
+func TestGenerationProgress(t *testing.T) {
+	var helper = newHelper(rawdb.HashScheme)
+	stRoot := helper.makeStorageTrie(common.Hash{}, []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"}, false)
+
+	helper.addTrieAccount("acc-1", &types.StateAccount{Balance: uint256.NewInt(1), Root: stRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	helper.addTrieAccount("acc-2", &types.StateAccount{Balance: uint256.NewInt(2), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()})
+	helper.addTrieAccount("acc-3", &types.StateAccount{Balance: uint256.NewInt(3), Root: stRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+
+	helper.makeStorageTrie(hashData([]byte("acc-1")), []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"}, true)
+	helper.makeStorageTrie(hashData([]byte("acc-3")), []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"}, true)
+
+	root, snap := helper.CommitAndGenerate()
+	select {
+	case <-snap.genPending:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Snapshot generation failed")
+	}
+	defer func() {
+		stop := make(chan *generatorStats)
+		snap.genAbort <- stop
+		<-stop
+	}()
+	tree := &Tree{layers: map[common.Hash]snapshot{root: snap}}
+	progress, err := tree.GenerationProgress()
+	if err != nil {
+		t.Fatalf("failed to retrieve progress: %v", err)
+	}
+	if progress.Root != root || !progress.Done {
+		t.Fatalf("progress mismatch: root %#x done %v, want root %#x done", progress.Root, progress.Done, root)
+	}
+	if progress.Accounts != 3 || progress.Slots != 6 {
+		t.Fatalf("generated items mismatch: have %d accounts %d slots, want 3 accounts 6 slots", progress.Accounts, progress.Slots)
+	}
+}
+
 // Tests that snapshot generation with existent flat state.
 func TestGenerateExistentState(t *testing.T) {
 	testGenerateExistentState(t, rawdb.HashScheme)
@@ -675,6 +675,7 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 		triedb:     base.triedb,
 		genMarker:  base.genMarker,
 		genPending: base.genPending,
+		genStats:   base.genStats,
 	}
 	// If snapshot generation hasn't finished yet, port over all the starts and
 	// continue where the previous round left off.
@@ -683,6 +684,7 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 	// to allow the tests to play with the marker without triggering this path.
 	if base.genMarker != nil && base.genAbort != nil {
 		res.genMarker = base.genMarker
+		res.genStats = *stats
 		res.genAbort = make(chan chan *generatorStats)
 		go res.generate(stats)
 	}
@@ -890,6 +892,37 @@ func (t *Tree) generating() (bool, error) {
 	return layer.genMarker != nil, nil
 }
 
+// GenerationProgress is a summary of the disk layer generation progress.
+type GenerationProgress struct {
+	Root     common.Hash        // Root of the disk layer being generated
+	Accounts uint64             // Number of accounts indexed so far
+	Slots    uint64             // Number of storage slots indexed so far
+	Storage  common.StorageSize // Total size of the indexed accounts and slots
+	Done     bool               // Whether the generation has completed
+}
+
+// GenerationProgress returns the progress of the disk layer generation as of
+// the last flushed batch.
+func (t *Tree) GenerationProgress() (GenerationProgress, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	layer := t.disklayer()
+	if layer == nil {
+		return GenerationProgress{}, errors.New("disk layer is missing")
+	}
+	layer.lock.RLock()
+	defer layer.lock.RUnlock()
+
+	return GenerationProgress{
+		Root:     layer.root,
+		Accounts: layer.genStats.accounts,
+		Slots:    layer.genStats.slots,
+		Storage:  layer.genStats.storage,
+		Done:     layer.genMarker == nil,
+	}, nil
+}
+
 // DiskRoot is a external helper function to return the disk layer root.
 func (t *Tree) DiskRoot() common.Hash {
 	t.lock.Lock()
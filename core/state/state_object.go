@@ -254,6 +254,7 @@ func (s *stateObject) GetCommittedState(key common.Hash) common.Hash {
 		if metrics.EnabledExpensive {
 			s.db.StorageReads += time.Since(start)
 		}
+		s.db.StorageTrieReads += 1
 		if err != nil {
 			s.db.setError(err)
 			return common.Hash{}
@@ -83,6 +83,7 @@ type StateDB struct {
 
 	fullProcessed bool
 	pipeCommit    bool
+	skipDiffLayer bool // Whether to skip building the diff layer on commit
 
 	// These maps hold the state changes (including the corresponding
 	// original value) that occurred in this **block**.
@@ -156,6 +157,11 @@ type StateDB struct {
 	AccountDeleted int
 	StorageDeleted int
 
+	// Number of accounts and storage slots read from the tries, i.e. missed
+	// by the snapshot (if any)
+	AccountTrieReads int
+	StorageTrieReads int
+
 	// Testing hooks
 	onCommit func(states *triestate.Set) // Hook invoked when commit is performed
 }
@@ -314,6 +320,12 @@ func (s *StateDB) IsPipeCommit() bool {
 	return s.pipeCommit
 }
 
+// SkipDiffLayer marks that no diff layer needs to be built on commit, e.g. for
+// blocks with an empty body whose diff layer would be discarded anyway.
+func (s *StateDB) SkipDiffLayer() {
+	s.skipDiffLayer = true
+}
+
 // Mark that the block is full processed
 func (s *StateDB) MarkFullProcessed() {
 	s.fullProcessed = true
@@ -759,6 +771,7 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 		if metrics.EnabledExpensive {
 			s.AccountReads += time.Since(start)
 		}
+		s.AccountTrieReads += 1
 		if err != nil {
 			s.setError(fmt.Errorf("getDeleteStateObject (%x) error: %w", addr.Bytes(), err))
 			return nil
@@ -1497,7 +1510,7 @@ func (s *StateDB) Commit(block uint64, failPostCommitFunc func(), postCommitFunc
 		nodes       = trienode.NewMergedNodeSet()
 	)
 
-	if s.snap != nil {
+	if s.snap != nil && !s.skipDiffLayer {
 		diffLayer = &types.DiffLayer{}
 	}
 	if s.pipeCommit {
@@ -1664,7 +1677,7 @@ func (s *StateDB) Commit(block uint64, failPostCommitFunc func(), postCommitFunc
 					if obj.code != nil && obj.dirtyCode {
 						rawdb.WriteCode(codeWriter, common.BytesToHash(obj.CodeHash()), obj.code)
 						obj.dirtyCode = false
-						if s.snap != nil {
+						if diffLayer != nil {
 							diffLayer.Codes = append(diffLayer.Codes, types.DiffCode{
 								Hash: common.BytesToHash(obj.CodeHash()),
 								Code: obj.code,
@@ -1698,7 +1711,9 @@ func (s *StateDB) Commit(block uint64, failPostCommitFunc func(), postCommitFunc
 					// State verification pipeline - accounts root are not calculated here, just populate needed fields for process
 					s.PopulateSnapAccountAndStorage()
 				}
-				diffLayer.Destructs, diffLayer.Accounts, diffLayer.Storages = s.SnapToDiffLayer()
+				if diffLayer != nil {
+					diffLayer.Destructs, diffLayer.Accounts, diffLayer.Storages = s.SnapToDiffLayer()
+				}
 				// Only update if there's a state transition (skip empty Clique blocks)
 				if parent := s.snap.Root(); parent != s.expectedRoot {
 					err := s.snaps.Update(s.expectedRoot, parent, s.convertAccountSet(s.stateObjectsDestruct), s.accounts, s.storages, verified)
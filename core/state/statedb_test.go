@@ -1206,3 +1206,33 @@ func TestDeleteStorage(t *testing.T) {
 		t.Fatalf("difference found:\nfast: %v\nslow: %v\n", fastRes, slowRes)
 	}
 }
+
+func TestTrieReadCounters(t *testing.T) {
+	var (
+		disk     = rawdb.NewMemoryDatabase()
+		tdb      = triedb.NewDatabase(disk, nil)
+		db       = NewDatabaseWithNodeDB(disk, tdb)
+		snaps, _ = snapshot.New(snapshot.Config{CacheSize: 10}, disk, tdb, types.EmptyRootHash, 128, false)
+		state, _ = New(types.EmptyRootHash, db, snaps)
+		addr     = common.HexToAddress("0x1")
+		slot     = common.HexToHash("0x1")
+	)
+	state.SetBalance(addr, uint256.NewInt(1))
+	state.SetState(addr, slot, common.HexToHash("0x2"))
+	root, _, _ := state.Commit(0, nil)
+
+	// Reads served by the snapshot must not be counted
+	fastState, _ := New(root, db, snaps)
+	fastState.GetState(addr, slot)
+	if fastState.AccountTrieReads != 0 || fastState.StorageTrieReads != 0 {
+		t.Fatalf("unexpected trie reads with snapshot: accounts %d, storage %d", fastState.AccountTrieReads, fastState.StorageTrieReads)
+	}
+	// Reads without snapshot hit the tries, cached objects only once
+	slowState, _ := New(root, db, nil)
+	slowState.GetState(addr, slot)
+	slowState.GetState(addr, slot)
+	slowState.GetState(common.HexToAddress("0x2"), slot)
+	if slowState.AccountTrieReads != 2 || slowState.StorageTrieReads != 1 {
+		t.Fatalf("unexpected trie reads without snapshot: accounts %d, storage %d, want 2, 1", slowState.AccountTrieReads, slowState.StorageTrieReads)
+	}
+}
@@ -58,7 +58,7 @@ func TestPrefetchLeaking(t *testing.T) {
 
 	block := blocks[0]
 	parent := archive.GetHeader(block.ParentHash(), block.NumberU64()-1)
-	statedb, _ := state.NewWithSharedPool(parent.Root, archive.stateCache, archive.snaps)
+	statedb, _ := state.NewWithSharedPool(parent.Root, archive.stateCache, archive.snaps.Load())
 	inter := make(chan struct{})
 
 	Track(ctx, t, func(ctx context.Context) {
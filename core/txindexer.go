@@ -19,6 +19,7 @@ package core
 import (
 	"errors"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -27,8 +28,9 @@ import (
 
 // TxIndexProgress is the struct describing the progress for transaction indexing.
 type TxIndexProgress struct {
-	Indexed   uint64 // number of blocks whose transactions are indexed
-	Remaining uint64 // number of blocks whose transactions are not indexed yet
+	Indexed     uint64 // number of blocks whose transactions are indexed
+	IndexedFrom uint64 // oldest block whose transactions are indexed, meaningless if none are
+	Remaining   uint64 // number of blocks whose transactions are not indexed yet
 }
 
 // Done returns an indicator if the transaction indexing is finished.
@@ -49,6 +51,9 @@ type txIndexer struct {
 	progress chan chan TxIndexProgress
 	term     chan chan struct{}
 	closed   chan struct{}
+
+	paused atomic.Bool   // Whether new indexing tasks are deferred
+	resume chan struct{} // Channel to schedule the deferred indexing on resume
 }
 
 // newTxIndexer initializes the transaction indexer.
@@ -59,6 +64,7 @@ func newTxIndexer(limit uint64, chain *BlockChain) *txIndexer {
 		progress: make(chan chan TxIndexProgress),
 		term:     make(chan chan struct{}),
 		closed:   make(chan struct{}),
+		resume:   make(chan struct{}),
 	}
 	go indexer.loop(chain)
 
@@ -148,12 +154,18 @@ func (indexer *txIndexer) loop(chain *BlockChain) {
 	for {
 		select {
 		case head := <-headCh:
-			if done == nil {
+			if done == nil && !indexer.paused.Load() {
 				stop = make(chan struct{})
 				done = make(chan struct{})
 				go indexer.run(rawdb.ReadTxIndexTail(indexer.db), head.Block.NumberU64(), stop, done)
 			}
 			lastHead = head.Block.NumberU64()
+		case <-indexer.resume:
+			if done == nil && lastHead != 0 {
+				stop = make(chan struct{})
+				done = make(chan struct{})
+				go indexer.run(rawdb.ReadTxIndexTail(indexer.db), lastHead, stop, done)
+			}
 		case <-done:
 			stop = nil
 			done = nil
@@ -180,9 +192,9 @@ func (indexer *txIndexer) report(head uint64, tail *uint64) TxIndexProgress {
 	if indexer.limit == 0 || total > head {
 		total = head + 1 // genesis included
 	}
-	var indexed uint64
+	var indexed, indexedFrom uint64
 	if tail != nil {
-		indexed = head - *tail + 1
+		indexed, indexedFrom = head-*tail+1, *tail
 	}
 	// The value of indexed might be larger than total if some blocks need
 	// to be unindexed, avoiding a negative remaining.
@@ -191,8 +203,9 @@ func (indexer *txIndexer) report(head uint64, tail *uint64) TxIndexProgress {
 		remaining = total - indexed
 	}
 	return TxIndexProgress{
-		Indexed:   indexed,
-		Remaining: remaining,
+		Indexed:     indexed,
+		IndexedFrom: indexedFrom,
+		Remaining:   remaining,
 	}
 }
 
@@ -208,6 +221,24 @@ func (indexer *txIndexer) txIndexProgress() (TxIndexProgress, error) {
 	}
 }
 
+// pause defers the scheduling of new indexing tasks until resumed, a task which
+// is already running is left to complete.
+func (indexer *txIndexer) pause() {
+	indexer.paused.Store(true)
+}
+
+// resumeIndexing schedules the indexing deferred while paused, continuing from
+// the current index tail towards the last announced head.
+func (indexer *txIndexer) resumeIndexing() {
+	if !indexer.paused.CompareAndSwap(true, false) {
+		return
+	}
+	select {
+	case indexer.resume <- struct{}{}:
+	case <-indexer.closed:
+	}
+}
+
 // close shutdown the indexer. Safe to be called for multiple times.
 func (indexer *txIndexer) close() {
 	ch := make(chan struct{})
@@ -20,11 +20,13 @@ import (
 	"math/big"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
@@ -89,6 +91,9 @@ func TestTxIndexer(t *testing.T) {
 		if !progress.Done() {
 			t.Fatalf("Expect fully indexed")
 		}
+		if progress.IndexedFrom != expTail {
+			t.Fatalf("Unexpected indexed from, want %d, got %d", expTail, progress.IndexedFrom)
+		}
 	}
 
 	var cases = []struct {
@@ -241,3 +246,61 @@ func TestTxIndexer(t *testing.T) {
 		os.RemoveAll(frdir)
 	}
 }
+
+// TestPauseTxIndexing tests that no indexing work is scheduled while the
+// indexer is paused, and that it catches up from the current tail on resume.
+func TestPauseTxIndexing(t *testing.T) {
+	var (
+		testBankKey, _  = crypto.GenerateKey()
+		testBankAddress = crypto.PubkeyToAddress(testBankKey.PublicKey)
+		testBankFunds   = big.NewInt(1000000000000000000)
+
+		gspec = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   types.GenesisAlloc{testBankAddress: {Balance: testBankFunds}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		engine = ethash.NewFaker()
+		nonce  = uint64(0)
+		limit  = uint64(0)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, engine, 32, func(i int, gen *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, common.HexToAddress("0xdeadbeef"), big.NewInt(1000), params.TxGas, big.NewInt(10*params.InitialBaseFee), nil), types.HomesteadSigner{}, testBankKey)
+		gen.AddTx(tx)
+		nonce += 1
+	})
+	db := rawdb.NewMemoryDatabase()
+	chain, err := NewBlockChain(db, nil, gspec, nil, engine, vm.Config{}, nil, &limit)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	chain.PauseTxIndexing()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if tail := rawdb.ReadTxIndexTail(db); tail != nil {
+		t.Fatalf("unexpected indexing while paused, tail %d", *tail)
+	}
+
+	chain.ResumeTxIndexing()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if tail := rawdb.ReadTxIndexTail(db); tail != nil && *tail == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("transaction indexing not resumed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	progress, err := chain.TxIndexProgress()
+	if err != nil {
+		t.Fatalf("failed to retrieve progress: %v", err)
+	}
+	if !progress.Done() {
+		t.Fatalf("expected fully indexed, got %+v", progress)
+	}
+}
@@ -280,6 +280,9 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 			PathSyncFlush:       config.PathSyncFlush,
 			JournalFilePath:     journalFilePath,
 			JournalFile:         config.JournalFileEnabled,
+
+			NoSnapshotPrefetch:      config.NoSnapshotPrefetch,
+			NoTriePrefetchInAdvance: config.NoTriePrefetchInAdvance,
 		}
 	)
 	bcOps := make([]core.BlockChainOption, 0)
@@ -290,7 +293,7 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 		bcOps = append(bcOps, core.EnablePersistDiff(config.DiffBlock))
 	}
 	if stack.Config().EnableDoubleSignMonitor {
-		bcOps = append(bcOps, core.EnableDoubleSignChecker)
+		bcOps = append(bcOps, core.EnableDoubleSignChecker(0))
 	}
 
 	peers := newPeerSet()
@@ -26,6 +26,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/beacon/engine"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/txpool"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto/kzg4844"
@@ -286,7 +287,11 @@ func (c *SimulatedBeacon) Fork(parentHash common.Hash) error {
 	if parent == nil {
 		return errors.New("parent not found")
 	}
-	return c.eth.BlockChain().SetHead(parent.NumberU64())
+	// Forking off the current head leaves nothing to rewind
+	if err := c.eth.BlockChain().SetHead(parent.NumberU64()); err != nil && !errors.Is(err, core.ErrSetHeadNoRewind) {
+		return err
+	}
+	return nil
 }
 
 // AdjustTime creates a new block with an adjusted timestamp.
@@ -565,9 +565,10 @@ func (d *Downloader) syncWithPeer(p *peerConnection, hash common.Hash, td, ttd *
 		} else if d.ancientLimit > 0 {
 			log.Debug("Enabling direct-ancient mode", "ancient", d.ancientLimit)
 		}
-		// Rewind the ancient store and blockchain if reorg happens.
+		// Rewind the ancient store and blockchain if reorg happens. The head
+		// header may already sit at the origin, nothing to rewind then.
 		if origin+1 < frozen {
-			if err := d.lightchain.SetHead(origin); err != nil {
+			if err := d.lightchain.SetHead(origin); err != nil && !errors.Is(err, core.ErrSetHeadNoRewind) {
 				return err
 			}
 			log.Info("Truncated excess ancient chain segment", "oldhead", frozen-1, "newhead", origin)
@@ -102,13 +102,15 @@ type Config struct {
 	TrustDiscoveryURLs []string
 	BscDiscoveryURLs   []string
 
-	NoPruning           bool // Whether to disable pruning and flush everything to disk
-	NoPrefetch          bool
-	DirectBroadcast     bool
-	DisableSnapProtocol bool // Whether disable snap protocol
-	EnableTrustProtocol bool // Whether enable trust protocol
-	PipeCommit          bool
-	RangeLimit          bool
+	NoPruning               bool // Whether to disable pruning and flush everything to disk
+	NoPrefetch              bool
+	NoSnapshotPrefetch      bool // Whether to disable the speculative execution of large blocks ahead of their import
+	NoTriePrefetchInAdvance bool // Whether to disable the trie prefetch of the senders and recipients of large blocks
+	DirectBroadcast         bool
+	DisableSnapProtocol     bool // Whether disable snap protocol
+	EnableTrustProtocol     bool // Whether enable trust protocol
+	PipeCommit              bool
+	RangeLimit              bool
 
 	// Deprecated, use 'TransactionHistory' instead.
 	TxLookupLimit      uint64 `toml:",omitempty"` // The maximum number of blocks from head whose tx indices are reserved.
@@ -27,6 +27,8 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		BscDiscoveryURLs        []string
 		NoPruning               bool
 		NoPrefetch              bool
+		NoSnapshotPrefetch      bool
+		NoTriePrefetchInAdvance bool
 		DirectBroadcast         bool
 		DisableSnapProtocol     bool
 		EnableTrustProtocol     bool
@@ -85,6 +87,8 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.BscDiscoveryURLs = c.BscDiscoveryURLs
 	enc.NoPruning = c.NoPruning
 	enc.NoPrefetch = c.NoPrefetch
+	enc.NoSnapshotPrefetch = c.NoSnapshotPrefetch
+	enc.NoTriePrefetchInAdvance = c.NoTriePrefetchInAdvance
 	enc.DirectBroadcast = c.DirectBroadcast
 	enc.DisableSnapProtocol = c.DisableSnapProtocol
 	enc.EnableTrustProtocol = c.EnableTrustProtocol
@@ -147,6 +151,8 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		BscDiscoveryURLs        []string
 		NoPruning               *bool
 		NoPrefetch              *bool
+		NoSnapshotPrefetch      *bool
+		NoTriePrefetchInAdvance *bool
 		DirectBroadcast         *bool
 		DisableSnapProtocol     *bool
 		EnableTrustProtocol     *bool
@@ -228,6 +234,12 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.NoPrefetch != nil {
 		c.NoPrefetch = *dec.NoPrefetch
 	}
+	if dec.NoSnapshotPrefetch != nil {
+		c.NoSnapshotPrefetch = *dec.NoSnapshotPrefetch
+	}
+	if dec.NoTriePrefetchInAdvance != nil {
+		c.NoTriePrefetchInAdvance = *dec.NoTriePrefetchInAdvance
+	}
 	if dec.DirectBroadcast != nil {
 		c.DirectBroadcast = *dec.DirectBroadcast
 	}
@@ -270,19 +270,16 @@ func ServiceGetReceiptsQuery(chain *core.BlockChain, query GetReceiptsRequest) [
 			break
 		}
 		// Retrieve the requested block's receipts
-		results := chain.GetReceiptsByHash(hash)
-		if results == nil {
+		encoded := chain.GetReceiptsRLP(hash)
+		if encoded == nil {
 			if header := chain.GetHeaderByHash(hash); header == nil || header.ReceiptHash != types.EmptyRootHash {
 				continue
 			}
+			encoded = rlp.EmptyList
 		}
-		// If known, encode and queue for response packet
-		if encoded, err := rlp.EncodeToBytes(results); err != nil {
-			log.Error("Failed to encode receipt", "err", err)
-		} else {
-			receipts = append(receipts, encoded)
-			bytes += len(encoded)
-		}
+		// If known, queue for response packet
+		receipts = append(receipts, encoded)
+		bytes += len(encoded)
 	}
 	return receipts
 }